@@ -1,41 +1,268 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 type APIServer struct {
 	listenAddr string
+	tlsCert    string
+	tlsKey     string
 	storage    Storage
+	fees       FeeCalculator
+	numbers    NumberGenerator
+	balances   *BalanceBroker
+	notifier   Notifier
+	webhooks   *WebhookSender
+	settlement Settlement
+	rates      RateProvider
+	features   Features
+	stats      statsCache
+
+	idempotency        IdempotencyStore
+	idempotencyTTL     time.Duration
+	idempotencyMetrics idempotencyMetrics
+
+	trustedProxies []*net.IPNet
+	schemas        map[string]*jsonschema.Schema
+	admins         map[int64]bool
+	contentTypes   map[string]bool
+	cors           *cors
+
+	numberRetries       int
+	defaultBalance      Money
+	maxTransferAmount   Money
+	nameCase            string
+	categories          map[string]bool
+	categoryList        []string
+	maxAccountsPerOwner int
+	requireVerification bool
+	confirmDeletes      bool
+	publicURL           string
+
+	passwordResetLimiter *RateLimiter
+	concurrency          *ConcurrencyLimiter
+	jwtTTL               time.Duration
+	loginMaxFailures     int
+	loginLockout         time.Duration
+	requestTimeout       time.Duration
+	shutdownTimeout      time.Duration
+	tokenCleanupInterval time.Duration
+
+	// maintenance is switched at runtime through /maintenance.
+	maintenance           atomic.Bool
+	maintenanceRetryAfter time.Duration
+
+	displayLocation *time.Location
 }
 
-func NewAPIServer(addr string, s Storage) *APIServer {
-	return &APIServer{
-		listenAddr: addr,
+func NewAPIServer(cfg *Config, s Storage, n Notifier) (*APIServer, error) {
+	schemas, err := loadSchemas(cfg.SchemaDir, SchemaCreateAccount, SchemaTransfer)
+	if err != nil {
+		return nil, err
+	}
+
+	admins := make(map[int64]bool)
+	for _, number := range cfg.AdminAccounts {
+		admins[number] = true
+	}
+
+	contentTypes := map[string]bool{"application/json": true}
+	if len(cfg.ContentTypes) > 0 {
+		contentTypes = make(map[string]bool)
+		for _, t := range cfg.ContentTypes {
+			contentTypes[t] = true
+		}
+	}
+
+	idempotency, err := newIdempotencyStore(cfg.IdempotencyStore, s)
+	if err != nil {
+		return nil, err
+	}
+	idempotencyTTL := cfg.IdempotencyKeyTTL
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = idempotencyKeyTTL
+	}
+
+	server := &APIServer{
+		listenAddr: cfg.ListenAddr,
+		tlsCert:    cfg.TLSCert,
+		tlsKey:     cfg.TLSKey,
 		storage:    s,
+		fees:       NewFeeCalculator(cfg),
+		numbers:    NewNumberGenerator(cfg),
+		balances:   NewBalanceBroker(),
+		notifier:   n,
+		settlement: logSettlement{},
+		rates:      staticRates{base: moneyCurrency, rates: cfg.ExchangeRates, at: time.Now().UTC()},
+		features:   cfg.Features,
+
+		idempotency:    idempotency,
+		idempotencyTTL: idempotencyTTL,
+
+		trustedProxies: cfg.TrustedProxies,
+		schemas:        schemas,
+		admins:         admins,
+		contentTypes:   contentTypes,
+		cors:           newCORS(cfg.CORS),
+
+		numberRetries:       cfg.AccountNumberRetries,
+		defaultBalance:      Money(cfg.DefaultBalance),
+		maxTransferAmount:   Money(cfg.MaxTransferAmount),
+		nameCase:            cfg.NameCase,
+		categories:          make(map[string]bool),
+		categoryList:        cfg.TransferCategories,
+		maxAccountsPerOwner: cfg.MaxAccountsPerOwner,
+		requireVerification: cfg.RequireVerification,
+		confirmDeletes:      cfg.RequireDeleteConfirmation,
+		publicURL:           cfg.PublicURL,
+
+		passwordResetLimiter: NewRateLimiter(cfg.PasswordResetRateLimit, time.Hour),
+		jwtTTL:               cfg.JWTTTL,
+		loginMaxFailures:     cfg.LoginMaxFailures,
+		loginLockout:         cfg.LoginLockout,
+		requestTimeout:       cfg.RequestTimeout,
+		shutdownTimeout:      cfg.ShutdownTimeout,
+		tokenCleanupInterval: cfg.TokenCleanupInterval,
+
+		maintenanceRetryAfter: cfg.MaintenanceRetryAfter,
+
+		displayLocation: cfg.DisplayLocation,
+	}
+	if cfg.WebhookURL != "" && cfg.Features.Enabled(FeatureWebhooks) {
+		server.webhooks = &WebhookSender{
+			URL:    cfg.WebhookURL,
+			Secret: cfg.WebhookSecret,
+			Client: &http.Client{Timeout: webhookTimeout},
+		}
 	}
+	for _, c := range cfg.TransferCategories {
+		server.categories[c] = true
+	}
+	if cfg.MaxConcurrentPerIP > 0 {
+		server.concurrency = NewConcurrencyLimiter(cfg.MaxConcurrentPerIP)
+	}
+	server.maintenance.Store(cfg.Maintenance)
+	return server, nil
 }
 
-func (s *APIServer) Run() {
+// router registers the routes of the API.
+func (s *APIServer) router() *mux.Router {
 	router := mux.NewRouter()
+	router.Use(s.withTimeout)
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusNotFound, ApiError{Error: fmt.Sprintf("no such route: %s", r.URL.Path), Code: CodeNotFound})
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusMethodNotAllowed, ApiError{Error: fmt.Sprintf("method not allowed, %s", r.Method), Code: CodeMethodNotAllowed})
+	})
 
+	router.HandleFunc("/livez", makeHTTPHandlerFunc(s.handleLivez))
+	router.HandleFunc("/readyz", makeHTTPHandlerFunc(s.handleReadyz))
 	router.HandleFunc("/login", makeHTTPHandlerFunc(s.handleLogin))
-	router.HandleFunc("/account", makeHTTPHandlerFunc(s.handleAccount))
+	router.HandleFunc("/verify", makeHTTPHandlerFunc(s.handleVerify))
+	router.HandleFunc("/password/reset/request", makeHTTPHandlerFunc(s.withRateLimit(s.passwordResetLimiter, s.handlePasswordResetRequest)))
+	router.HandleFunc("/password/reset/confirm", makeHTTPHandlerFunc(s.handlePasswordResetConfirm))
+	router.HandleFunc("/account", makeHTTPHandlerFunc(s.withSchema(SchemaCreateAccount, s.handleAccount)))
+	router.HandleFunc("/account/export", s.feature(FeatureExport, withAdminAuth(makeHTTPHandlerFunc(s.handleExportAccounts), s.admins)))
+	router.HandleFunc("/account/import", s.feature(FeatureImport, withAdminAuth(makeHTTPHandlerFunc(s.handleImportAccounts), s.admins)))
+	router.HandleFunc("/accounts/balances", withAdminAuth(makeHTTPHandlerFunc(s.handleAccountBalances), s.admins)).Methods(http.MethodPost)
+	router.HandleFunc("/accounts/by-number/{number:[0-9]+}", withAdminAuth(makeHTTPHandlerFunc(s.handleAccountByNumber), s.admins)).Methods(http.MethodGet)
+	router.HandleFunc("/account/me", withTokenAuth(makeHTTPHandlerFunc(s.handleGetMe))).Methods(http.MethodGet)
+	router.HandleFunc("/account/me/password", withTokenAuth(makeHTTPHandlerFunc(s.handleChangePassword))).Methods(http.MethodPost)
 	router.HandleFunc("/account/{id}", withJWTAuth(makeHTTPHandlerFunc(s.handleAccountByID), s.storage))
-	router.HandleFunc("/transfer", makeHTTPHandlerFunc(s.handleTransfer))
+	router.HandleFunc("/account/{id}/delete-request", withJWTAuth(makeHTTPHandlerFunc(s.handleDeleteRequest), s.storage)).Methods(http.MethodPost)
+	router.HandleFunc("/account/{id}/owners", withJWTAuth(makeHTTPHandlerFunc(s.handleAccountOwners), s.storage))
+	router.HandleFunc("/account/{id}/owners/{ownerId}", withJWTAuth(makeHTTPHandlerFunc(s.handleRemoveAccountOwner), s.storage))
+	router.HandleFunc("/account/{id}/balance", withJWTAuth(makeHTTPHandlerFunc(s.handleAccountBalance), s.storage))
+	router.HandleFunc("/account/{id}/transfers", withJWTAuth(makeHTTPHandlerFunc(s.handleAccountTransfers), s.storage))
+	router.HandleFunc("/account/{id}/spending", withJWTAuth(makeHTTPHandlerFunc(s.handleAccountSpending), s.storage))
+	router.HandleFunc("/account/{id}/sessions", withOwnerOrAdminAuth(makeHTTPHandlerFunc(s.handleAccountSessions), s.storage, s.admins))
+	router.HandleFunc("/account/{id}/sessions/{sessionId}", withOwnerOrAdminAuth(makeHTTPHandlerFunc(s.handleRevokeSession), s.storage, s.admins))
+	router.HandleFunc("/account/{id}/transfer", s.feature(FeatureTransfers, withVerifiedAccount(withJWTAuth(makeHTTPHandlerFunc(s.handleAccountTransfer), s.storage), s.storage))).Methods(http.MethodPost)
+	router.HandleFunc("/account/{id}/stream", s.feature(FeatureStream, s.withQueryToken(withJWTAuth(makeHTTPHandlerFunc(s.handleAccountStream), s.storage))))
+	router.HandleFunc("/account/{id}/min-balance", withAdminAuth(makeHTTPHandlerFunc(s.handleSetMinBalance), s.admins))
+	router.HandleFunc("/account/{id}/max-accounts", withAdminAuth(makeHTTPHandlerFunc(s.handleSetMaxAccounts), s.admins))
+	router.HandleFunc("/account/{id}/number", withAdminAuth(makeHTTPHandlerFunc(s.handleChangeNumber), s.admins)).Methods(http.MethodPut)
+	router.HandleFunc("/transfer", s.feature(FeatureTransfers, withVerifiedAccount(makeHTTPHandlerFunc(s.withSchema(SchemaTransfer, s.handleTransfer)), s.storage)))
+	router.HandleFunc("/transfer/preview", s.feature(FeatureTransfers, withVerifiedAccount(makeHTTPHandlerFunc(s.withSchema(SchemaTransfer, s.handlePreviewTransfer)), s.storage))).Methods(http.MethodPost)
+	router.HandleFunc("/transfer/{id:[0-9]+}", s.feature(FeatureTransfers, withTokenAuth(makeHTTPHandlerFunc(s.handleGetTransfer)))).Methods(http.MethodGet)
+	router.HandleFunc("/transfer/schedule", s.feature(FeatureScheduling, withVerifiedAccount(makeHTTPHandlerFunc(s.handleScheduleTransfer), s.storage))).Methods(http.MethodPost)
+	router.HandleFunc("/transfer/schedule", s.feature(FeatureScheduling, makeHTTPHandlerFunc(s.handleListScheduledTransfers))).Methods(http.MethodGet)
+	router.HandleFunc("/transfer/schedule/{id}", s.feature(FeatureScheduling, makeHTTPHandlerFunc(s.handleCancelScheduledTransfer))).Methods(http.MethodDelete)
+	router.HandleFunc("/transfers/batch", s.feature(FeatureTransfers, withVerifiedAccount(makeHTTPHandlerFunc(s.handleBatchTransfer), s.storage)))
+	router.HandleFunc("/maintenance", withAdminAuth(makeHTTPHandlerFunc(s.handleMaintenance), s.admins))
+	router.HandleFunc("/events", withAdminAuth(makeHTTPHandlerFunc(s.handleEvents), s.admins))
+	router.HandleFunc("/reconcile", withAdminAuth(makeHTTPHandlerFunc(s.handleReconcile), s.admins)).Methods(http.MethodGet)
+	router.HandleFunc("/audit", withAdminAuth(makeHTTPHandlerFunc(s.handleAudit), s.admins))
+	router.HandleFunc("/stats", s.feature(FeatureStats, withAdminAuth(makeHTTPHandlerFunc(s.handleStats), s.admins)))
+	router.HandleFunc("/features", withAdminAuth(makeHTTPHandlerFunc(s.handleFeatures), s.admins))
 
-	log.Println("API server is running on port:", s.listenAddr)
+	return router
+}
 
-	err := http.ListenAndServe(s.listenAddr, router)
-	if err != nil {
+func (s *APIServer) Run() {
+	router := s.router()
+
+	conns := new(connCounter)
+	server := &http.Server{
+		Addr:      s.listenAddr,
+		Handler:   s.withRequestLogging(withRecovery(s.withCORS(s.withConcurrencyLimit(s.withMaintenance(s.withContentType(s.withSessions(router))))))),
+		ConnState: conns.track,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		if s.tlsCert != "" {
+			// net/http negotiates HTTP/2 on its own when serving TLS.
+			server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+			log.Println("API server is running with TLS on port:", s.listenAddr)
+			errc <- server.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+		} else {
+			log.Println("API server is running on port:", s.listenAddr)
+			errc <- server.ListenAndServe()
+		}
+	}()
+
+	if s.features.Enabled(FeatureScheduling) {
+		go s.runScheduler(ctx)
+	}
+	go s.runBalanceSnapshots(ctx)
+	if s.tokenCleanupInterval > 0 {
+		go s.runTokenCleanup(ctx)
+	}
+	if s.webhooks != nil {
+		go s.runOutboxDispatcher(ctx)
+	}
+
+	select {
+	case err := <-errc:
+		panic(err)
+	case <-ctx.Done():
+	}
+	if err := s.shutdown(server, conns); err != nil {
 		panic(err)
 	}
 }
@@ -50,18 +277,38 @@ func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	acc, err := s.storage.GetAccountByNumber(int(req.Number))
-	if err != nil {
+	if errors.Is(err, ErrAccountNotFound) {
 		return WriteJSON(w, http.StatusBadRequest, "no account found with this number, please register!!")
 	}
+	if err != nil {
+		return err
+	}
 
+	// The lock is checked before the password so that it also stops
+	// guessing, rather than only logging in.
+	now := time.Now().UTC()
+	if acc.Locked(now) {
+		return accountLocked(w, acc.LockedUntil.Sub(now))
+	}
 	if !acc.ValidatePassword(req.Password) {
+		locked, err := s.storage.RecordFailedLogin(acc.ID, s.loginMaxFailures, now.Add(s.loginLockout))
+		if err != nil {
+			return err
+		}
+		if locked {
+			return accountLocked(w, s.loginLockout)
+		}
 		return fmt.Errorf("not authenticated")
 	}
+	if !acc.Verified {
+		return withStatus(http.StatusForbidden, fmt.Errorf("account not verified, follow the link emailed to %s first", acc.Email))
+	}
 
-	tokenString, err := createJWT(acc)
+	tokenString, err := s.issueToken(r, acc)
 	if err != nil {
 		return err
 	}
+	s.recordLogin(acc.ID)
 
 	res := LoginResponse{
 		Number: acc.Number,
@@ -71,6 +318,24 @@ func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	return WriteJSON(w, http.StatusOK, res)
 }
 
+// accountLocked reports a login refused because of too many failed ones
+// with 423 Locked, telling the client when to try again.
+func accountLocked(w http.ResponseWriter, retryAfter time.Duration) error {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	return withStatus(http.StatusLocked, fmt.Errorf("too many failed logins, the account is locked, try again later"))
+}
+
+// recordLogin stores when the account last logged in without holding up
+// the response; losing the odd update is harmless.
+func (s *APIServer) recordLogin(accountID int) {
+	at := time.Now().UTC()
+	go func() {
+		if err := s.storage.RecordLogin(accountID, at); err != nil {
+			log.Printf("error recording login of account %s: %v", maskNumber(int64(accountID)), err)
+		}
+	}()
+}
+
 func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case http.MethodGet:
@@ -83,11 +348,86 @@ func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error
 }
 
 func (s *APIServer) handleGetAllAccounts(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.storage.GetAllAccounts()
+	loc, err := s.requestLocation(r)
 	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, accounts)
+
+	filter, err := s.parseAccountFilter(r)
+	if err != nil {
+		return err
+	}
+	if err := parseAccountPage(r.URL.Query(), &filter); err != nil {
+		return err
+	}
+	limit := filter.Limit
+	if limit > 0 {
+		// One more tells whether there is a next page.
+		filter.Limit++
+	}
+
+	accounts, err := s.storage.GetAllAccounts(filter)
+	if err != nil {
+		return err
+	}
+
+	var page AccountPage
+	if limit > 0 && len(accounts) > limit {
+		accounts = accounts[:limit]
+		last := accounts[limit-1]
+		page.NextCursor = encodeAccountCursor(AccountCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+	page.Accounts = make([]any, len(accounts))
+	number, full := fullNumberRequested(r)
+	for i, account := range accounts {
+		account.CreatedAt = account.CreatedAt.In(loc)
+		page.Accounts[i] = account
+		if !full || !s.mayShowFullNumber(number, account) {
+			page.Accounts[i] = NewMaskedAccount(account)
+		}
+	}
+
+	// Without a limit the listing is the plain array it has always been.
+	if limit == 0 {
+		return WriteJSON(w, http.StatusOK, page.Accounts)
+	}
+	return WriteJSON(w, http.StatusOK, page)
+}
+
+// parseAccountFilter reads the filter of the account listing and export from
+// the query string.
+func (s *APIServer) parseAccountFilter(r *http.Request) (AccountFilter, error) {
+	query := r.URL.Query()
+	filter := AccountFilter{
+		MetadataKey:   query.Get("metadataKey"),
+		MetadataValue: query.Get("metadataValue"),
+		Name:          s.normalizeName(query.Get("name")),
+	}
+	if filter.MetadataValue != "" && filter.MetadataKey == "" {
+		return filter, fmt.Errorf("metadataValue requires metadataKey")
+	}
+	if v := query.Get("minBalance"); v != "" {
+		minBalance, err := ParseMoney(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid minBalance: %w", err)
+		}
+		filter.MinBalance = &minBalance
+	}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"createdFrom", &filter.CreatedFrom}, {"createdTo", &filter.CreatedTo}} {
+		if v := query.Get(bound.name); v != "" {
+			var err error
+			if *bound.t, err = time.Parse(time.RFC3339, v); err != nil {
+				return filter, fmt.Errorf("invalid %s: '%s', expected an RFC 3339 time such as 2024-03-01T00:00:00Z", bound.name, v)
+			}
+		}
+	}
+	if !filter.CreatedFrom.IsZero() && !filter.CreatedTo.IsZero() && filter.CreatedTo.Before(filter.CreatedFrom) {
+		return filter, fmt.Errorf("createdFrom must not be after createdTo")
+	}
+	return filter, nil
 }
 
 func (s *APIServer) handleAccountByID(w http.ResponseWriter, r *http.Request) error {
@@ -98,14 +438,39 @@ func (s *APIServer) handleAccountByID(w http.ResponseWriter, r *http.Request) er
 			if err != nil {
 				return err
 			}
+			loc, err := s.requestLocation(r)
+			if err != nil {
+				return err
+			}
+			fields, err := parseFields(r.URL.Query().Get("fields"), accountFields)
+			if err != nil {
+				return err
+			}
 
 			account, err := s.storage.GetAccountByID(id)
+			if errors.Is(err, ErrAccountNotFound) {
+				return withStatus(http.StatusNotFound, err)
+			}
 			if err != nil {
-				return fmt.Errorf("error occured while fetching account details: %w", err)
+				log.Printf("error fetching account %s: %v", maskNumber(int64(id)), err)
+				return withStatus(http.StatusInternalServerError, fmt.Errorf("error occured while fetching account details"))
 			}
 
-			return WriteJSON(w, http.StatusOK, account)
+			account.CreatedAt = account.CreatedAt.In(loc)
+			w.Header().Set("ETag", accountETag(account))
+			var body any = account
+			if !s.showFullNumber(r, account) {
+				body = NewMaskedAccount(account)
+			}
+			if fields != nil {
+				if body, err = selectFields(body, fields); err != nil {
+					return err
+				}
+			}
+			return WriteJSON(w, http.StatusOK, body)
 		}
+	case http.MethodPatch:
+		return s.handleUpdateAccount(w, r)
 	case http.MethodDelete:
 		return s.handleDeleteAccount(w, r)
 	default:
@@ -113,36 +478,297 @@ func (s *APIServer) handleAccountByID(w http.ResponseWriter, r *http.Request) er
 	}
 }
 
+// showFullNumber reports whether the caller asked for the full account
+// number, with X-Show-Full-Number: true or ?fullNumber=true, and may see it
+// as an owner of the account or an admin.
+func (s *APIServer) showFullNumber(r *http.Request, account *Account) bool {
+	number, ok := fullNumberRequested(r)
+	return ok && s.mayShowFullNumber(number, account)
+}
+
+// fullNumberRequested returns the account number of a caller asking for
+// full account numbers.
+func fullNumberRequested(r *http.Request) (int64, bool) {
+	show := r.Header.Get("X-Show-Full-Number")
+	if show == "" {
+		show = r.URL.Query().Get("fullNumber")
+	}
+	if ok, _ := strconv.ParseBool(show); !ok {
+		return 0, false
+	}
+	number, err := accountNumberFromToken(r)
+	return number, err == nil
+}
+
+// mayShowFullNumber reports whether the caller with number is an owner of
+// account or an admin.
+func (s *APIServer) mayShowFullNumber(number int64, account *Account) bool {
+	if s.admins[number] {
+		return true
+	}
+	ok, err := canOperate(s.storage, number, account)
+	return err == nil && ok
+}
+
+// handleGetMe returns the account the JWT was issued for, sparing clients
+// from keeping track of their account id.
+func (s *APIServer) handleGetMe(w http.ResponseWriter, r *http.Request) error {
+	loc, err := s.requestLocation(r)
+	if err != nil {
+		return err
+	}
+
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return withStatus(http.StatusUnauthorized, err)
+	}
+	account, err := s.storage.GetAccountByNumber(int(number))
+	if err != nil {
+		return accountLookupError(err)
+	}
+
+	account.CreatedAt = account.CreatedAt.In(loc)
+	res := MeResponse{Account: account, Email: account.Email}
+	if account.LastLoginAt != nil {
+		at := account.LastLoginAt.In(loc)
+		res.LastLoginAt = &at
+	}
+	return WriteJSON(w, http.StatusOK, res)
+}
+
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
 	req := new(CreateAccountRequest)
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 		return err
 	}
 
-	account, err := NewAccount(req.FirstName, req.LastName, req.Password)
-	if err != nil {
+	req.FirstName = s.normalizeName(req.FirstName)
+	req.LastName = s.normalizeName(req.LastName)
+	if err := req.Validate(); err != nil {
 		return err
 	}
 
-	err = s.storage.CreateAccount(account)
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key != "" {
+		existing, err := s.reserveIdempotencyKey(key, req)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return s.writeCreateAccountResponse(w, r, existing)
+		}
+	}
+
+	account, err := s.createAccount(r, req)
+	if key != "" {
+		s.finishIdempotencyKey(key, account, err)
+	}
 	if err != nil {
 		return err
 	}
+	return s.writeCreateAccountResponse(w, r, account)
+}
+
+func (s *APIServer) createAccount(r *http.Request, req *CreateAccountRequest) (*Account, error) {
+	// Signing up needs no token and creates a new owner. An owner who is
+	// logged in opens further accounts, up to their cap.
+	var ownerID int
+	if tokenFromRequest(r) != "" {
+		var err error
+		if ownerID, err = s.checkAccountCap(r); err != nil {
+			return nil, err
+		}
+	}
 
-	tokenString, err := createJWT(account)
+	account, err := NewAccountWithOptions(req.FirstName, req.LastName, req.Password, WithBalance(s.defaultBalance))
+	if err != nil {
+		return nil, err
+	}
+	account.Metadata = req.Metadata
+	account.OwnerID = ownerID
+	account.Email = req.Email
+	account.Verified = !s.requireVerification
+	account.audit = s.newAuditEntry(r, AuditActionAccountCreated)
+
+	for attempt := 0; ; attempt++ {
+		account.Number = s.numbers.Generate()
+		err = s.storage.CreateAccount(account)
+		if !errors.Is(err, ErrNumberTaken) {
+			break
+		}
+		log.Printf("account number collision on %s, attempt %d of %d", maskNumber(account.Number), attempt+1, s.numberRetries+1)
+		if attempt == s.numberRetries {
+			log.Printf("no free account number found after %d attempts, the number space is likely too small", attempt+1)
+			return nil, withStatus(http.StatusInternalServerError, fmt.Errorf("could not allocate a unique account number, please try again later"))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !account.Verified {
+		s.sendVerification(account)
+	}
+	return account, nil
+}
+
+func (s *APIServer) writeCreateAccountResponse(w http.ResponseWriter, r *http.Request, account *Account) error {
+	tokenString, err := s.issueToken(r, account)
 	if err != nil {
 		return err
 	}
 
 	res := CreateAccountResponse{
-		FirstName: req.FirstName,
-		LastName:  req.LastName,
+		FirstName: account.FirstName,
+		LastName:  account.LastName,
 		Token:     tokenString,
 	}
 
 	return WriteJSON(w, http.StatusOK, res)
 }
 
+// checkAccountCap returns the owner of the caller's account once it has made
+// sure they are allowed another account.
+func (s *APIServer) checkAccountCap(r *http.Request) (int, error) {
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return 0, withStatus(http.StatusForbidden, fmt.Errorf("permission denied"))
+	}
+	caller, err := s.storage.GetAccountByNumber(int(number))
+	if err != nil {
+		return 0, withStatus(http.StatusForbidden, fmt.Errorf("permission denied"))
+	}
+	owner, err := s.storage.GetAccountByID(caller.OwnerID)
+	if err != nil {
+		return 0, err
+	}
+
+	limit := s.maxAccountsPerOwner
+	if owner.MaxAccounts != nil {
+		limit = *owner.MaxAccounts
+	}
+	if limit == 0 {
+		return owner.ID, nil
+	}
+
+	count, err := s.storage.CountAccountsByOwner(owner.ID)
+	if err != nil {
+		return 0, err
+	}
+	if count >= limit {
+		return 0, withStatus(http.StatusForbidden, fmt.Errorf("account limit reached, at most %d accounts are allowed", limit))
+	}
+	return owner.ID, nil
+}
+
+func (s *APIServer) handleSetMaxAccounts(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPut {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+
+	req := new(SetMaxAccountsRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if req.MaxAccounts != nil && *req.MaxAccounts < 0 {
+		return fmt.Errorf("maximum number of accounts must not be negative")
+	}
+
+	account, err := s.storage.GetAccountByID(id)
+	if err != nil {
+		return accountLookupError(err)
+	}
+	if account.OwnerID != account.ID {
+		return fmt.Errorf("account %d is not an owner, set the cap on account %d instead", id, account.OwnerID)
+	}
+	account.MaxAccounts = req.MaxAccounts
+	if err := s.storage.UpdateAccount(account); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+
+	req := new(UpdateAccountRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if req.FirstName != nil {
+		*req.FirstName = s.normalizeName(*req.FirstName)
+	}
+	if req.LastName != nil {
+		*req.LastName = s.normalizeName(*req.LastName)
+	}
+	if req.Nickname != nil {
+		*req.Nickname = sanitizeNickname(*req.Nickname)
+	}
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	account, err := s.storage.GetAccountByID(id)
+	if err != nil {
+		return accountLookupError(err)
+	}
+	if !ifMatch(r.Header.Get("If-Match"), accountETag(account)) {
+		return withStatus(http.StatusPreconditionFailed, fmt.Errorf("account %d was changed, fetch it again", id))
+	}
+	if req.FirstName != nil {
+		account.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		account.LastName = *req.LastName
+	}
+	if req.Metadata != nil {
+		account.Metadata = req.Metadata
+	}
+	if req.Nickname != nil {
+		account.Nickname = *req.Nickname
+	}
+
+	// A change between the read and the write is a mismatch too, whether
+	// or not the caller sent If-Match.
+	err = s.storage.UpdateAccount(account)
+	if errors.Is(err, ErrVersionConflict) {
+		return withStatus(http.StatusPreconditionFailed, err)
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", accountETag(account))
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// accountETag is the entity tag of the account's current version.
+func accountETag(a *Account) string {
+	return `"` + strconv.Itoa(a.Version) + `"`
+}
+
+// ifMatch reports whether an If-Match header value lets a request through
+// for a resource with etag. A missing header or "*" matches anything;
+// otherwise one of the listed tags must be etag. Weak tags never match,
+// as RFC 9110 asks.
+func ifMatch(header, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
 	id, err := getId(r)
 	if err != nil {
@@ -151,7 +777,12 @@ func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request)
 
 	_, err = s.storage.GetAccountByID(id)
 	if err != nil {
-		return fmt.Errorf("error occured while deleting account details: %w", err)
+		return accountLookupError(fmt.Errorf("error occured while deleting account details: %w", err))
+	}
+	if s.confirmDeletes {
+		if err := s.confirmDelete(r, id); err != nil {
+			return err
+		}
 	}
 
 	err = s.storage.DeleteAccount(id)
@@ -161,6 +792,34 @@ func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request)
 	return WriteJSON(w, http.StatusOK, map[string]int{"account deleted successfully with id": id})
 }
 
+func (s *APIServer) handleSetMinBalance(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPut {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+
+	req := new(SetMinBalanceRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if req.MinBalance > 0 {
+		return fmt.Errorf("minimum balance must not be positive")
+	}
+
+	account, err := s.storage.GetAccountByID(id)
+	if err != nil {
+		return accountLookupError(err)
+	}
+	account.MinBalance = req.MinBalance
+	if err := s.storage.UpdateAccount(account); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, account)
+}
+
 func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		return fmt.Errorf("method not allowed, %s", r.Method)
@@ -170,13 +829,68 @@ func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error
 	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, transferRequest)
+	return s.createTransfer(w, r, transferRequest)
+}
+
+// createTransfer makes the transfer the caller asked for and writes it
+// out.
+func (s *APIServer) createTransfer(w http.ResponseWriter, r *http.Request, transferRequest *TransferRequest) error {
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return withCode(http.StatusUnauthorized, CodeUnauthenticated, fmt.Errorf("permission denied"))
+	}
+	if transferRequest.External != nil {
+		return s.createExternalTransfer(w, number, transferRequest)
+	}
+	transfer, err := s.prepareTransfer(number, transferRequest)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.CreateTransfer(transfer); err != nil {
+		return transferError(err)
+	}
+	s.publishTransfer(transfer)
+	return WriteJSON(w, http.StatusOK, NewTransferResult(transfer))
 }
 
+// WriteJSON encodes v before writing anything, so that an encoding error
+// is returned, as a 500, while the status can still be changed instead of
+// leaving the client with a truncated body.
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return withStatus(http.StatusInternalServerError, fmt.Errorf("error encoding response: %w", err))
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	return json.NewEncoder(w).Encode(v)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *APIServer) withRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %s %s %d %s", clientIP(r, s.trustedProxies), r.Method, sanitizePath(r.URL.Path), rec.status, time.Since(start))
+	})
 }
 
 func permissionDenied(w http.ResponseWriter) {
@@ -184,29 +898,150 @@ func permissionDenied(w http.ResponseWriter) {
 }
 
 func withJWTAuth(handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc {
+	cache, hasCache := findAccountIDCache(s)
 	return func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("calling JWT middlewares")
 
-		token, err := validateJWT(r.Header.Get("x-jwt-token"))
-		if err != nil || !token.Valid {
+		number, err := accountNumberFromToken(r)
+		if err != nil {
 			permissionDenied(w)
 			return
 		}
 
 		id, err := getId(r)
+		if errors.Is(err, errMissingID) {
+			// Letting the request through would skip the ownership check.
+			log.Printf("withJWTAuth guards %s, whose route has no {id}", sanitizePath(r.URL.Path))
+			WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "route misconfigured: missing account id"})
+			return
+		}
 		if err != nil {
-			permissionDenied(w)
+			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
 			return
 		}
 
+		// Callers mostly operate their own account, which the number cache
+		// can confirm without a query.
+		if hasCache {
+			if cached, ok := cache.cachedAccountID(number); ok && cached == id {
+				handlerFunc(w, r)
+				return
+			}
+		}
+
 		account, err := s.GetAccountByID(id)
+		if errors.Is(err, ErrAccountNotFound) {
+			WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+			return
+		}
 		if err != nil {
 			permissionDenied(w)
 			return
 		}
 
-		claims := token.Claims.(jwt.MapClaims)
-		if account.Number != int64(claims["accountNumber"].(float64)) {
+		if ok, err := canOperate(s, number, account); err != nil || !ok {
+			permissionDenied(w)
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
+
+// withTokenAuth only requires a valid JWT, for the routes that operate on
+// the caller's own account rather than on one named in the URL.
+func withTokenAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := accountNumberFromToken(r); err != nil {
+			permissionDenied(w)
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
+
+// canOperate reports whether the holder of a JWT issued for number may
+// operate account, i.e. whether their owner is one of the account's owners.
+func canOperate(s Storage, number int64, account *Account) (bool, error) {
+	if account.Number == number {
+		return true, nil
+	}
+	caller, err := s.GetAccountByNumber(int(number))
+	if err != nil {
+		return false, err
+	}
+	return s.IsAccountOwner(account.ID, caller.OwnerID)
+}
+
+// tokenFromRequest returns the JWT sent with the request, preferably as
+// Authorization: Bearer <token>, or else in the x-jwt-token header older
+// clients use.
+func tokenFromRequest(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		if token = strings.TrimSpace(token); token != "" {
+			return token
+		}
+	}
+	return r.Header.Get("x-jwt-token")
+}
+
+// accountNumberFromToken validates the JWT sent with the request and returns
+// the number of the account it was issued for.
+func accountNumberFromToken(r *http.Request) (int64, error) {
+	token, err := validateJWT(tokenFromRequest(r))
+	if err != nil {
+		return 0, err
+	}
+	if !token.Valid {
+		return 0, fmt.Errorf("invalid token")
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	switch number := claims["accountNumber"].(type) {
+	case string:
+		n, err := strconv.ParseInt(number, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid account number in token: '%s'", number)
+		}
+		return n, nil
+	case float64:
+		// Tokens issued before the claim became a string; exact up to 2^53.
+		return int64(number), nil
+	}
+	return 0, fmt.Errorf("token is missing the account number")
+}
+
+// withVerifiedAccount rejects requests whose JWT was issued for an account
+// that hasn't been verified yet. It guards the endpoints that move money;
+// reads stay available to unverified accounts.
+func withVerifiedAccount(handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		number, err := accountNumberFromToken(r)
+		if err != nil {
+			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "permission denied", Code: CodeUnauthenticated})
+			return
+		}
+
+		account, err := s.GetAccountByNumber(int(number))
+		if err != nil {
+			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "permission denied", Code: CodeUnauthenticated})
+			return
+		}
+
+		if !account.Verified {
+			WriteJSON(w, http.StatusForbidden, ApiError{Error: "account not verified", Code: CodeAccountNotVerified})
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
+
+// withAdminAuth only lets through requests whose JWT was issued for one of
+// the admin accounts.
+func withAdminAuth(handlerFunc http.HandlerFunc, admins map[int64]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		number, err := accountNumberFromToken(r)
+		if err != nil || !admins[number] {
 			permissionDenied(w)
 			return
 		}
@@ -214,14 +1049,50 @@ func withJWTAuth(handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc {
 	}
 }
 
-func createJWT(account *Account) (string, error) {
+// withOwnerOrAdminAuth lets admins through and everybody else only when
+// withJWTAuth would.
+func withOwnerOrAdminAuth(handlerFunc http.HandlerFunc, s Storage, admins map[int64]bool) http.HandlerFunc {
+	owner := withJWTAuth(handlerFunc, s)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if number, err := accountNumberFromToken(r); err == nil && admins[number] {
+			handlerFunc(w, r)
+			return
+		}
+		owner(w, r)
+	}
+}
+
+// jwtSecrets returns the secrets tokens may be signed with. JWT_SECRETS is
+// a comma-separated list whose first entry signs new tokens while the others
+// are only accepted for verification, so that a secret can be rotated
+// without invalidating the tokens already handed out. JWT_TEST_SECRET is
+// still honoured when JWT_SECRETS isn't set.
+func jwtSecrets() []string {
+	var secrets []string
+	for _, secret := range strings.Split(os.Getenv("JWT_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	if len(secrets) == 0 {
+		secrets = []string{os.Getenv("JWT_TEST_SECRET")}
+	}
+	return secrets
+}
 
-	secret := os.Getenv("JWT_TEST_SECRET")
+func createJWT(account *Account, sessionID string, ttl time.Duration) (string, error) {
+
+	secret := jwtSecrets()[0]
 
 	// Create the Claims and token
+	// The account number is a string, since JSON numbers are decoded as
+	// float64 and lose precision beyond 2^53.
+	now := time.Now()
 	claims := &jwt.MapClaims{
-		"expiresAt":     15000,
-		"accountNumber": account.Number,
+		"jti":           sessionID,
+		"iat":           jwt.NewNumericDate(now),
+		"exp":           jwt.NewNumericDate(now.Add(ttl)),
+		"accountNumber": strconv.FormatInt(account.Number, 10),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
@@ -229,33 +1100,135 @@ func createJWT(account *Account) (string, error) {
 }
 
 func validateJWT(tokenString string) (*jwt.Token, error) {
-	secret := os.Getenv("JWT_TEST_SECRET")
+	var (
+		token *jwt.Token
+		err   error
+	)
+	for _, secret := range jwtSecrets() {
+		token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
 
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			return []byte(secret), nil
+		})
+		if err == nil {
+			return token, nil
 		}
-
-		return []byte(secret), nil
-	})
+	}
+	return token, err
 }
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
+// StatusError attaches the HTTP status an error should be reported with;
+// errors without one are reported as 400 Bad Request. Code optionally
+// gives clients a stable identifier to tell errors apart by.
+type StatusError struct {
+	Status int
+	Code   string
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+func withStatus(status int, err error) error {
+	return &StatusError{Status: status, Err: err}
+}
+
+// accountLookupError reports a missing account as 404 Not Found.
+func accountLookupError(err error) error {
+	if errors.Is(err, ErrAccountNotFound) {
+		return withStatus(http.StatusNotFound, err)
+	}
+	return err
+}
+
+func withCode(status int, code string, err error) error {
+	return &StatusError{Status: status, Code: code, Err: err}
+}
+
+// Codes of requests that matched no route.
+const (
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+)
+
+// errorCode returns the code attached to err, if any.
+func errorCode(err error) string {
+	var serr *StatusError
+	if errors.As(err, &serr) && serr.Code != "" {
+		return serr.Code
+	}
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		return CodeInvalidRequest
+	}
+	return ""
+}
+
 type ApiError struct {
-	Error string `json:"error"`
+	Error  string       `json:"error"`
+	Code   string       `json:"code,omitempty"`
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 func makeHTTPHandlerFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			status := http.StatusBadRequest
+			var serr *StatusError
+			if errors.As(err, &serr) {
+				status = serr.Status
+			}
+
+			apiErr := ApiError{Error: err.Error(), Code: errorCode(err)}
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				apiErr = ApiError{Error: "invalid request", Code: CodeInvalidRequest, Fields: verr.Fields}
+			}
+			WriteJSON(w, status, apiErr)
 		}
 	}
 }
 
+// requestLocation returns the timezone the client asked timestamps to be
+// rendered in, through the tz query parameter or the X-Timezone header,
+// falling back to the configured display timezone.
+func (s *APIServer) requestLocation(r *http.Request) (*time.Location, error) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		name = r.Header.Get("X-Timezone")
+	}
+	if name == "" {
+		if s.displayLocation == nil {
+			return time.UTC, nil
+		}
+		return s.displayLocation, nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: '%s'", name)
+	}
+	return loc, nil
+}
+
+// errMissingID means a handler needing an {id} was routed a request
+// without one, which is a mistake in the routes rather than the request.
+var errMissingID = errors.New("missing id")
+
 func getId(r *http.Request) (int, error) {
-	idStr := mux.Vars(r)["id"]
+	idStr, ok := mux.Vars(r)["id"]
+	if !ok {
+		return 0, withStatus(http.StatusInternalServerError, errMissingID)
+	}
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		return id, fmt.Errorf("invalid id provided: '%s'", idStr)
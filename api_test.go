@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStorage keeps accounts in memory. It embeds Storage so that tests
+// only need to implement what the code under test actually calls; anything
+// else panics.
+type fakeStorage struct {
+	Storage
+	accounts map[int]*Account
+	owners   map[int][]int
+	readyErr error
+}
+
+func newFakeStorage(accounts ...*Account) *fakeStorage {
+	s := &fakeStorage{accounts: make(map[int]*Account), owners: make(map[int][]int)}
+	for _, a := range accounts {
+		s.accounts[a.ID] = a
+		s.owners[a.ID] = []int{a.OwnerID}
+	}
+	return s
+}
+
+func (s *fakeStorage) GetAccountByID(id int) (*Account, error) {
+	if a, ok := s.accounts[id]; ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, id)
+}
+
+func (s *fakeStorage) GetAccountByNumber(number int) (*Account, error) {
+	for _, a := range s.accounts {
+		if a.Number == int64(number) {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("%w with number: '%d'", ErrAccountNotFound, number)
+}
+
+func (s *fakeStorage) GetAccountsByIDs(ids []int) (map[int]*Account, error) {
+	accounts := make(map[int]*Account)
+	for _, id := range ids {
+		if a, ok := s.accounts[id]; ok {
+			accounts[id] = a
+		}
+	}
+	return accounts, nil
+}
+
+func (s *fakeStorage) IsAccountOwner(accountID, ownerID int) (bool, error) {
+	for _, id := range s.owners[accountID] {
+		if id == ownerID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *fakeStorage) Ready() error {
+	return s.readyErr
+}
+
+func newTestServer(t *testing.T, s Storage) *APIServer {
+	t.Helper()
+
+	server, err := NewAPIServer(&Config{}, s, NoopNotifier{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestGetId(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/account/7", nil)
+	_, err := getId(req)
+	assert.ErrorIs(t, err, errMissingID)
+
+	_, err = getId(mux.SetURLVars(req, map[string]string{"id": "abc"}))
+	assert.EqualError(t, err, "invalid id provided: 'abc'")
+
+	id, err := getId(mux.SetURLVars(req, map[string]string{"id": "7"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 7, id)
+}
+
+func TestWithJWTAuthWithoutID(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	acc := &Account{ID: 1, Number: 1001}
+	handler := withJWTAuth(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the handler must not run without the ownership check")
+	}, newFakeStorage(acc))
+
+	token, err := createJWT(acc, "session", time.Minute)
+	assert.Nil(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/account/summary", nil)
+	req.Header.Set("x-jwt-token", token)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestWithJWTAuthLargeAccountNumber(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	// 2^53+1 is the first integer a float64 can't hold: it rounds to 2^53.
+	acc := &Account{ID: 1, Number: 1<<53 + 1, OwnerID: 1}
+	handler := withJWTAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, newFakeStorage(acc))
+
+	token, err := createJWT(acc, "session", time.Minute)
+	assert.Nil(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/account/1", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	req.Header.Set("x-jwt-token", token)
+	number, err := accountNumberFromToken(req)
+	assert.Nil(t, err)
+	assert.Equal(t, acc.Number, number)
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func TestAccountNumberFromLegacyToken(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	// Tokens issued before the claim became a string hold a number.
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":           jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		"accountNumber": 1001,
+	}).SignedString([]byte("secret"))
+	assert.Nil(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/account", nil)
+	req.Header.Set("x-jwt-token", token)
+	number, err := accountNumberFromToken(req)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1001), number)
+}
+
+func TestWithVerifiedAccount(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	verified := &Account{ID: 1, Number: 1001, Verified: true}
+	unverified := &Account{ID: 2, Number: 1002}
+	store := newFakeStorage(verified, unverified)
+
+	next := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	handler := withVerifiedAccount(next, store)
+
+	for _, tc := range []struct {
+		account *Account
+		status  int
+	}{
+		{verified, http.StatusNoContent},
+		{unverified, http.StatusForbidden},
+	} {
+		token, err := createJWT(tc.account, "session", time.Minute)
+		assert.Nil(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/transfer", nil)
+		req.Header.Set("x-jwt-token", token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		assert.Equal(t, tc.status, rec.Code)
+	}
+}
+
+func TestAccountNumberFromToken(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice, err := createJWT(&Account{Number: 1001}, "session", time.Minute)
+	assert.Nil(t, err)
+	bob, err := createJWT(&Account{Number: 1002}, "session", time.Minute)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		number  int64
+	}{
+		{"bearer", map[string]string{"Authorization": "Bearer " + alice}, 1001},
+		{"lowercase scheme", map[string]string{"Authorization": "bearer " + alice}, 1001},
+		{"x-jwt-token", map[string]string{"x-jwt-token": alice}, 1001},
+		{"bearer preferred", map[string]string{"Authorization": "Bearer " + alice, "x-jwt-token": bob}, 1001},
+		{"other scheme falls back", map[string]string{"Authorization": "Basic dXNlcjpwYXNz", "x-jwt-token": bob}, 1002},
+		{"none", map[string]string{"Authorization": "Bearer "}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/account/me", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			number, err := accountNumberFromToken(req)
+			if tt.number == 0 {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.number, number)
+		})
+	}
+}
+
+func TestHandleGetMe(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	lastLogin := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	alice := &Account{ID: 7, Number: 1001, FirstName: "Alice", Email: "alice@example.com", LastLoginAt: &lastLogin}
+	server := newTestServer(t, newFakeStorage(alice))
+	handler := withTokenAuth(makeHTTPHandlerFunc(server.handleGetMe))
+
+	token, err := createJWT(alice, "session", time.Minute)
+	assert.Nil(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/account/me", nil)
+	req.Header.Set("x-jwt-token", token)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var me struct {
+		ID          int        `json:"id"`
+		Email       string     `json:"email"`
+		LastLoginAt *time.Time `json:"lastLoginAt"`
+	}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&me))
+	assert.Equal(t, 7, me.ID)
+	assert.Equal(t, "alice@example.com", me.Email)
+	if assert.NotNil(t, me.LastLoginAt) {
+		assert.True(t, lastLogin.Equal(*me.LastLoginAt))
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/account/me", nil))
+	assert.Contains(t, rec.Body.String(), "permission denied")
+
+	token, err = createJWT(&Account{Number: 1002}, "session", time.Minute)
+	assert.Nil(t, err)
+	req = httptest.NewRequest(http.MethodGet, "/account/me", nil)
+	req.Header.Set("x-jwt-token", token)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHandleGetAccountMasksNumber(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice := &Account{ID: 1, Number: 123456, OwnerID: 1}
+	bob := &Account{ID: 2, Number: 654321, OwnerID: 2}
+	server := newTestServer(t, newFakeStorage(alice, bob))
+	server.admins = map[int64]bool{bob.Number: true}
+
+	tests := []struct {
+		name   string
+		caller *Account
+		header string
+		want   any
+	}{
+		{"owner by default", alice, "", "****3456"},
+		{"owner asking for the full number", alice, "true", float64(123456)},
+		{"admin asking for the full number", bob, "true", float64(123456)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := createJWT(tt.caller, "session", time.Minute)
+			assert.Nil(t, err)
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/account/1", nil), map[string]string{"id": "1"})
+			req.Header.Set("x-jwt-token", token)
+			req.Header.Set("X-Show-Full-Number", tt.header)
+			rec := httptest.NewRecorder()
+			makeHTTPHandlerFunc(server.handleAccountByID)(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			var got map[string]any
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&got))
+			assert.Equal(t, tt.want, got["number"])
+		})
+	}
+
+	server.admins = nil
+	token, err := createJWT(bob, "session", time.Minute)
+	assert.Nil(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/account/1?fullNumber=true", nil)
+	req.Header.Set("x-jwt-token", token)
+	assert.False(t, server.showFullNumber(req, alice), "only owners and admins see the full number")
+}
+
+type fakeUpdateStorage struct {
+	*fakeStorage
+	// conflict makes UpdateAccount behave as if the account was changed
+	// after it was read.
+	conflict bool
+}
+
+func (s *fakeUpdateStorage) UpdateAccount(a *Account) error {
+	if s.conflict {
+		return fmt.Errorf("%w: '%d'", ErrVersionConflict, a.ID)
+	}
+	a.Version++
+	return nil
+}
+
+func TestHandleUpdateAccountIfMatch(t *testing.T) {
+	store := &fakeUpdateStorage{fakeStorage: newFakeStorage(&Account{ID: 1, FirstName: "Ann", Version: 3})}
+	server := newTestServer(t, store)
+
+	tests := []struct {
+		name     string
+		ifMatch  string
+		conflict bool
+		status   int
+		etag     string
+	}{
+		{"current version", `"3"`, false, http.StatusOK, `"4"`},
+		{"stale version", `"3"`, false, http.StatusPreconditionFailed, ""},
+		{"one of several", `"1", "4"`, false, http.StatusOK, `"5"`},
+		{"weak tag", `W/"5"`, false, http.StatusPreconditionFailed, ""},
+		{"any version", "*", false, http.StatusOK, `"6"`},
+		{"no header", "", false, http.StatusOK, `"7"`},
+		{"changed meanwhile", `"7"`, true, http.StatusPreconditionFailed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.conflict = tt.conflict
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodPatch, "/account/1", strings.NewReader(`{"firstName": "Anna"}`)), map[string]string{"id": "1"})
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			rec := httptest.NewRecorder()
+			makeHTTPHandlerFunc(server.handleUpdateAccount)(rec, req)
+			assert.Equal(t, tt.status, rec.Code, rec.Body.String())
+			assert.Equal(t, tt.etag, rec.Header().Get("ETag"))
+		})
+	}
+}
+
+func TestHandleUpdateAccountNickname(t *testing.T) {
+	account := &Account{ID: 1, FirstName: "Ann"}
+	server := newTestServer(t, &fakeUpdateStorage{fakeStorage: newFakeStorage(account)})
+
+	for _, tt := range []struct {
+		body, want string
+	}{
+		{`{"nickname": "  Rent\u0000 money "}`, "Rent money"},
+		{`{"firstName": "Anna"}`, "Rent money"},
+		{`{"nickname": ""}`, ""},
+	} {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPatch, "/account/1", strings.NewReader(tt.body)), map[string]string{"id": "1"})
+		rec := httptest.NewRecorder()
+		makeHTTPHandlerFunc(server.handleUpdateAccount)(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Equal(t, tt.want, account.Nickname, tt.body)
+	}
+}
+
+func TestRouterUnmatchedRequests(t *testing.T) {
+	router := newTestServer(t, newFakeStorage()).router()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/nope", http.StatusNotFound, CodeNotFound},
+		{http.MethodPost, "/transfer/schedule/1", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		assert.Equal(t, tt.status, rec.Code, "%s %s", tt.method, tt.path)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		var apiErr ApiError
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&apiErr))
+		assert.Equal(t, tt.code, apiErr.Code)
+	}
+}
+
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("boom")
+}
+
+func TestWriteJSONEncodingError(t *testing.T) {
+	handler := makeHTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return WriteJSON(w, http.StatusCreated, map[string]any{"ok": true, "bad": failingMarshaler{}})
+	})
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	var apiErr ApiError
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&apiErr))
+	assert.Contains(t, apiErr.Error, "boom")
+}
+
+func TestCanOperate(t *testing.T) {
+	alice := &Account{ID: 1, Number: 1001, OwnerID: 1}
+	bob := &Account{ID: 2, Number: 1002, OwnerID: 2}
+	joint := &Account{ID: 3, Number: 1003, OwnerID: 1}
+	store := newFakeStorage(alice, bob, joint)
+	store.owners[joint.ID] = append(store.owners[joint.ID], bob.OwnerID)
+
+	for _, tc := range []struct {
+		caller  *Account
+		account *Account
+		ok      bool
+	}{
+		{alice, alice, true},
+		{alice, bob, false},
+		{bob, alice, false},
+		{alice, joint, true},
+		{bob, joint, true},
+	} {
+		ok, err := canOperate(store, tc.caller.Number, tc.account)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.ok, ok, "account %d operating account %d", tc.caller.ID, tc.account.ID)
+	}
+}
+
+func TestParseAccountFilter(t *testing.T) {
+	server := newTestServer(t, newFakeStorage())
+
+	filter, err := server.parseAccountFilter(httptest.NewRequest(http.MethodGet, "/account?minBalance=0.01&metadataKey=tier", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "tier", filter.MetadataKey)
+	if assert.NotNil(t, filter.MinBalance) {
+		assert.Equal(t, Money(1), *filter.MinBalance)
+	}
+
+	filter, err = server.parseAccountFilter(httptest.NewRequest(http.MethodGet, "/account", nil))
+	assert.Nil(t, err)
+	assert.Nil(t, filter.MinBalance, "no balance filter by default")
+
+	filter, err = server.parseAccountFilter(httptest.NewRequest(http.MethodGet, "/account?createdFrom=2024-03-01T00:00:00%2B02:00&createdTo=2024-03-31T23:59:59Z", nil))
+	assert.Nil(t, err)
+	assert.True(t, filter.CreatedFrom.Equal(time.Date(2024, 2, 29, 22, 0, 0, 0, time.UTC)), "the offset is honored")
+	assert.True(t, filter.CreatedTo.Equal(time.Date(2024, 3, 31, 23, 59, 59, 0, time.UTC)))
+
+	for _, q := range []string{"minBalance=abc", "minBalance=1.001", "metadataValue=gold", "createdFrom=2024-03-01",
+		"createdFrom=2024-03-02T00:00:00Z&createdTo=2024-03-01T00:00:00Z"} {
+		_, err := server.parseAccountFilter(httptest.NewRequest(http.MethodGet, "/account?"+q, nil))
+		assert.NotNil(t, err, q)
+	}
+}
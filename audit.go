@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+
+	// maxAuditUserAgent bounds what a client can make us store.
+	maxAuditUserAgent = 512
+)
+
+// newAuditEntry describes who the request comes from: the client IP, its
+// user agent and, when the caller is an admin, their account number.
+func (s *APIServer) newAuditEntry(r *http.Request, action string) *AuditEntry {
+	entry := &AuditEntry{
+		Action:    action,
+		SourceIP:  clientIP(r, s.trustedProxies),
+		UserAgent: strings.ToValidUTF8(r.UserAgent(), ""),
+	}
+	if len(entry.UserAgent) > maxAuditUserAgent {
+		entry.UserAgent = strings.ToValidUTF8(entry.UserAgent[:maxAuditUserAgent], "")
+	}
+	if tokenFromRequest(r) != "" {
+		if number, err := accountNumberFromToken(r); err == nil && s.admins[number] {
+			entry.AdminNumber = &number
+		}
+	}
+	return entry
+}
+
+// handleAudit returns the audit log to admins, newest first, optionally
+// only for the account given by ?accountId=.
+func (s *APIServer) handleAudit(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+
+	q := r.URL.Query()
+	filter := AuditFilter{Limit: defaultAuditLimit}
+	if v := q.Get("accountId"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 {
+			return fmt.Errorf("invalid accountId: '%s'", v)
+		}
+		filter.AccountID = id
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			return fmt.Errorf("invalid limit: '%s', expected 1 to %d", v, maxAuditLimit)
+		}
+		filter.Limit = n
+	}
+
+	entries, err := s.storage.GetAuditLog(filter)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, entries)
+}
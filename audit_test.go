@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAuditStorage struct {
+	*fakeStorage
+	filter AuditFilter
+}
+
+func (s *fakeAuditStorage) GetAuditLog(filter AuditFilter) ([]*AuditEntry, error) {
+	s.filter = filter
+	return []*AuditEntry{}, nil
+}
+
+func TestNewAuditEntry(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	server := newTestServer(t, newFakeStorage())
+	server.admins = map[int64]bool{1001: true}
+
+	req := httptest.NewRequest(http.MethodPost, "/account", nil)
+	req.RemoteAddr = "203.0.113.7:4242"
+	req.Header.Set("User-Agent", strings.Repeat("x", 600))
+	entry := server.newAuditEntry(req, AuditActionAccountCreated)
+	assert.Equal(t, AuditActionAccountCreated, entry.Action)
+	assert.Equal(t, "203.0.113.7", entry.SourceIP)
+	assert.Len(t, entry.UserAgent, maxAuditUserAgent)
+	assert.Nil(t, entry.AdminNumber, "signing up involves no admin")
+
+	for number, admin := range map[int64]bool{1001: true, 1002: false} {
+		token, err := createJWT(&Account{Number: number}, "session", time.Minute)
+		assert.Nil(t, err)
+		req.Header.Set("x-jwt-token", token)
+		entry := server.newAuditEntry(req, AuditActionAccountCreated)
+		if admin {
+			assert.Equal(t, &number, entry.AdminNumber)
+		} else {
+			assert.Nil(t, entry.AdminNumber, "owners opening accounts aren't admins")
+		}
+	}
+}
+
+func TestHandleAudit(t *testing.T) {
+	storage := &fakeAuditStorage{fakeStorage: newFakeStorage()}
+	server := newTestServer(t, storage)
+	handler := makeHTTPHandlerFunc(server.handleAudit)
+
+	tests := []struct {
+		query  string
+		status int
+		filter AuditFilter
+	}{
+		{"", http.StatusOK, AuditFilter{Limit: defaultAuditLimit}},
+		{"?accountId=7&limit=5", http.StatusOK, AuditFilter{AccountID: 7, Limit: 5}},
+		{"?accountId=x", http.StatusBadRequest, AuditFilter{}},
+		{"?limit=5000", http.StatusBadRequest, AuditFilter{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			storage.filter = AuditFilter{}
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/audit"+tt.query, nil))
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.filter, storage.filter)
+		})
+	}
+}
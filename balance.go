@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxBalancesPerRequest bounds how many accounts POST /accounts/balances
+// looks up at once.
+const maxBalancesPerRequest = 1000
+
+// snapshotInterval is how often the snapshot job checks whether today's
+// balance snapshots have been taken.
+const snapshotInterval = time.Hour
+
+// handleAccountBalance returns the balance of an account, as of the end of
+// the ?asOf=YYYY-MM-DD day in the requested timezone when given.
+func (s *APIServer) handleAccountBalance(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	loc, err := s.requestLocation(r)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	at := now
+	if v := r.URL.Query().Get("asOf"); v != "" {
+		day, err := time.ParseInLocation(time.DateOnly, v, loc)
+		if err != nil {
+			return fmt.Errorf("invalid asOf date: '%s', expected YYYY-MM-DD", v)
+		}
+		if day.After(now) {
+			return fmt.Errorf("asOf date must not be in the future")
+		}
+		if end := day.AddDate(0, 0, 1); end.Before(now) {
+			at = end
+		}
+	}
+
+	display := strings.ToUpper(r.URL.Query().Get("display"))
+	if display != "" {
+		if _, err := currencyExponent(display); err != nil {
+			return err
+		}
+	}
+
+	balance, err := s.storage.GetBalanceAsOf(id, at.UTC())
+	if errors.Is(err, ErrAccountNotFound) {
+		return withStatus(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	res := BalanceResponse{AccountID: id, Balance: balance, Currency: moneyCurrency, AsOf: at.In(loc)}
+	if display != "" {
+		if res.Display, err = s.convertBalance(balance, display); err != nil {
+			return err
+		}
+	}
+	return WriteJSON(w, http.StatusOK, res)
+}
+
+// handleAccountBalances returns the current balances of the accounts in
+// the body, in a single query, for dashboards showing many of them.
+func (s *APIServer) handleAccountBalances(w http.ResponseWriter, r *http.Request) error {
+	req := new(BalancesRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if len(req.IDs) == 0 {
+		return fmt.Errorf("no account ids given")
+	}
+	if len(req.IDs) > maxBalancesPerRequest {
+		return fmt.Errorf("too many account ids: %d, at most %d are allowed", len(req.IDs), maxBalancesPerRequest)
+	}
+
+	accounts, err := s.storage.GetAccountsByIDs(req.IDs)
+	if err != nil {
+		return err
+	}
+	res := BalancesResponse{Balances: make(map[int]Money, len(accounts))}
+	for id, account := range accounts {
+		res.Balances[id] = account.Balance
+	}
+	return WriteJSON(w, http.StatusOK, res)
+}
+
+// runBalanceSnapshots records the balance of every account at the start of
+// each UTC day, until ctx is done.
+func (s *APIServer) runBalanceSnapshots(ctx context.Context) {
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		day := time.Now().UTC().Truncate(24 * time.Hour)
+		if err := s.storage.RecordBalanceSnapshots(day); err != nil {
+			log.Printf("error recording balance snapshots: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBalanceStorage struct {
+	*fakeStorage
+	at time.Time
+}
+
+func (s *fakeBalanceStorage) GetBalanceAsOf(_ int, at time.Time) (Money, error) {
+	s.at = at
+	return 1250, nil
+}
+
+func TestHandleAccountBalanceAsOf(t *testing.T) {
+	store := &fakeBalanceStorage{fakeStorage: newFakeStorage()}
+	server := newTestServer(t, store)
+
+	for _, tc := range []struct {
+		query  string
+		status int
+		at     time.Time
+	}{
+		{"?asOf=2024-01-31", http.StatusOK, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"?asOf=2024-01-31&tz=Europe/Berlin", http.StatusOK, time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)},
+		{"?asOf=31.01.2024", http.StatusBadRequest, time.Time{}},
+		{"?asOf=2999-01-01", http.StatusBadRequest, time.Time{}},
+	} {
+		store.at = time.Time{}
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/account/1/balance"+tc.query, nil), map[string]string{"id": "1"})
+		rec := httptest.NewRecorder()
+		makeHTTPHandlerFunc(server.handleAccountBalance)(rec, req)
+
+		assert.Equal(t, tc.status, rec.Code, tc.query)
+		assert.True(t, tc.at.Equal(store.at), "%s: balance asked for %s", tc.query, store.at)
+	}
+}
+
+func TestHandleAccountBalances(t *testing.T) {
+	alice := &Account{ID: 1, Balance: 500}
+	bob := &Account{ID: 2, Balance: 1250}
+	server := newTestServer(t, newFakeStorage(alice, bob))
+	handler := makeHTTPHandlerFunc(server.handleAccountBalances)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{"found and missing", `{"ids": [1, 2, 3]}`, http.StatusOK, `{"balances": {"1": 5.00, "2": 12.50}}`},
+		{"no ids", `{"ids": []}`, http.StatusBadRequest, ""},
+		{"too many ids", `{"ids": [` + strings.Repeat("1, ", maxBalancesPerRequest) + `1]}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, "/accounts/balances", strings.NewReader(tt.body)))
+			assert.Equal(t, tt.status, rec.Code)
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type BalanceUpdate struct {
+	AccountID int       `json:"accountId"`
+	Balance   Money     `json:"balance"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// BalanceBroker fans balance updates out to the subscribers of each account
+// within this process.
+type BalanceBroker struct {
+	mu   sync.Mutex
+	subs map[int]map[chan BalanceUpdate]struct{}
+}
+
+func NewBalanceBroker() *BalanceBroker {
+	return &BalanceBroker{
+		subs: make(map[int]map[chan BalanceUpdate]struct{}),
+	}
+}
+
+// Subscribe returns the updates of an account and the function that must be
+// called once the subscriber is gone.
+func (b *BalanceBroker) Subscribe(accountID int) (<-chan BalanceUpdate, func()) {
+	ch := make(chan BalanceUpdate, 8)
+
+	b.mu.Lock()
+	if b.subs[accountID] == nil {
+		b.subs[accountID] = make(map[chan BalanceUpdate]struct{})
+	}
+	b.subs[accountID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[accountID], ch)
+		if len(b.subs[accountID]) == 0 {
+			delete(b.subs, accountID)
+		}
+	}
+}
+
+// Publish never blocks: a subscriber too slow to keep up misses the update,
+// which is fine because the next one carries the full balance anyway.
+func (b *BalanceBroker) Publish(u BalanceUpdate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[u.AccountID] {
+		select {
+		case ch <- u:
+		default:
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// runTokenCleanup deletes expired tokens and sessions every
+// tokenCleanupInterval, which would otherwise only go when used or, for
+// sessions, when their account logs in again.
+func (s *APIServer) runTokenCleanup(ctx context.Context) {
+	ticker := time.NewTicker(s.tokenCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.cleanUpTokens(time.Now().UTC())
+	}
+}
+
+func (s *APIServer) cleanUpTokens(now time.Time) {
+	deleted, err := s.storage.DeleteExpiredTokens(now)
+	if err != nil {
+		log.Printf("error deleting expired tokens, %d deleted: %v", deleted, err)
+		return
+	}
+	log.Printf("deleted %d expired tokens and sessions", deleted)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCleanupStorage struct {
+	*fakeStorage
+	cleanups chan time.Time
+}
+
+func (s *fakeCleanupStorage) DeleteExpiredTokens(now time.Time) (int64, error) {
+	s.cleanups <- now
+	return 3, nil
+}
+
+func TestRunTokenCleanup(t *testing.T) {
+	storage := &fakeCleanupStorage{fakeStorage: newFakeStorage(), cleanups: make(chan time.Time, 100)}
+	server := newTestServer(t, storage)
+	server.tokenCleanupInterval = 5 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.runTokenCleanup(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case now := <-storage.cleanups:
+			assert.WithinDuration(t, time.Now(), now, time.Second)
+			assert.Equal(t, time.UTC, now.Location())
+		case <-time.After(time.Second):
+			t.Fatal("expired tokens weren't cleaned up")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runTokenCleanup didn't stop")
+	}
+}
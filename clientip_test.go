@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs("10.0.0.0/8, 192.168.1.1")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:1234", "", "203.0.113.7"},
+		{"untrusted peer cannot spoof", "203.0.113.7:1234", "1.2.3.4", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:80", "198.51.100.2", "198.51.100.2"},
+		{"chain of trusted proxies", "10.1.2.3:80", "198.51.100.2, 192.168.1.1, 10.9.9.9", "198.51.100.2"},
+		{"spoofed leftmost entry", "10.1.2.3:80", "1.2.3.4, 198.51.100.2", "198.51.100.2"},
+		{"trusted proxy without header", "192.168.1.1:80", "", "192.168.1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			assert.Equal(t, tt.want, clientIP(r, trusted))
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+// ConcurrencyLimiter caps how many requests per key may be in flight at the
+// same time. Every key gets its own semaphore, dropped again once nothing
+// holds it.
+type ConcurrencyLimiter struct {
+	mu    sync.Mutex
+	limit int
+	sems  map[string]chan struct{}
+}
+
+func NewConcurrencyLimiter(limit int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		limit: limit,
+		sems:  make(map[string]chan struct{}),
+	}
+}
+
+// Acquire takes a slot for key without waiting. It returns false when all
+// slots are taken; otherwise the returned function gives the slot back.
+func (l *ConcurrencyLimiter) Acquire(key string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sem, ok := l.sems[key]
+	if !ok {
+		sem = make(chan struct{}, l.limit)
+		l.sems[key] = sem
+	}
+	select {
+	case sem <- struct{}{}:
+	default:
+		return nil, false
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		<-sem
+		if len(sem) == 0 {
+			delete(l.sems, key)
+		}
+	}, true
+}
+
+// withConcurrencyLimit rejects requests from clients that already have as
+// many requests in flight as the limiter allows with 429 Too Many Requests.
+// The slot is given back in a deferred call, so a panicking handler doesn't
+// leak it on its way up to withRecovery.
+func (s *APIServer) withConcurrencyLimit(next http.Handler) http.Handler {
+	if s.concurrency == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, ok := s.concurrency.Acquire(clientIP(r, s.trustedProxies))
+		if !ok {
+			WriteJSON(w, http.StatusTooManyRequests, ApiError{Error: "too many concurrent requests, try again later"})
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRecovery turns a panicking handler into a 500 response instead of a
+// dropped connection, and logs the stack trace.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// net/http uses this panic to abort a response on purpose.
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, sanitizePath(r.URL.Path), err, debug.Stack())
+			WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "internal server error"})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
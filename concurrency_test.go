@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l := NewConcurrencyLimiter(2)
+
+	release1, ok := l.Acquire("a")
+	assert.True(t, ok)
+	release2, ok := l.Acquire("a")
+	assert.True(t, ok)
+	_, ok = l.Acquire("a")
+	assert.False(t, ok, "both slots of a are taken")
+	_, ok = l.Acquire("b")
+	assert.True(t, ok, "b has slots of its own")
+
+	release1()
+	release3, ok := l.Acquire("a")
+	assert.True(t, ok, "a released a slot")
+
+	release2()
+	release3()
+	assert.NotContains(t, l.sems, "a", "idle semaphores are dropped")
+}
+
+func TestWithConcurrencyLimitReleasesOnPanic(t *testing.T) {
+	server := newTestServer(t, newFakeStorage())
+	server.concurrency = NewConcurrencyLimiter(1)
+
+	block := make(chan struct{})
+	started := make(chan struct{})
+	handler := withRecovery(server.withConcurrencyLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-block
+			return
+		}
+		panic("boom")
+	})))
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		close(done)
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "the slow request holds the only slot")
+	close(block)
+	<-done
+
+	for i := 0; i < 3; i++ {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+		assert.Equal(t, http.StatusInternalServerError, rec.Code, "the slot is released after each panic")
+	}
+}
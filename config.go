@@ -0,0 +1,729 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxJWTTTL bounds JWT_TTL: a leaked token works until it expires or its
+// session is revoked, so it shouldn't outlive a working day.
+const maxJWTTTL = 24 * time.Hour
+
+// defaultMaxTransferAmount is a billion in major units of a two decimal
+// currency, far above any legitimate transfer.
+const defaultMaxTransferAmount = 100_000_000_000
+
+// Config holds the runtime settings of the server, read from the environment
+// and the -config file.
+type Config struct {
+	ListenAddr string
+
+	// TLSCert and TLSKey switch the API to HTTPS when both are set.
+	TLSCert string
+	TLSKey  string
+
+	DBHost     string
+	DBPort     string
+	DBUser     string
+	DBPassword string
+	DBName     string
+	// DBSSLMode is one of the lib/pq sslmodes. verify-ca and verify-full
+	// need DBSSLRootCert; DBSSLCert and DBSSLKey enable client certificates.
+	DBSSLMode     string
+	DBSSLRootCert string
+	DBSSLCert     string
+	DBSSLKey      string
+
+	// DBSchema is the schema the tables live in, public when empty. It is
+	// created if missing.
+	DBSchema string
+
+	// ReplicaDSN optionally points at a read replica serving account
+	// lookups and listings.
+	ReplicaDSN string
+	// SlowQueryThreshold, when positive, has storage calls taking at least
+	// that long logged.
+	SlowQueryThreshold time.Duration
+	// NumberCacheSize, when positive, caches the ids of up to that many
+	// account numbers for withJWTAuth, loaded on startup.
+	NumberCacheSize int
+
+	// Currency is the ISO 4217 code of the currency amounts are held in. It
+	// decides how many decimal places amounts have in the API.
+	Currency string
+	// ExchangeRates are what one unit of Currency is worth in other
+	// currencies, for showing balances in them.
+	ExchangeRates map[string]float64
+
+	// TransferFeeFlat is charged on every transfer, in minor units.
+	TransferFeeFlat int64
+	// TransferFeeBasisPoints is charged proportionally to the transfer
+	// amount, in hundredths of a percent.
+	TransferFeeBasisPoints int64
+
+	// AsyncEventQueue, when positive, has the events of transfers written
+	// after the transfer has committed, by AsyncEventWorkers workers taking
+	// them from a queue of that many events. Events that can't be written
+	// then are lost rather than rolling the transfer back.
+	AsyncEventQueue   int
+	AsyncEventWorkers int
+
+	// MaxTransferAmount caps every single transfer, in minor units, whatever
+	// the balance, as a circuit breaker against runaway clients and fraud.
+	// Zero disables it.
+	MaxTransferAmount int64
+
+	// IdempotencyStore is where idempotency keys are kept: "memory", for a
+	// single instance, or "postgres", shared by all of them. Keys are
+	// forgotten after IdempotencyKeyTTL.
+	IdempotencyStore  string
+	IdempotencyKeyTTL time.Duration
+
+	// StartupReconcile runs the reconciliation before the API starts, and
+	// refuses to start when more than StartupReconcileMax accounts'
+	// balances disagree with their ledger.
+	StartupReconcile    bool
+	StartupReconcileMax int
+
+	// TrustedProxies are the networks whose X-Forwarded-For header is
+	// believed when determining the client IP.
+	TrustedProxies []*net.IPNet
+
+	// SchemaDir holds the JSON schemas request bodies are validated
+	// against. Validation is skipped when it is empty.
+	SchemaDir string
+
+	// ContentTypes are the media types POST, PUT and PATCH bodies may be
+	// sent as. application/json is the only one accepted when it is empty.
+	ContentTypes []string
+
+	CORS CORSConfig
+
+	// Features switches parts of the API off, see FEATURES.
+	Features Features
+
+	// WebhookURL receives a POST for every transfer, signed with
+	// WebhookSecret when it is set.
+	WebhookURL    string
+	WebhookSecret string
+
+	// AdminAccounts are the numbers of the accounts allowed to use the
+	// admin endpoints.
+	AdminAccounts []int64
+
+	// DisplayLocation is the default timezone timestamps are rendered in.
+	// They are always stored in UTC.
+	DisplayLocation *time.Location
+
+	// AccountNumberLength, when set, switches new account numbers to
+	// AccountNumberPrefix followed by random digits and a Luhn check digit.
+	AccountNumberPrefix string
+	AccountNumberLength int
+	// AccountNumberMax bounds the random numbers handed out when no number
+	// format is configured.
+	AccountNumberMax int64
+	// AccountNumberRetries is how many more numbers are tried when a newly
+	// generated one is already taken.
+	AccountNumberRetries int
+
+	// DefaultBalance is credited to every new account, in minor units, and
+	// recorded in its ledger as the opening balance.
+	DefaultBalance int64
+
+	// NameCase is how the casing of account holder names is normalized,
+	// NameCasePreserve or NameCaseTitle. Names are always trimmed.
+	NameCase string
+
+	// TransferCategories are the spending categories transfers may be
+	// tagged with.
+	TransferCategories []string
+
+	// MaxAccountsPerOwner caps how many accounts a single owner may hold.
+	// Zero means no cap.
+	MaxAccountsPerOwner int
+
+	// RequireVerification keeps new accounts from logging in until they
+	// confirm their email address through the link sent to them.
+	RequireVerification bool
+	// RequireDeleteConfirmation makes deleting an account take two steps:
+	// asking for a confirmation token, then sending it with the DELETE.
+	RequireDeleteConfirmation bool
+	// PublicURL is where clients reach the API, used in emailed links.
+	PublicURL string
+
+	// SMTPHost enables sending emails through that server.
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// PasswordResetRateLimit is how many reset emails a client IP may
+	// request per hour.
+	PasswordResetRateLimit int
+	// MaxConcurrentPerIP caps the requests a client IP may have in flight
+	// at once. Zero means no cap.
+	MaxConcurrentPerIP int
+
+	JWTTTL time.Duration
+
+	// LoginMaxFailures failed logins in a row lock an account for
+	// LoginLockout.
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+
+	// RequestTimeout is how long a request may take before it is
+	// cancelled and answered with 503; zero disables it.
+	RequestTimeout time.Duration
+
+	// ShutdownTimeout is how long in-flight requests get to finish on
+	// SIGINT/SIGTERM before their connections are closed.
+	ShutdownTimeout time.Duration
+
+	// TokenCleanupInterval is how often expired tokens and sessions are
+	// deleted; zero disables it.
+	TokenCleanupInterval time.Duration
+
+	// Maintenance starts the server in maintenance mode, rejecting writes
+	// with a Retry-After of MaintenanceRetryAfter.
+	Maintenance           bool
+	MaintenanceRetryAfter time.Duration
+}
+
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		ListenAddr: getEnv("LISTEN_ADDR", ":3000"),
+		TLSCert:    getEnv("TLS_CERT", ""),
+		TLSKey:     getEnv("TLS_KEY", ""),
+
+		DBHost:        getEnv("DB_HOST", "localhost"),
+		DBPort:        getEnv("DB_PORT", "5432"),
+		DBUser:        getEnv("DB_USER", "postgres"),
+		DBPassword:    getEnv("DB_PASSWORD", "gobank"),
+		DBName:        getEnv("DB_NAME", "postgres"),
+		DBSSLMode:     getEnv("DB_SSLMODE", "disable"),
+		DBSSLRootCert: getEnv("DB_SSLROOTCERT", ""),
+		DBSSLCert:     getEnv("DB_SSLCERT", ""),
+		DBSSLKey:      getEnv("DB_SSLKEY", ""),
+
+		DBSchema:   getEnv("DB_SCHEMA", ""),
+		ReplicaDSN: getEnv("DB_REPLICA_DSN", ""),
+		SchemaDir:  getEnv("JSON_SCHEMA_DIR", ""),
+		Currency:   strings.ToUpper(getEnv("CURRENCY", "USD")),
+	}
+
+	var missing []string
+	if getEnv("JWT_SECRETS", "") == "" && getEnv("JWT_TEST_SECRET", "") == "" {
+		missing = append(missing, "JWT_SECRETS")
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing required settings: %s", strings.Join(missing, ", "))
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	if err := cfg.validateDatabaseTLS(); err != nil {
+		return nil, err
+	}
+	if cfg.DBSchema != "" && !schemaName.MatchString(cfg.DBSchema) {
+		return nil, fmt.Errorf("invalid DB_SCHEMA: '%s', expected lowercase letters, digits and underscores", cfg.DBSchema)
+	}
+
+	var err error
+	if _, err := currencyExponent(cfg.Currency); err != nil {
+		return nil, err
+	}
+
+	if cfg.TransferFeeFlat, err = getEnvInt64("TRANSFER_FEE_FLAT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.TransferFeeFlat < 0 {
+		return nil, fmt.Errorf("TRANSFER_FEE_FLAT must not be negative")
+	}
+
+	percent, err := getEnvFloat("TRANSFER_FEE_PERCENT", 0)
+	if err != nil {
+		return nil, err
+	}
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("TRANSFER_FEE_PERCENT must be between 0 and 100")
+	}
+	cfg.TransferFeeBasisPoints = int64(math.Round(percent * 100))
+
+	queue, err := getEnvInt64("ASYNC_EVENT_QUEUE", 0)
+	if err != nil {
+		return nil, err
+	}
+	if queue < 0 {
+		return nil, fmt.Errorf("ASYNC_EVENT_QUEUE must not be negative")
+	}
+	cfg.AsyncEventQueue = int(queue)
+	workers, err := getEnvInt64("ASYNC_EVENT_WORKERS", 4)
+	if err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		return nil, fmt.Errorf("ASYNC_EVENT_WORKERS must be at least 1")
+	}
+	cfg.AsyncEventWorkers = int(workers)
+
+	if cfg.MaxTransferAmount, err = getEnvInt64("MAX_TRANSFER_AMOUNT", defaultMaxTransferAmount); err != nil {
+		return nil, err
+	}
+	if cfg.MaxTransferAmount < 0 {
+		return nil, fmt.Errorf("MAX_TRANSFER_AMOUNT must not be negative")
+	}
+
+	cfg.IdempotencyStore = strings.ToLower(getEnv("IDEMPOTENCY_STORE", IdempotencyStorePostgres))
+	if cfg.IdempotencyStore != IdempotencyStoreMemory && cfg.IdempotencyStore != IdempotencyStorePostgres {
+		return nil, fmt.Errorf("IDEMPOTENCY_STORE must be %s or %s", IdempotencyStoreMemory, IdempotencyStorePostgres)
+	}
+	if cfg.IdempotencyKeyTTL, err = getEnvDuration("IDEMPOTENCY_KEY_TTL", idempotencyKeyTTL); err != nil {
+		return nil, err
+	}
+	if cfg.IdempotencyKeyTTL <= 0 {
+		return nil, fmt.Errorf("IDEMPOTENCY_KEY_TTL must be positive")
+	}
+
+	if cfg.SlowQueryThreshold, err = getEnvDuration("SLOW_QUERY_THRESHOLD", 0); err != nil {
+		return nil, err
+	}
+	if cfg.SlowQueryThreshold < 0 {
+		return nil, fmt.Errorf("SLOW_QUERY_THRESHOLD must not be negative")
+	}
+	numberCache, err := getEnvInt64("NUMBER_CACHE_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+	if numberCache < 0 {
+		return nil, fmt.Errorf("NUMBER_CACHE_SIZE must not be negative")
+	}
+	cfg.NumberCacheSize = int(numberCache)
+
+	if cfg.StartupReconcile, err = getEnvBool("STARTUP_RECONCILE", false); err != nil {
+		return nil, err
+	}
+	reconcileMax, err := getEnvInt64("STARTUP_RECONCILE_MAX", 0)
+	if err != nil {
+		return nil, err
+	}
+	if reconcileMax < 0 {
+		return nil, fmt.Errorf("STARTUP_RECONCILE_MAX must not be negative")
+	}
+	cfg.StartupReconcileMax = int(reconcileMax)
+
+	if cfg.TrustedProxies, err = parseCIDRs(getEnv("TRUSTED_PROXIES", "")); err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+
+	if cfg.Features, err = parseFeatures(getEnvList("FEATURES")); err != nil {
+		return nil, err
+	}
+	if cfg.ExchangeRates, err = parseExchangeRates(getEnvList("EXCHANGE_RATES")); err != nil {
+		return nil, fmt.Errorf("invalid EXCHANGE_RATES: %w", err)
+	}
+
+	cfg.WebhookURL = getEnv("WEBHOOK_URL", "")
+	cfg.WebhookSecret = getEnv("WEBHOOK_SECRET", "")
+	if cfg.WebhookURL != "" {
+		if u, err := url.Parse(cfg.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid WEBHOOK_URL: '%s'", cfg.WebhookURL)
+		}
+	}
+
+	cfg.CORS.AllowedOrigins = getEnvList("CORS_ALLOWED_ORIGINS")
+	cfg.CORS.ExposedHeaders = getEnvList("CORS_EXPOSED_HEADERS")
+	if cfg.CORS.AllowCredentials, err = getEnvBool("CORS_ALLOW_CREDENTIALS", false); err != nil {
+		return nil, err
+	}
+	if cfg.CORS.MaxAge, err = getEnvDuration("CORS_MAX_AGE", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if err := cfg.CORS.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.AdminAccounts, err = getEnvInt64List("ADMIN_ACCOUNTS"); err != nil {
+		return nil, err
+	}
+
+	for _, t := range strings.Split(getEnv("CONTENT_TYPES", ""), ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			cfg.ContentTypes = append(cfg.ContentTypes, t)
+		}
+	}
+
+	if cfg.DisplayLocation, err = time.LoadLocation(getEnv("DISPLAY_TZ", "UTC")); err != nil {
+		return nil, fmt.Errorf("invalid DISPLAY_TZ: %w", err)
+	}
+
+	cfg.AccountNumberPrefix = getEnv("ACCOUNT_NUMBER_PREFIX", "")
+	length, err := getEnvInt64("ACCOUNT_NUMBER_LENGTH", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AccountNumberLength = int(length)
+	if err := validateNumberFormat(cfg.AccountNumberPrefix, cfg.AccountNumberLength); err != nil {
+		return nil, err
+	}
+	if cfg.AccountNumberMax, err = getEnvInt64("ACCOUNT_NUMBER_MAX", defaultAccountNumberMax); err != nil {
+		return nil, err
+	}
+	if cfg.AccountNumberMax < 2 {
+		return nil, fmt.Errorf("ACCOUNT_NUMBER_MAX must be at least 2")
+	}
+	retries, err := getEnvInt64("ACCOUNT_NUMBER_RETRIES", 5)
+	if err != nil {
+		return nil, err
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("ACCOUNT_NUMBER_RETRIES must not be negative")
+	}
+	cfg.AccountNumberRetries = int(retries)
+
+	if cfg.DefaultBalance, err = getEnvInt64("DEFAULT_BALANCE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.DefaultBalance < 0 {
+		return nil, fmt.Errorf("DEFAULT_BALANCE must not be negative")
+	}
+
+	cfg.NameCase = strings.ToLower(getEnv("NAME_CASE", NameCasePreserve))
+	if err := validateNameCase(cfg.NameCase); err != nil {
+		return nil, err
+	}
+
+	cfg.TransferCategories = getEnvList("TRANSFER_CATEGORIES")
+	if len(cfg.TransferCategories) == 0 {
+		cfg.TransferCategories = defaultCategories
+	}
+	for i, c := range cfg.TransferCategories {
+		cfg.TransferCategories[i] = normalizeCategory(c)
+	}
+	if err := validateCategories(cfg.TransferCategories); err != nil {
+		return nil, err
+	}
+
+	maxAccounts, err := getEnvInt64("MAX_ACCOUNTS_PER_OWNER", 5)
+	if err != nil {
+		return nil, err
+	}
+	if maxAccounts < 0 {
+		return nil, fmt.Errorf("MAX_ACCOUNTS_PER_OWNER must not be negative")
+	}
+	cfg.MaxAccountsPerOwner = int(maxAccounts)
+
+	cfg.SMTPHost = getEnv("SMTP_HOST", "")
+	cfg.SMTPPort = getEnv("SMTP_PORT", "587")
+	cfg.SMTPUsername = getEnv("SMTP_USERNAME", "")
+	cfg.SMTPPassword = getEnv("SMTP_PASSWORD", "")
+	cfg.SMTPFrom = getEnv("SMTP_FROM", "")
+	if cfg.SMTPHost != "" && cfg.SMTPFrom == "" {
+		return nil, fmt.Errorf("SMTP_HOST requires SMTP_FROM")
+	}
+
+	// Verification emails can only be sent through SMTP; without it new
+	// accounts could never log in.
+	if cfg.RequireVerification, err = getEnvBool("REQUIRE_VERIFICATION", cfg.SMTPHost != ""); err != nil {
+		return nil, err
+	}
+	if cfg.RequireVerification && cfg.SMTPHost == "" {
+		return nil, fmt.Errorf("REQUIRE_VERIFICATION requires SMTP_HOST")
+	}
+	if cfg.RequireDeleteConfirmation, err = getEnvBool("REQUIRE_DELETE_CONFIRMATION", true); err != nil {
+		return nil, err
+	}
+	cfg.PublicURL = strings.TrimSuffix(getEnv("PUBLIC_URL", "http://localhost:3000"), "/")
+
+	resetLimit, err := getEnvInt64("PASSWORD_RESET_RATE_LIMIT", 5)
+	if err != nil {
+		return nil, err
+	}
+	if resetLimit < 1 {
+		return nil, fmt.Errorf("PASSWORD_RESET_RATE_LIMIT must be at least 1")
+	}
+	cfg.PasswordResetRateLimit = int(resetLimit)
+
+	concurrent, err := getEnvInt64("MAX_CONCURRENT_PER_IP", 20)
+	if err != nil {
+		return nil, err
+	}
+	if concurrent < 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_PER_IP must not be negative")
+	}
+	cfg.MaxConcurrentPerIP = int(concurrent)
+
+	if cfg.JWTTTL, err = getEnvDuration("JWT_TTL", 15*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.JWTTTL <= 0 || cfg.JWTTTL > maxJWTTTL {
+		return nil, fmt.Errorf("JWT_TTL must be positive and at most %s", maxJWTTTL)
+	}
+
+	maxFailures, err := getEnvInt64("LOGIN_MAX_FAILURES", 5)
+	if err != nil {
+		return nil, err
+	}
+	if maxFailures < 1 {
+		return nil, fmt.Errorf("LOGIN_MAX_FAILURES must be at least 1")
+	}
+	cfg.LoginMaxFailures = int(maxFailures)
+	if cfg.LoginLockout, err = getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.LoginLockout <= 0 {
+		return nil, fmt.Errorf("LOGIN_LOCKOUT must be positive")
+	}
+
+	if cfg.RequestTimeout, err = getEnvDuration("REQUEST_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.RequestTimeout < 0 {
+		return nil, fmt.Errorf("REQUEST_TIMEOUT must not be negative")
+	}
+
+	if cfg.ShutdownTimeout, err = getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return nil, fmt.Errorf("SHUTDOWN_TIMEOUT must be positive")
+	}
+	if cfg.TokenCleanupInterval, err = getEnvDuration("TOKEN_CLEANUP_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.TokenCleanupInterval < 0 {
+		return nil, fmt.Errorf("TOKEN_CLEANUP_INTERVAL must not be negative")
+	}
+
+	if cfg.Maintenance, err = getEnvBool("MAINTENANCE_MODE", false); err != nil {
+		return nil, err
+	}
+	if cfg.MaintenanceRetryAfter, err = getEnvDuration("MAINTENANCE_RETRY_AFTER", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.MaintenanceRetryAfter < time.Second {
+		return nil, fmt.Errorf("MAINTENANCE_RETRY_AFTER must be at least a second")
+	}
+
+	return cfg, nil
+}
+
+// schemaName is what DB_SCHEMA may be: an unquoted Postgres identifier,
+// which is then safe to splice into statements and connection strings.
+var schemaName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// DatabaseDSN assembles the connection URL for the primary database. Going
+// through url.URL escapes whatever the settings contain, e.g. a password
+// with '@', ':' or spaces in it.
+func (c *Config) DatabaseDSN() string {
+	q := url.Values{}
+	q.Set("sslmode", c.DBSSLMode)
+	if c.DBSSLRootCert != "" {
+		q.Set("sslrootcert", c.DBSSLRootCert)
+	}
+	if c.DBSSLCert != "" {
+		q.Set("sslcert", c.DBSSLCert)
+		q.Set("sslkey", c.DBSSLKey)
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.DBUser, c.DBPassword),
+		Host:     net.JoinHostPort(c.DBHost, c.DBPort),
+		Path:     "/" + c.DBName,
+		RawQuery: q.Encode(),
+	}
+	return withSearchPath(u.String(), c.DBSchema)
+}
+
+// withSearchPath makes the connections of dsn resolve table names in
+// schema, which saves qualifying every query with it. dsn may be a URL or
+// key=value pairs.
+func withSearchPath(dsn, schema string) string {
+	if schema == "" {
+		return dsn
+	}
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			// Leave it to lib/pq to report.
+			return dsn
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+func (c *Config) validateDatabaseTLS() error {
+	switch c.DBSSLMode {
+	case "disable", "require":
+	case "verify-ca", "verify-full":
+		if c.DBSSLRootCert == "" {
+			return fmt.Errorf("DB_SSLMODE=%s requires DB_SSLROOTCERT", c.DBSSLMode)
+		}
+	default:
+		return fmt.Errorf("invalid DB_SSLMODE: '%s'", c.DBSSLMode)
+	}
+
+	if (c.DBSSLCert == "") != (c.DBSSLKey == "") {
+		return fmt.Errorf("DB_SSLCERT and DB_SSLKEY must be set together")
+	}
+	if c.DBSSLMode == "disable" && (c.DBSSLRootCert != "" || c.DBSSLCert != "") {
+		return fmt.Errorf("TLS files are configured but DB_SSLMODE=disable")
+	}
+
+	for key, path := range map[string]string{
+		"DB_SSLROOTCERT": c.DBSSLRootCert,
+		"DB_SSLCERT":     c.DBSSLCert,
+		"DB_SSLKEY":      c.DBSSLKey,
+	} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// configKey is what the keys of a config file look like: the name of the
+// environment variable they stand for.
+var configKey = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// loadConfigFile reads a JSON object of settings named like the
+// environment variables, e.g. {"DB_HOST": "db", "JWT_TTL": "1h"}, and sets
+// the variables that aren't already set, so that the environment keeps
+// the last word. Numbers and booleans are taken as written.
+func loadConfigFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	defer f.Close()
+
+	var settings map[string]any
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&settings); err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !configKey.MatchString(key) {
+			return fmt.Errorf("invalid key in config file %s: '%s', expected an environment variable name", path, key)
+		}
+		var value string
+		switch v := settings[key].(type) {
+		case string:
+			value = v
+		case json.Number, bool:
+			value = fmt.Sprint(v)
+		default:
+			return fmt.Errorf("invalid value for %s in config file %s, expected a string, number or boolean", key, path)
+		}
+		if getEnv(key, "") == "" {
+			os.Setenv(key, value)
+		}
+	}
+	return nil
+}
+
+func getEnv(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getEnvInt64(key string, fallback int64) (int64, error) {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: '%s'", key, v)
+	}
+	return n, nil
+}
+
+func getEnvBool(key string, fallback bool) (bool, error) {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: '%s'", key, v)
+	}
+	return b, nil
+}
+
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: '%s'", key, v)
+	}
+	return d, nil
+}
+
+func getEnvFloat(key string, fallback float64) (float64, error) {
+	v := getEnv(key, "")
+	if v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: '%s'", key, v)
+	}
+	return f, nil
+}
+
+// getEnvList splits a comma-separated variable, dropping empty entries.
+func getEnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(getEnv(key, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func getEnvInt64List(key string) ([]int64, error) {
+	var list []int64
+	for _, v := range strings.Split(getEnv(key, ""), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: '%s'", key, v)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	// Registered so that the variables set from the file are restored.
+	t.Setenv("DB_HOST", "")
+	t.Setenv("DB_PORT", "6543")
+	t.Setenv("MAINTENANCE_MODE", "")
+	t.Setenv("DEFAULT_BALANCE", "")
+	t.Setenv("JWT_SECRETS", "")
+	t.Setenv("JWT_TEST_SECRET", "")
+
+	path := filepath.Join(t.TempDir(), "gobank.json")
+	err := os.WriteFile(path, []byte(`{"DB_HOST": "db", "DB_PORT": "5433", "MAINTENANCE_MODE": true, "DEFAULT_BALANCE": 1000000}`), 0o600)
+	assert.Nil(t, err)
+	assert.Nil(t, loadConfigFile(path))
+
+	_, err = LoadConfig()
+	assert.EqualError(t, err, "missing required settings: JWT_SECRETS")
+
+	t.Setenv("JWT_SECRETS", "secret")
+	cfg, err := LoadConfig()
+	if assert.Nil(t, err) {
+		assert.Equal(t, "db", cfg.DBHost)
+		assert.Equal(t, "6543", cfg.DBPort, "the environment overrides the file")
+		assert.True(t, cfg.Maintenance)
+		assert.Equal(t, int64(1000000), cfg.DefaultBalance)
+	}
+
+	for _, body := range []string{`{"db_host": "db"}`, `{"DB_HOST": ["db"]}`, `DB_HOST=db`} {
+		assert.Nil(t, os.WriteFile(path, []byte(body), 0o600))
+		assert.Error(t, loadConfigFile(path), body)
+	}
+}
+
+func TestLoadConfigVerification(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	t.Setenv("SMTP_FROM", "bank@example.com")
+
+	tests := []struct {
+		smtpHost string
+		require  string
+		want     bool
+		err      string
+	}{
+		{"", "", false, ""},
+		{"smtp.example.com", "", true, ""},
+		{"smtp.example.com", "false", false, ""},
+		{"", "true", false, "REQUIRE_VERIFICATION requires SMTP_HOST"},
+	}
+	for _, tt := range tests {
+		t.Setenv("SMTP_HOST", tt.smtpHost)
+		t.Setenv("REQUIRE_VERIFICATION", tt.require)
+		cfg, err := LoadConfig()
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err)
+			continue
+		}
+		if assert.Nil(t, err) {
+			assert.Equal(t, tt.want, cfg.RequireVerification, "SMTP_HOST=%q REQUIRE_VERIFICATION=%q", tt.smtpHost, tt.require)
+		}
+	}
+}
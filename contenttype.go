@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// routeContentTypes are the media types accepted by routes that don't take
+// JSON, instead of the configured ones.
+var routeContentTypes = map[string]map[string]bool{
+	"/account/import": {"text/csv": true},
+}
+
+// withContentType rejects POST, PUT and PATCH requests whose body isn't
+// declared as one of the accepted media types, so that clients sending
+// e.g. text/plain by mistake find out instead of having it decoded anyway.
+func (s *APIServer) withContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accepted, ok := routeContentTypes[r.URL.Path]
+		if !ok {
+			accepted = s.contentTypes
+		}
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !accepted[mediaType] {
+			WriteJSON(w, http.StatusUnsupportedMediaType, ApiError{
+				Error: fmt.Sprintf("unsupported content type: '%s', expected %s", r.Header.Get("Content-Type"), joinContentTypes(accepted)),
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func joinContentTypes(accepted map[string]bool) string {
+	types := make([]string, 0, len(accepted))
+	for t := range accepted {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return strings.Join(types, " or ")
+}
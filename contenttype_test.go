@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithContentType(t *testing.T) {
+	server := newTestServer(t, newFakeStorage())
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	handler := server.withContentType(next)
+
+	for _, tc := range []struct {
+		method      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{http.MethodPost, "application/json", `{}`, http.StatusNoContent},
+		{http.MethodPost, "application/json; charset=utf-8", `{}`, http.StatusNoContent},
+		{http.MethodPatch, "Application/JSON", `{}`, http.StatusNoContent},
+		{http.MethodPost, "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPut, "", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", ``, http.StatusNoContent},
+		{http.MethodGet, "", ``, http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(tc.method, "/account", strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, tc.status, rec.Code, "%s with %q", tc.method, tc.contentType)
+	}
+}
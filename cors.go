@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsAllowedMethods and corsAllowedHeaders are what browsers may send in
+// cross-origin requests: every method the API serves and every request
+// header it reads.
+const (
+	corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE"
+	corsAllowedHeaders = "Authorization, Content-Type, x-jwt-token, Idempotency-Key, X-Timezone, If-Match, X-Show-Full-Number, X-Delete-Confirmation"
+)
+
+// CORSConfig describes which browser origins may call the API.
+type CORSConfig struct {
+	// AllowedOrigins are origins like https://app.example.com, or "*" for
+	// any. CORS headers are only sent when it isn't empty.
+	AllowedOrigins []string
+	// AllowCredentials lets browsers send cookies and HTTP auth along,
+	// which requires naming the origins rather than "*".
+	AllowCredentials bool
+	// ExposedHeaders are the response headers scripts may read besides the
+	// CORS-safelisted ones.
+	ExposedHeaders []string
+	// MaxAge is how long browsers may cache a preflight response. Zero
+	// leaves it to their default.
+	MaxAge time.Duration
+}
+
+func (c *CORSConfig) validate() error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("CORS_ALLOW_CREDENTIALS can't be combined with the wildcard origin, list the origins in CORS_ALLOWED_ORIGINS instead")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("invalid CORS_ALLOWED_ORIGINS entry: '%s', expected scheme://host[:port]", origin)
+		}
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("CORS_MAX_AGE must not be negative")
+	}
+	return nil
+}
+
+// cors answers preflight requests and adds the CORS headers to the
+// responses to allowed origins.
+type cors struct {
+	any         bool
+	origins     map[string]bool
+	credentials bool
+	exposed     string
+	maxAge      string
+}
+
+func newCORS(cfg CORSConfig) *cors {
+	if len(cfg.AllowedOrigins) == 0 {
+		return nil
+	}
+	c := &cors{
+		origins:     make(map[string]bool),
+		credentials: cfg.AllowCredentials,
+		exposed:     strings.Join(cfg.ExposedHeaders, ", "),
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			c.any = true
+		}
+		c.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	if cfg.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	}
+	return c
+}
+
+func (s *APIServer) withCORS(next http.Handler) http.Handler {
+	c := s.cors
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if !c.any && !c.origins[origin] {
+			if preflight {
+				WriteJSON(w, http.StatusForbidden, ApiError{Error: fmt.Sprintf("origin not allowed: '%s'", origin)})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.any {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if c.exposed != "" {
+				h.Set("Access-Control-Expose-Headers", c.exposed)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+		h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		if c.maxAge != "" {
+			h.Set("Access-Control-Max-Age", c.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
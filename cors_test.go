@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  CORSConfig
+		ok   bool
+	}{
+		{"disabled", CORSConfig{}, true},
+		{"wildcard", CORSConfig{AllowedOrigins: []string{"*"}}, true},
+		{"credentials with origins", CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}, true},
+		{"credentials with wildcard", CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true}, false},
+		{"origin without scheme", CORSConfig{AllowedOrigins: []string{"app.example.com"}}, false},
+		{"origin with path", CORSConfig{AllowedOrigins: []string{"https://app.example.com/login"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.ok, tt.cfg.validate() == nil)
+		})
+	}
+}
+
+func TestWithCORS(t *testing.T) {
+	server := newTestServer(t, newFakeStorage())
+	server.cors = newCORS(CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		ExposedHeaders:   []string{"Retry-After"},
+		MaxAge:           time.Hour,
+	})
+	handler := server.withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	serve := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/account", nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodOptions, "https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "3600", rec.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "x-jwt-token")
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "X-Show-Full-Number")
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "X-Delete-Confirmation")
+
+	rec = serve(http.MethodGet, "https://app.example.com")
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, "Retry-After", rec.Header().Get("Access-Control-Expose-Headers"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Max-Age"))
+
+	rec = serve(http.MethodOptions, "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serve(http.MethodGet, "https://evil.example.com")
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+}
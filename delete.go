@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	deletionTokenTTL = 5 * time.Minute
+
+	// deleteConfirmationHeader carries the token of POST
+	// /account/{id}/delete-request on the DELETE it confirms.
+	deleteConfirmationHeader = "X-Delete-Confirmation"
+)
+
+type DeleteRequestResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// handleDeleteRequest issues the token that DELETE /account/{id} must come
+// with, so that a single stray request can't delete an account. The token
+// is good for one delete of this account within a few minutes.
+func (s *APIServer) handleDeleteRequest(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.storage.GetAccountByID(id); err != nil {
+		return accountLookupError(err)
+	}
+
+	token, hash, err := generateToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().UTC().Add(deletionTokenTTL)
+	if err := s.storage.CreateDeletionToken(id, hash, expiresAt); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, DeleteRequestResponse{Token: token, ExpiresAt: expiresAt})
+}
+
+// confirmDelete checks the confirmation token of a delete of the account,
+// using it up.
+func (s *APIServer) confirmDelete(r *http.Request, id int) error {
+	token := r.Header.Get(deleteConfirmationHeader)
+	if token == "" {
+		return withStatus(http.StatusPreconditionRequired, fmt.Errorf("deleting an account needs the token of POST /account/%d/delete-request in the %s header", id, deleteConfirmationHeader))
+	}
+	err := s.storage.ConsumeDeletionToken(id, hashToken(token))
+	if errors.Is(err, ErrInvalidToken) {
+		return withStatus(http.StatusForbidden, fmt.Errorf("invalid or expired deletion confirmation, please request a new one"))
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDeletionStorage struct {
+	*fakeStorage
+	tokens  map[string]int
+	deleted []int
+}
+
+func (s *fakeDeletionStorage) CreateDeletionToken(accountID int, hash string, _ time.Time) error {
+	s.tokens[hash] = accountID
+	return nil
+}
+
+func (s *fakeDeletionStorage) ConsumeDeletionToken(accountID int, hash string) error {
+	if id, ok := s.tokens[hash]; !ok || id != accountID {
+		return ErrInvalidToken
+	}
+	delete(s.tokens, hash)
+	return nil
+}
+
+func (s *fakeDeletionStorage) DeleteAccount(id int) error {
+	s.deleted = append(s.deleted, id)
+	return nil
+}
+
+func TestTwoStepDelete(t *testing.T) {
+	storage := &fakeDeletionStorage{
+		fakeStorage: newFakeStorage(&Account{ID: 1}, &Account{ID: 2}),
+		tokens:      make(map[string]int),
+	}
+	server := newTestServer(t, storage)
+	server.confirmDeletes = true
+
+	request := func(id int) string {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/account/%d/delete-request", id), nil)
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(id)})
+		rec := httptest.NewRecorder()
+		makeHTTPHandlerFunc(server.handleDeleteRequest)(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var res DeleteRequestResponse
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		return res.Token
+	}
+	del := func(id int, token string) int {
+		req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/account/%d", id), nil)
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(id)})
+		if token != "" {
+			req.Header.Set(deleteConfirmationHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		makeHTTPHandlerFunc(server.handleDeleteAccount)(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusPreconditionRequired, del(1, ""))
+	assert.Equal(t, http.StatusForbidden, del(1, "garbage"))
+
+	token := request(1)
+	assert.Equal(t, http.StatusForbidden, del(2, token), "the token is for another account")
+	assert.Equal(t, http.StatusOK, del(1, token))
+	assert.Equal(t, http.StatusForbidden, del(1, token), "the token is used up")
+	assert.Equal(t, []int{1}, storage.deleted)
+
+	server.confirmDeletes = false
+	assert.Equal(t, http.StatusOK, del(2, ""), "single-step deletes when turned off")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// eventQueue writes events outside the transaction of the change they
+// describe, from a pool of workers. It takes the event insert, and the
+// advisory lock that serializes it, off the path of every transfer, which
+// otherwise all queue up on that lock.
+//
+// The price is the guarantee insertEvent gives: an event whose write fails,
+// or that is still queued when the process dies, is lost although its
+// transfer committed. Such losses are logged and counted. Only events go
+// through here; balances, the transfer, its ledger entries and its webhook
+// message are always written in the transaction.
+type eventQueue struct {
+	queue chan *Event
+	write func(*Event) error
+	wg    sync.WaitGroup
+
+	// mu guards closed, so that a transfer finishing during shutdown
+	// doesn't send on the closed queue.
+	mu     sync.RWMutex
+	closed bool
+
+	// written counts the events written, inline those written by the
+	// caller because the queue was full, and lost those that couldn't be
+	// written at all.
+	written atomic.Int64
+	inline  atomic.Int64
+	lost    atomic.Int64
+}
+
+func newEventQueue(size, workers int, write func(*Event) error) *eventQueue {
+	q := &eventQueue{queue: make(chan *Event, size), write: write}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// enqueue queues e for writing. When the queue is full the caller writes e
+// itself, so that a backlog slows transfers down instead of growing
+// without bound or dropping events. Once the queue is closed every caller
+// does.
+func (q *eventQueue) enqueue(e *Event) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		q.writeEvent(e)
+		return
+	}
+	select {
+	case q.queue <- e:
+	default:
+		q.inline.Add(1)
+		q.writeEvent(e)
+	}
+}
+
+func (q *eventQueue) work() {
+	defer q.wg.Done()
+	for e := range q.queue {
+		q.writeEvent(e)
+	}
+}
+
+func (q *eventQueue) writeEvent(e *Event) {
+	if err := q.write(e); err != nil {
+		q.lost.Add(1)
+		log.Printf("lost %s event of account %d, %d lost so far: %v", e.Type, e.AccountID, q.lost.Load(), err)
+		return
+	}
+	q.written.Add(1)
+}
+
+// close writes the events still queued and stops the workers.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	close(q.queue)
+	q.mu.Unlock()
+	q.wg.Wait()
+	if n := q.lost.Load(); n > 0 {
+		log.Printf("event queue closed, %d events were lost", n)
+	}
+}
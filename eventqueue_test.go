@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventQueueWritesEverything(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		written []int
+	)
+	q := newEventQueue(4, 2, func(e *Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, e.AccountID)
+		return nil
+	})
+	for i := 1; i <= 20; i++ {
+		q.enqueue(&Event{Type: EventTransferCreated, AccountID: i})
+	}
+	q.close()
+
+	assert.Len(t, written, 20, "closing writes what is still queued")
+	assert.Equal(t, int64(20), q.written.Load())
+	assert.Equal(t, int64(0), q.lost.Load())
+
+	q.enqueue(&Event{Type: EventTransferCreated, AccountID: 21})
+	assert.Len(t, written, 21, "events are written inline once the queue is closed")
+}
+
+func TestEventQueueBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	var calls sync.WaitGroup
+	calls.Add(1)
+	first := true
+	var mu sync.Mutex
+	q := newEventQueue(1, 1, func(e *Event) error {
+		mu.Lock()
+		isFirst := first
+		first = false
+		mu.Unlock()
+		if isFirst {
+			calls.Done()
+			<-release
+		}
+		return nil
+	})
+
+	q.enqueue(&Event{AccountID: 1})
+	calls.Wait() // the worker is busy with the first event
+	q.enqueue(&Event{AccountID: 2})
+	q.enqueue(&Event{AccountID: 3})
+	assert.Equal(t, int64(1), q.inline.Load(), "a full queue has the caller write the event")
+	close(release)
+	q.close()
+	assert.Equal(t, int64(3), q.written.Load())
+}
+
+func TestEventQueueCountsLosses(t *testing.T) {
+	q := newEventQueue(1, 1, func(e *Event) error {
+		return errors.New("connection refused")
+	})
+	q.enqueue(&Event{Type: EventTransferCreated, AccountID: 1})
+	q.close()
+	assert.Equal(t, int64(1), q.lost.Load())
+	assert.Equal(t, int64(0), q.written.Load())
+}
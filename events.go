@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxEventsPerPoll  = 100
+	maxEventsWait     = 30 * time.Second
+	eventPollInterval = 500 * time.Millisecond
+)
+
+// handleEvents returns the events that happened after the id given by
+// ?since=. With ?wait= (a duration of up to 30s) the request is held open
+// until at least one event is available, so consumers can long-poll.
+func (s *APIServer) handleEvents(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+
+	query := r.URL.Query()
+	var since int64
+	if v := query.Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			return fmt.Errorf("invalid since: '%s'", v)
+		}
+	}
+	var wait time.Duration
+	if v := query.Get("wait"); v != "" {
+		var err error
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 || wait > maxEventsWait {
+			return fmt.Errorf("invalid wait: '%s', must be a duration of at most %s", v, maxEventsWait)
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		events, err := s.storage.GetEvents(since, maxEventsPerPoll)
+		if err != nil {
+			return err
+		}
+		if len(events) > 0 || !time.Now().Before(deadline) {
+			return WriteJSON(w, http.StatusOK, events)
+		}
+
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case <-time.After(eventPollInterval):
+		}
+	}
+}
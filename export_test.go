@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeExportStorage struct {
+	*fakeStorage
+	n int
+}
+
+func (s *fakeExportStorage) ExportAccounts(filter AccountFilter, fn func(*Account) error) error {
+	for i := 1; i <= s.n; i++ {
+		if err := fn(&Account{ID: i, Number: int64(1000 + i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestHandleExportAccounts(t *testing.T) {
+	server := newTestServer(t, &fakeExportStorage{fakeStorage: newFakeStorage(), n: 250})
+
+	rec := httptest.NewRecorder()
+	makeHTTPHandlerFunc(server.handleExportAccounts)(rec, httptest.NewRequest(http.MethodGet, "/account/export", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	assert.True(t, rec.Flushed)
+
+	lines := 0
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var account Account
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &account))
+		lines++
+		assert.Equal(t, lines, account.ID)
+	}
+	assert.Equal(t, 250, lines)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ibanFormat          = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+	routingNumberFormat = regexp.MustCompile(`^[0-9]{9}$`)
+	bankAccountFormat   = regexp.MustCompile(`^[0-9]{4,17}$`)
+)
+
+// normalizeIBAN drops the spaces IBANs are usually printed with.
+func normalizeIBAN(iban string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(iban), ""))
+}
+
+// validIBAN checks the format of an IBAN and its check digits: moved to
+// the end, with letters as numbers from 10, it must leave 1 modulo 97.
+func validIBAN(iban string) bool {
+	if !ibanFormat.MatchString(iban) {
+		return false
+	}
+	var digits strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		if c >= 'A' && c <= 'Z' {
+			fmt.Fprintf(&digits, "%d", c-'A'+10)
+		} else {
+			digits.WriteRune(c)
+		}
+	}
+	n, _ := new(big.Int).SetString(digits.String(), 10)
+	return new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// validRoutingNumber checks the format of an ABA routing number and its
+// checksum, weighting the digits 3, 7, 1.
+func validRoutingNumber(rn string) bool {
+	if !routingNumberFormat.MatchString(rn) {
+		return false
+	}
+	sum := 0
+	for i, c := range rn {
+		sum += int(c-'0') * [3]int{3, 7, 1}[i%3]
+	}
+	return sum%10 == 0
+}
+
+func (d *ExternalDestination) validate(errs *fieldErrors) {
+	switch {
+	case d.IBAN != "" && (d.RoutingNumber != "" || d.AccountNumber != ""):
+		errs.add("external", "specify either an IBAN or a routing and account number, not both")
+	case d.IBAN != "":
+		if !validIBAN(normalizeIBAN(d.IBAN)) {
+			errs.add("external.iban", "is not a valid IBAN")
+		}
+	case d.RoutingNumber != "" || d.AccountNumber != "":
+		if !validRoutingNumber(d.RoutingNumber) {
+			errs.add("external.routingNumber", "is not a valid routing number")
+		}
+		if !bankAccountFormat.MatchString(d.AccountNumber) {
+			errs.add("external.accountNumber", "must be 4 to 17 digits")
+		}
+	default:
+		errs.add("external", "an IBAN or a routing and account number is required")
+	}
+}
+
+// Settlement hands external transfers to whatever settles them with other
+// banks. Submitting may happen after the source was debited; a transfer
+// that fails to submit stays external_pending for the process to pick up.
+type Settlement interface {
+	Submit(*ExternalTransfer) error
+}
+
+// logSettlement stands in for a settlement process: it only logs.
+type logSettlement struct{}
+
+func (logSettlement) Submit(et *ExternalTransfer) error {
+	log.Printf("external transfer %d of %s from account %s awaits settlement", et.ID, et.Amount, maskNumber(int64(et.FromAccount)))
+	return nil
+}
+
+// createExternalTransfer is createTransfer to another bank. It is checked
+// like an internal transfer, with no destination account to look up.
+func (s *APIServer) createExternalTransfer(w http.ResponseWriter, number int64, req *TransferRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	if err := s.validateTransferRequest(req); err != nil {
+		return err
+	}
+	from, err := s.resolveAccount(req.FromAccount, req.FromNumber, nil)
+	if err != nil {
+		return transferError(fmt.Errorf("invalid source account: %w", err))
+	}
+	if ok, err := canOperate(s.storage, number, from); err != nil || !ok {
+		return withCode(http.StatusForbidden, CodePermissionDenied, fmt.Errorf("permission denied"))
+	}
+	fee := s.fees.CalculateFee(req)
+	if err := s.checkTransferAmount(from, req.Amount, fee); err != nil {
+		return err
+	}
+
+	destination := *req.External
+	destination.IBAN = normalizeIBAN(destination.IBAN)
+	et := &ExternalTransfer{
+		FromAccount: from.ID,
+		Destination: destination,
+		Amount:      req.Amount,
+		Fee:         fee,
+		Description: sanitizeDescription(req.Description),
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := s.storage.CreateExternalTransfer(et); err != nil {
+		return transferError(err)
+	}
+	s.balances.Publish(BalanceUpdate{AccountID: et.FromAccount, Balance: et.FromBalance, UpdatedAt: et.CreatedAt})
+	if err := s.settlement.Submit(et); err != nil {
+		log.Printf("error submitting external transfer %d for settlement: %v", et.ID, err)
+	}
+	return WriteJSON(w, http.StatusAccepted, et)
+}
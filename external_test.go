@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidIBAN(t *testing.T) {
+	for iban, valid := range map[string]bool{
+		"GB82WEST12345698765432":       true,
+		"DE89370400440532013000":       true,
+		"gb82 west 1234 5698 7654 32":  true,
+		"GB82WEST12345698765433":       false,
+		"GB82WEST1234":                 false,
+		"1282WEST12345698765432":       false,
+		"DE89 3704 0044 0532 0130 00!": false,
+	} {
+		assert.Equal(t, valid, validIBAN(normalizeIBAN(iban)), iban)
+	}
+}
+
+func TestValidRoutingNumber(t *testing.T) {
+	for rn, valid := range map[string]bool{
+		"021000021":  true,
+		"011000015":  true,
+		"021000022":  false,
+		"02100002":   false,
+		"02100002a":  false,
+		"0210000210": false,
+	} {
+		assert.Equal(t, valid, validRoutingNumber(rn), rn)
+	}
+}
+
+type fakeExternalStorage struct {
+	*fakeStorage
+	created []*ExternalTransfer
+}
+
+func (s *fakeExternalStorage) CreateExternalTransfer(et *ExternalTransfer) error {
+	from := s.accounts[et.FromAccount]
+	if from.Balance-(et.Amount+et.Fee) < from.MinBalance {
+		return ErrInsufficientFunds
+	}
+	et.ID, et.Status, et.FromBalance = len(s.created)+1, TransferStatusExternalPending, from.Balance-(et.Amount+et.Fee)
+	s.created = append(s.created, et)
+	return nil
+}
+
+func TestHandleExternalTransfer(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice := &Account{ID: 1, Number: 1001, OwnerID: 1, Balance: 5000, Verified: true}
+	bob := &Account{ID: 2, Number: 1002, OwnerID: 2, Balance: 5000, Verified: true}
+	storage := &fakeExternalStorage{fakeStorage: newFakeStorage(alice, bob)}
+	server := newTestServer(t, storage)
+	handler := makeHTTPHandlerFunc(server.handleTransfer)
+	token, err := createJWT(alice, "session", time.Minute)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"by IBAN", `{"fromAccount": 1, "external": {"iban": "GB82 WEST 1234 5698 7654 32"}, "amount": 10}`, http.StatusAccepted, ""},
+		{"by routing number", `{"fromAccount": 1, "external": {"routingNumber": "021000021", "accountNumber": "12345678"}, "amount": 10}`, http.StatusAccepted, ""},
+		{"invalid IBAN", `{"fromAccount": 1, "external": {"iban": "GB82WEST12345698765433"}, "amount": 10}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"both IBAN and routing number", `{"fromAccount": 1, "external": {"iban": "GB82WEST12345698765432", "routingNumber": "021000021", "accountNumber": "12345678"}, "amount": 10}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"and an internal destination", `{"fromAccount": 1, "toAccount": 2, "external": {"iban": "GB82WEST12345698765432"}, "amount": 10}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"from another's account", `{"fromAccount": 2, "external": {"iban": "GB82WEST12345698765432"}, "amount": 10}`, http.StatusForbidden, CodePermissionDenied},
+		{"beyond the balance", `{"fromAccount": 1, "external": {"iban": "GB82WEST12345698765432"}, "amount": 1000}`, http.StatusUnprocessableEntity, CodeInsufficientFunds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/transfer", strings.NewReader(tt.body))
+			req.Header.Set("x-jwt-token", token)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+			if tt.code != "" {
+				var apiErr ApiError
+				assert.Nil(t, json.NewDecoder(rec.Body).Decode(&apiErr))
+				assert.Equal(t, tt.code, apiErr.Code)
+			}
+		})
+	}
+
+	if assert.Len(t, storage.created, 2) {
+		assert.Equal(t, "GB82WEST12345698765432", storage.created[0].Destination.IBAN, "the IBAN is stored without spaces")
+		assert.Equal(t, TransferStatusExternalPending, storage.created[0].Status)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Features that can be switched off with FEATURES, e.g.
+// FEATURES=scheduling=false,webhooks=false. All of them are on by default.
+const (
+	FeatureTransfers  = "transfers"
+	FeatureScheduling = "scheduling"
+	FeatureWebhooks   = "webhooks"
+	FeatureImport     = "import"
+	FeatureExport     = "export"
+	FeatureStream     = "stream"
+	FeatureStats      = "stats"
+)
+
+// CodeFeatureDisabled is the error code of requests to disabled features.
+const CodeFeatureDisabled = "feature_disabled"
+
+var knownFeatures = []string{
+	FeatureTransfers,
+	FeatureScheduling,
+	FeatureWebhooks,
+	FeatureImport,
+	FeatureExport,
+	FeatureStream,
+	FeatureStats,
+}
+
+// Features holds the features that were switched on or off explicitly;
+// the others are enabled.
+type Features map[string]bool
+
+func (f Features) Enabled(name string) bool {
+	enabled, ok := f[name]
+	return !ok || enabled
+}
+
+// All returns whether each known feature is enabled.
+func (f Features) All() map[string]bool {
+	all := make(map[string]bool, len(knownFeatures))
+	for _, name := range knownFeatures {
+		all[name] = f.Enabled(name)
+	}
+	return all
+}
+
+// parseFeatures parses name=bool pairs, rejecting features it doesn't
+// know so that a typo doesn't leave one on by accident.
+func parseFeatures(pairs []string) (Features, error) {
+	features := make(Features)
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid feature flag: '%s', expected name=true or name=false", pair)
+		}
+		if !isKnownFeature(name) {
+			return nil, fmt.Errorf("unknown feature: '%s'", name)
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid feature flag: '%s': %w", pair, err)
+		}
+		features[name] = enabled
+	}
+	return features, nil
+}
+
+func isKnownFeature(name string) bool {
+	for _, known := range knownFeatures {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+// feature returns handler when the named feature is enabled, and otherwise
+// one answering 501 Not Implemented.
+func (s *APIServer) feature(name string, handler http.HandlerFunc) http.HandlerFunc {
+	if s.features.Enabled(name) {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusNotImplemented, ApiError{Error: fmt.Sprintf("feature '%s' is disabled on this server", name), Code: CodeFeatureDisabled})
+	}
+}
+
+// handleFeatures lists the features and whether they are enabled.
+func (s *APIServer) handleFeatures(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	return WriteJSON(w, http.StatusOK, s.features.All())
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFeatures(t *testing.T) {
+	features, err := parseFeatures([]string{"scheduling=false", "webhooks=true"})
+	assert.Nil(t, err)
+	assert.False(t, features.Enabled(FeatureScheduling))
+	assert.True(t, features.Enabled(FeatureWebhooks))
+	assert.True(t, features.Enabled(FeatureTransfers), "features are on unless switched off")
+
+	for _, pairs := range [][]string{{"scheduling"}, {"schedulin=false"}, {"scheduling=maybe"}} {
+		_, err := parseFeatures(pairs)
+		assert.Error(t, err, "%v", pairs)
+	}
+}
+
+func TestFeatureDisabled(t *testing.T) {
+	server := newTestServer(t, newFakeStorage())
+	server.features = Features{FeatureStats: false}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	rec := httptest.NewRecorder()
+	server.feature(FeatureStats, ok)(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	assert.Contains(t, rec.Body.String(), CodeFeatureDisabled)
+
+	rec = httptest.NewRecorder()
+	server.feature(FeatureExport, ok)(rec, httptest.NewRequest(http.MethodGet, "/account/export", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
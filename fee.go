@@ -0,0 +1,35 @@
+package main
+
+// FeeCalculator decides the fee charged to the source account of a transfer.
+type FeeCalculator interface {
+	CalculateFee(req *TransferRequest) Money
+}
+
+// NewFeeCalculator returns the fee calculator described by the config,
+// falling back to charging no fees at all.
+func NewFeeCalculator(cfg *Config) FeeCalculator {
+	if cfg.TransferFeeFlat == 0 && cfg.TransferFeeBasisPoints == 0 {
+		return ZeroFeeCalculator{}
+	}
+	return FlatPercentFeeCalculator{
+		Flat:        cfg.TransferFeeFlat,
+		BasisPoints: cfg.TransferFeeBasisPoints,
+	}
+}
+
+type ZeroFeeCalculator struct{}
+
+func (ZeroFeeCalculator) CalculateFee(*TransferRequest) Money {
+	return 0
+}
+
+// FlatPercentFeeCalculator charges a flat fee plus a percentage of the
+// amount, expressed in basis points and rounded down to the minor unit.
+type FlatPercentFeeCalculator struct {
+	Flat        int64
+	BasisPoints int64
+}
+
+func (c FlatPercentFeeCalculator) CalculateFee(req *TransferRequest) Money {
+	return Money(c.Flat + int64(req.Amount)*c.BasisPoints/10000)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlatPercentFeeCalculator(t *testing.T) {
+	calc := FlatPercentFeeCalculator{Flat: 25, BasisPoints: 150}
+
+	assert.Equal(t, Money(25), calc.CalculateFee(&TransferRequest{Amount: 0}))
+	assert.Equal(t, Money(175), calc.CalculateFee(&TransferRequest{Amount: 10000}))
+	assert.Equal(t, Money(0), ZeroFeeCalculator{}.CalculateFee(&TransferRequest{Amount: 10000}))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// accountFields are the fields of an account that ?fields= may select.
+var accountFields = map[string]bool{
+	"id": true, "firstName": true, "lastName": true, "number": true,
+	"balance": true, "minBalance": true, "metadata": true,
+	"verified": true, "ownerId": true, "maxAccounts": true, "createdAt": true,
+	"version": true, "nickname": true,
+}
+
+// parseFields splits a comma separated ?fields= value, rejecting any field
+// that is not allowed. It returns nil when no fields were asked for.
+func parseFields(param string, allowed map[string]bool) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(param, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !allowed[f] {
+			return nil, fmt.Errorf("unknown field '%s'", f)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// selectFields keeps only the given fields of v's JSON object. Fields that
+// v leaves out, such as empty metadata, stay out.
+func selectFields(v any, fields []string) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if raw, ok := all[f]; ok {
+			selected[f] = raw
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountFieldsCoverAccount(t *testing.T) {
+	max := 3
+	b, err := json.Marshal(&Account{Metadata: map[string]string{"k": "v"}, Email: "a@example.com", MaxAccounts: &max, Nickname: "Rent"})
+	assert.Nil(t, err)
+	var all map[string]any
+	assert.Nil(t, json.Unmarshal(b, &all))
+	for f := range all {
+		assert.True(t, accountFields[f], "%s can't be selected", f)
+	}
+	assert.Len(t, accountFields, len(all), "only account fields can be selected")
+}
+
+func TestHandleGetAccountFields(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice := &Account{ID: 1, Number: 123456, OwnerID: 1, Balance: 1250}
+	server := newTestServer(t, newFakeStorage(alice))
+	token, err := createJWT(alice, "session", time.Minute)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   string
+	}{
+		{"selected", "?fields=id,balance", http.StatusOK, `{"id": 1, "balance": 12.50}`},
+		{"masked number", "?fields=number", http.StatusOK, `{"number": "****3456"}`},
+		{"full number", "?fields=number&fullNumber=true", http.StatusOK, `{"number": 123456}`},
+		{"left out when empty", "?fields=id,metadata", http.StatusOK, `{"id": 1}`},
+		{"unknown field", "?fields=id,balanse", http.StatusBadRequest, ""},
+		{"not allowed", "?fields=encryptedPassword", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/account/1"+tt.query, nil), map[string]string{"id": "1"})
+			req.Header.Set("x-jwt-token", token)
+			rec := httptest.NewRecorder()
+			makeHTTPHandlerFunc(server.handleAccountByID)(rec, req)
+			assert.Equal(t, tt.status, rec.Code, rec.Body.String())
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// handleLivez reports that the process is up. It deliberately checks
+// nothing else, so that a database outage doesn't get the process restarted.
+func (s *APIServer) handleLivez(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the server can take traffic, i.e. whether
+// the storage is migrated and reachable.
+func (s *APIServer) handleReadyz(w http.ResponseWriter, r *http.Request) error {
+	if err := s.storage.Ready(); err != nil {
+		log.Printf("not ready: %v", err)
+		return WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+	}
+	return WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthProbes(t *testing.T) {
+	store := newFakeStorage()
+	server := newTestServer(t, store)
+
+	for _, tc := range []struct {
+		name     string
+		readyErr error
+		livez    int
+		readyz   int
+	}{
+		{"ready", nil, http.StatusOK, http.StatusOK},
+		{"database down", errors.New("connection refused"), http.StatusOK, http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store.readyErr = tc.readyErr
+
+			rec := httptest.NewRecorder()
+			makeHTTPHandlerFunc(server.handleLivez)(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+			assert.Equal(t, tc.livez, rec.Code)
+
+			rec = httptest.NewRecorder()
+			makeHTTPHandlerFunc(server.handleReadyz)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tc.readyz, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// handleAccountTransfers lists the transfers of an account. It accepts
+// ?direction=in|out, ?from= and ?to= dates (YYYY-MM-DD, both inclusive, in
+// the requested timezone) and ?limit=/?offset= for pagination.
+func (s *APIServer) handleAccountTransfers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	loc, err := s.requestLocation(r)
+	if err != nil {
+		return err
+	}
+	filter, err := parseTransferFilter(r.URL.Query(), loc)
+	if err != nil {
+		return err
+	}
+
+	transfers, err := s.storage.GetTransfers(id, filter)
+	if err != nil {
+		return err
+	}
+	for _, t := range transfers {
+		t.CreatedAt = t.CreatedAt.In(loc)
+	}
+	return WriteJSON(w, http.StatusOK, TransferHistoryResponse{
+		Transfers: transfers,
+		Limit:     filter.Limit,
+		Offset:    filter.Offset,
+	})
+}
+
+// parseDateRange parses the from and to dates (YYYY-MM-DD, both included)
+// of q in loc, returning the half-open range [from, to). Either is zero
+// when not given.
+func parseDateRange(q url.Values, loc *time.Location) (from, to time.Time, err error) {
+	if v := q.Get("from"); v != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, v, loc); err != nil {
+			return from, to, fmt.Errorf("invalid from date: '%s', expected YYYY-MM-DD", v)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, v, loc); err != nil {
+			return from, to, fmt.Errorf("invalid to date: '%s', expected YYYY-MM-DD", v)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, fmt.Errorf("from date must not be after to date")
+	}
+	return from, to, nil
+}
+
+func parseTransferFilter(q url.Values, loc *time.Location) (TransferFilter, error) {
+	filter := TransferFilter{Limit: defaultHistoryLimit}
+
+	switch d := q.Get("direction"); d {
+	case "", DirectionIn, DirectionOut:
+		filter.Direction = d
+	default:
+		return filter, fmt.Errorf("invalid direction: '%s', expected 'in' or 'out'", d)
+	}
+
+	var err error
+	if filter.From, filter.To, err = parseDateRange(q, loc); err != nil {
+		return filter, err
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			return filter, fmt.Errorf("invalid limit: '%s', expected 1 to %d", v, maxHistoryLimit)
+		}
+		filter.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return filter, fmt.Errorf("invalid offset: '%s'", v)
+		}
+		filter.Offset = n
+	}
+	return filter, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTransferFilter(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		ok    bool
+	}{
+		{"", true},
+		{"direction=in&limit=10&offset=20", true},
+		{"direction=sideways", false},
+		{"from=2024-01-01&to=2024-01-31", true},
+		{"from=2024-01-31&to=2024-01-31", true},
+		{"from=2024-02-01&to=2024-01-31", false},
+		{"from=01/02/2024", false},
+		{"limit=0", false},
+		{"limit=1000", false},
+		{"offset=-1", false},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		_, err := parseTransferFilter(q, time.UTC)
+		assert.Equal(t, tc.ok, err == nil, "query %q: %v", tc.query, err)
+	}
+
+	q, _ := url.ParseQuery("from=2024-01-01&to=2024-01-31")
+	filter, err := parseTransferFilter(q, time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultHistoryLimit, filter.Limit)
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), filter.To, "to is inclusive")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotencyKeyTTL       = 24 * time.Hour
+	maxIdempotencyKeyLength = 255
+)
+
+const (
+	IdempotencyStoreMemory   = "memory"
+	IdempotencyStorePostgres = "postgres"
+)
+
+// IdempotencyStore keeps the idempotency keys of account creations. A key
+// is reserved and completed rather than read and then written, so that two
+// requests racing with the same key can't both be let through.
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey claims key for a request with the given hash.
+	// It returns nil when the key was free and the record of the earlier
+	// request otherwise. Keys older than ttl are forgotten.
+	ReserveIdempotencyKey(key, requestHash string, ttl time.Duration) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(key string, accountID int) error
+	ReleaseIdempotencyKey(key string) error
+}
+
+// newIdempotencyStore returns the store named by IDEMPOTENCY_STORE. Keys in
+// memory are only seen by this instance, which is fine for a single one;
+// several instances need them in Postgres.
+func newIdempotencyStore(backend string, storage Storage) (IdempotencyStore, error) {
+	switch backend {
+	case "", IdempotencyStoreMemory:
+		return newMemoryIdempotencyStore(), nil
+	case IdempotencyStorePostgres:
+		// The storage may be wrapped in decorators, which don't keep keys.
+		for {
+			if store, ok := storage.(IdempotencyStore); ok {
+				return store, nil
+			}
+			d, ok := storage.(storageDecorator)
+			if !ok {
+				return nil, fmt.Errorf("the storage can't keep idempotency keys")
+			}
+			storage = d.unwrap()
+		}
+	}
+	return nil, fmt.Errorf("unknown idempotency store: '%s'", backend)
+}
+
+// memoryIdempotencyStore keeps idempotency keys in a map, for running a
+// single instance.
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: make(map[string]IdempotencyRecord)}
+}
+
+func (m *memoryIdempotencyStore) ReserveIdempotencyKey(key, requestHash string, ttl time.Duration) (*IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	for k, rec := range m.records {
+		if now.Sub(rec.CreatedAt) >= ttl {
+			delete(m.records, k)
+		}
+	}
+	if rec, ok := m.records[key]; ok {
+		return &rec, nil
+	}
+	m.records[key] = IdempotencyRecord{Key: key, RequestHash: requestHash, CreatedAt: now}
+	return nil, nil
+}
+
+func (m *memoryIdempotencyStore) CompleteIdempotencyKey(key string, accountID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rec, ok := m.records[key]; ok {
+		rec.AccountID = accountID
+		m.records[key] = rec
+	}
+	return nil
+}
+
+func (m *memoryIdempotencyStore) ReleaseIdempotencyKey(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rec, ok := m.records[key]; ok && rec.AccountID == 0 {
+		delete(m.records, key)
+	}
+	return nil
+}
+
+// idempotencyMetrics counts what became of the requests that carried an
+// idempotency key, for /stats.
+type idempotencyMetrics struct {
+	// reserved counts first uses of a key, replays the requests answered
+	// with the account an earlier one created, and conflicts those refused
+	// because the key was in use.
+	reserved  atomic.Int64
+	replays   atomic.Int64
+	conflicts atomic.Int64
+}
+
+func (m *idempotencyMetrics) snapshot() *IdempotencyStats {
+	return &IdempotencyStats{Reserved: m.reserved.Load(), Replays: m.replays.Load(), Conflicts: m.conflicts.Load()}
+}
+
+// reserveIdempotencyKey claims key for req. It returns the account an
+// earlier request with the same key and payload created, or nil when this
+// is the first time the key is seen and the account still has to be
+// created.
+func (s *APIServer) reserveIdempotencyKey(key string, req *CreateAccountRequest) (*Account, error) {
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, fmt.Errorf("%s must be at most %d characters long", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+	// The password is left out of the stored hash, which would otherwise
+	// make it cheap to brute-force, and checked against the account instead.
+	payload := *req
+	payload.Password = ""
+	hash, err := requestHash(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := s.idempotency.ReserveIdempotencyKey(key, hash, s.idempotencyTTL)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		s.idempotencyMetrics.reserved.Add(1)
+		return nil, nil
+	}
+	if rec.RequestHash != hash {
+		s.idempotencyMetrics.conflicts.Add(1)
+		return nil, withStatus(http.StatusConflict, fmt.Errorf("%s was already used for a different request", idempotencyKeyHeader))
+	}
+	if rec.AccountID == 0 {
+		s.idempotencyMetrics.conflicts.Add(1)
+		return nil, withStatus(http.StatusConflict, fmt.Errorf("a request with this %s is still in progress", idempotencyKeyHeader))
+	}
+
+	account, err := s.storage.GetAccountByID(rec.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if !account.ValidatePassword(req.Password) {
+		s.idempotencyMetrics.conflicts.Add(1)
+		return nil, withStatus(http.StatusConflict, fmt.Errorf("%s was already used for a different request", idempotencyKeyHeader))
+	}
+	s.idempotencyMetrics.replays.Add(1)
+	return account, nil
+}
+
+// finishIdempotencyKey records the outcome of the request key was reserved
+// for. Failed requests release the key so that they can be retried.
+func (s *APIServer) finishIdempotencyKey(key string, account *Account, err error) {
+	if err != nil {
+		if err := s.idempotency.ReleaseIdempotencyKey(key); err != nil {
+			log.Printf("error releasing idempotency key: %v", err)
+		}
+		return
+	}
+	if err := s.idempotency.CompleteIdempotencyKey(key, account.ID); err != nil {
+		log.Printf("error completing idempotency key for account %s: %v", maskNumber(int64(account.ID)), err)
+	}
+}
+
+func requestHash(req any) (string, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
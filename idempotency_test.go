@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	account, err := NewAccount("a", "b", "password")
+	assert.Nil(t, err)
+	account.ID = 7
+	server := newTestServer(t, newFakeStorage(account))
+
+	req := &CreateAccountRequest{FirstName: "a", LastName: "b", Password: "password", Email: "a@b.c"}
+	existing, err := server.reserveIdempotencyKey("key", req)
+	assert.Nil(t, err)
+	assert.Nil(t, existing, "a new key is reserved")
+
+	_, err = server.reserveIdempotencyKey("key", req)
+	assertStatus(t, http.StatusConflict, err, "the first request is still in progress")
+
+	assert.Nil(t, server.idempotency.CompleteIdempotencyKey("key", account.ID))
+	existing, err = server.reserveIdempotencyKey("key", req)
+	assert.Nil(t, err)
+	assert.Equal(t, account, existing, "a replay returns the original account")
+
+	other := *req
+	other.Email = "other@b.c"
+	_, err = server.reserveIdempotencyKey("key", &other)
+	assertStatus(t, http.StatusConflict, err, "the key was used with a different payload")
+
+	other = *req
+	other.Password = "another password"
+	_, err = server.reserveIdempotencyKey("key", &other)
+	assertStatus(t, http.StatusConflict, err, "the key was used with a different password")
+
+	assert.Equal(t, &IdempotencyStats{Reserved: 1, Replays: 1, Conflicts: 3}, server.idempotencyMetrics.snapshot())
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	m := newMemoryIdempotencyStore()
+
+	rec, err := m.ReserveIdempotencyKey("key", "hash", time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, rec, "a new key is reserved")
+	assert.Nil(t, m.ReleaseIdempotencyKey("key"))
+	rec, err = m.ReserveIdempotencyKey("key", "hash", time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, rec, "a released key can be reserved again")
+
+	assert.Nil(t, m.CompleteIdempotencyKey("key", 7))
+	assert.Nil(t, m.ReleaseIdempotencyKey("key"), "completed keys are kept")
+	rec, err = m.ReserveIdempotencyKey("key", "other", time.Hour)
+	assert.Nil(t, err)
+	if assert.NotNil(t, rec) {
+		assert.Equal(t, "hash", rec.RequestHash)
+		assert.Equal(t, 7, rec.AccountID)
+	}
+
+	rec, err = m.ReserveIdempotencyKey("key", "other", 0)
+	assert.Nil(t, err)
+	assert.Nil(t, rec, "expired keys are forgotten")
+}
+
+func TestNewIdempotencyStore(t *testing.T) {
+	store, err := newIdempotencyStore("", newFakeStorage())
+	assert.Nil(t, err)
+	assert.IsType(t, &memoryIdempotencyStore{}, store)
+
+	_, err = newIdempotencyStore(IdempotencyStorePostgres, newFakeStorage())
+	assert.NotNil(t, err, "the storage doesn't keep idempotency keys")
+	_, err = newIdempotencyStore(IdempotencyStorePostgres, newSlowQueryStorage(newFakeStorage(), time.Second))
+	assert.NotNil(t, err, "nor does a decorator around it")
+	_, err = newIdempotencyStore("redis", newFakeStorage())
+	assert.NotNil(t, err)
+}
+
+func assertStatus(t *testing.T, status int, err error, msg string) {
+	t.Helper()
+	var serr *StatusError
+	if assert.True(t, errors.As(err, &serr), msg) {
+		assert.Equal(t, status, serr.Status, msg)
+	}
+}
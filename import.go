@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// importBatchSize is how many rows are inserted per transaction.
+const importBatchSize = 500
+
+// importColumns are the CSV columns the import understands. first_name and
+// last_name are required; balance and min_balance are decimals.
+var importColumns = map[string]bool{
+	"first_name":  true,
+	"last_name":   true,
+	"balance":     false,
+	"min_balance": false,
+	"email":       false,
+}
+
+type ImportRowResult struct {
+	// Row is the line of the data row, the header being line 1.
+	Row     int    `json:"row"`
+	Success bool   `json:"success"`
+	ID      int    `json:"id,omitempty"`
+	Number  int64  `json:"number,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ImportResponse struct {
+	Imported int               `json:"imported"`
+	Failed   int               `json:"failed"`
+	Rows     []ImportRowResult `json:"rows"`
+	// Error is set when the import stopped before the end of the file. The
+	// rows listed as successful were imported nonetheless, and those after
+	// the last row listed weren't read.
+	Error string `json:"error,omitempty"`
+}
+
+// ErrImportStopped is the error of the rows a failed import didn't get to.
+var ErrImportStopped = errors.New("not imported, the import stopped")
+
+// handleImportAccounts creates an account for every row of the CSV body.
+// The file is parsed as it is read and inserted in batches, so its size
+// isn't bounded by memory. Imported accounts have no password: their
+// holders choose one through a password reset.
+func (s *APIServer) handleImportAccounts(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+
+	reader := csv.NewReader(r.Body)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("error reading the CSV header: %w", err)
+	}
+	columns, err := parseImportHeader(header)
+	if err != nil {
+		return err
+	}
+
+	source := s.newAuditEntry(r, AuditActionAccountCreated)
+	res := ImportResponse{Rows: make([]ImportRowResult, 0)}
+	var (
+		batch []*Account
+		rows  []int
+	)
+	// stop answers with what was imported so far, since earlier batches are
+	// committed and retrying the whole file would import them twice.
+	stop := func(status int, reason string) error {
+		for _, row := range rows {
+			res.Rows = append(res.Rows, ImportRowResult{Row: row, Error: ErrImportStopped.Error()})
+			res.Failed++
+		}
+		res.Error = reason
+		return WriteJSON(w, status, res)
+	}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		errs, err := s.importBatch(batch)
+		if err != nil {
+			log.Printf("error importing accounts at row %d: %v", rows[0], err)
+		}
+		for i, a := range batch {
+			row := ImportRowResult{Row: rows[i], Success: errs[i] == nil}
+			if errs[i] != nil {
+				row.Error = errs[i].Error()
+				res.Failed++
+			} else {
+				row.ID, row.Number = a.ID, a.Number
+				res.Imported++
+			}
+			res.Rows = append(res.Rows, row)
+		}
+		batch, rows = batch[:0], rows[:0]
+		return err
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) || perr.Err != csv.ErrFieldCount {
+				return stop(http.StatusBadRequest, fmt.Sprintf("error reading the CSV: %v", err))
+			}
+		}
+
+		account, err := s.parseImportRow(columns, record)
+		if err != nil {
+			res.Rows = append(res.Rows, ImportRowResult{Row: line, Error: err.Error()})
+			res.Failed++
+			continue
+		}
+		audit := *source
+		account.audit = &audit
+		batch = append(batch, account)
+		rows = append(rows, line)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return stop(http.StatusInternalServerError, "error storing the accounts, the import stopped")
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return stop(http.StatusInternalServerError, "error storing the accounts, the import stopped")
+	}
+	return WriteJSON(w, http.StatusOK, res)
+}
+
+// importBatch stores a batch of accounts, retrying the ones whose generated
+// number turned out to be taken with new numbers. When storing fails, the
+// accounts that didn't make it get ErrImportStopped, and those imported by
+// an earlier attempt nil.
+func (s *APIServer) importBatch(batch []*Account) ([]error, error) {
+	errs := make([]error, len(batch))
+	pending := make([]int, len(batch))
+	for i := range batch {
+		pending[i] = i
+	}
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		accounts := make([]*Account, len(pending))
+		for j, i := range pending {
+			batch[i].Number = s.numbers.Generate()
+			accounts[j] = batch[i]
+		}
+		perr, err := s.storage.ImportAccounts(accounts)
+		if err != nil {
+			for _, i := range pending {
+				errs[i] = ErrImportStopped
+			}
+			return errs, err
+		}
+
+		var retry []int
+		for j, i := range pending {
+			errs[i] = perr[j]
+			if errors.Is(perr[j], ErrNumberTaken) && attempt < s.numberRetries {
+				retry = append(retry, i)
+			}
+		}
+		pending = retry
+	}
+	return errs, nil
+}
+
+func parseImportHeader(header []string) (map[string]int, error) {
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := importColumns[name]; !ok {
+			return nil, fmt.Errorf("unknown CSV column: '%s'", name)
+		}
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("duplicate CSV column: '%s'", name)
+		}
+		columns[name] = i
+	}
+	for name, required := range importColumns {
+		if _, ok := columns[name]; required && !ok {
+			return nil, fmt.Errorf("missing CSV column: '%s'", name)
+		}
+	}
+	return columns, nil
+}
+
+func (s *APIServer) parseImportRow(columns map[string]int, record []string) (*Account, error) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var errs fieldErrors
+	account := &Account{
+		FirstName: s.normalizeName(field("first_name")),
+		LastName:  s.normalizeName(field("last_name")),
+		Email:     field("email"),
+		// The previous system already vouched for these customers.
+		Verified:  true,
+		CreatedAt: time.Now().UTC(),
+	}
+	validateName(&errs, "first_name", account.FirstName)
+	validateName(&errs, "last_name", account.LastName)
+	if account.Email != "" {
+		if _, err := mail.ParseAddress(account.Email); err != nil {
+			errs.add("email", "invalid email address: '%s'", account.Email)
+		}
+	}
+	if v := field("balance"); v != "" {
+		balance, err := ParseMoney(v)
+		errs.addErr("balance", err)
+		account.Balance = balance
+	}
+	if v := field("min_balance"); v != "" {
+		minBalance, err := ParseMoney(v)
+		errs.addErr("min_balance", err)
+		if minBalance > 0 {
+			errs.add("min_balance", "must not be positive")
+		}
+		account.MinBalance = minBalance
+	}
+	if account.Balance < account.MinBalance {
+		errs.add("balance", "must not be below min_balance")
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
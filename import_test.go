@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeImportStorage struct {
+	*fakeStorage
+	collisions int
+	imported   []*Account
+	// batches, when positive, is how many calls succeed before storing
+	// fails.
+	batches int
+	calls   int
+}
+
+func (s *fakeImportStorage) ImportAccounts(accounts []*Account) ([]error, error) {
+	if s.calls++; s.batches > 0 && s.calls > s.batches {
+		return nil, fmt.Errorf("connection reset")
+	}
+	errs := make([]error, len(accounts))
+	for i, a := range accounts {
+		if s.collisions > 0 {
+			s.collisions--
+			errs[i] = fmt.Errorf("%w: '%d'", ErrNumberTaken, a.Number)
+			continue
+		}
+		a.ID = len(s.imported) + 1
+		s.imported = append(s.imported, a)
+	}
+	return errs, nil
+}
+
+func TestHandleImportAccounts(t *testing.T) {
+	store := &fakeImportStorage{fakeStorage: newFakeStorage(), collisions: 1}
+	server := newTestServer(t, store)
+	server.numberRetries = 1
+
+	body := "First_Name,last_name,balance,email\n" +
+		"Ada,Lovelace,12.50,ada@example.com\n" +
+		",Turing,1,\n" +
+		"Grace,Hopper,abc,not-an-email\n" +
+		"Alan,Kay\n"
+	req := httptest.NewRequest(http.MethodPost, "/account/import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+	rec := httptest.NewRecorder()
+	makeHTTPHandlerFunc(server.handleImportAccounts)(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var res ImportResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 2, res.Imported)
+	assert.Equal(t, 2, res.Failed)
+	if assert.Len(t, res.Rows, 4) {
+		// Rows failing validation are reported before the batch they'd
+		// have been part of.
+		assert.Equal(t, 3, res.Rows[0].Row)
+		assert.Contains(t, res.Rows[0].Error, "first_name")
+		assert.Equal(t, 4, res.Rows[1].Row)
+		assert.Contains(t, res.Rows[1].Error, "balance")
+		assert.Contains(t, res.Rows[1].Error, "email")
+		// The first row collided and was retried after the second.
+		assert.Equal(t, ImportRowResult{Row: 2, Success: true, ID: 2, Number: store.imported[1].Number}, res.Rows[2])
+		assert.Equal(t, 5, res.Rows[3].Row)
+		assert.True(t, res.Rows[3].Success)
+	}
+	assert.Equal(t, Money(1250), store.imported[1].Balance)
+	assert.True(t, store.imported[1].Verified)
+}
+
+func TestHandleImportAccountsStops(t *testing.T) {
+	rows := func(n int) string {
+		return strings.Repeat("Ada,Lovelace\n", n)
+	}
+
+	t.Run("storage error", func(t *testing.T) {
+		store := &fakeImportStorage{fakeStorage: newFakeStorage(), batches: 1}
+		server := newTestServer(t, store)
+		req := httptest.NewRequest(http.MethodPost, "/account/import", strings.NewReader("first_name,last_name\n"+rows(importBatchSize+2)))
+		rec := httptest.NewRecorder()
+		makeHTTPHandlerFunc(server.handleImportAccounts)(rec, req)
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+		var res ImportResponse
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		assert.Equal(t, importBatchSize, res.Imported, "the first batch was committed")
+		assert.Equal(t, 2, res.Failed)
+		assert.NotEmpty(t, res.Error)
+		if assert.Len(t, res.Rows, importBatchSize+2) {
+			assert.True(t, res.Rows[importBatchSize-1].Success)
+			assert.Equal(t, ImportRowResult{Row: importBatchSize + 2, Error: ErrImportStopped.Error()}, res.Rows[importBatchSize])
+		}
+		assert.NotContains(t, rec.Body.String(), "connection reset")
+	})
+
+	t.Run("malformed CSV", func(t *testing.T) {
+		store := &fakeImportStorage{fakeStorage: newFakeStorage()}
+		server := newTestServer(t, store)
+		req := httptest.NewRequest(http.MethodPost, "/account/import", strings.NewReader("first_name,last_name\n"+rows(importBatchSize+1)+"\"Ada,Lovelace\n"))
+		rec := httptest.NewRecorder()
+		makeHTTPHandlerFunc(server.handleImportAccounts)(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		var res ImportResponse
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		assert.Equal(t, importBatchSize, res.Imported)
+		assert.Equal(t, 1, res.Failed, "the row read in the next batch wasn't imported")
+		assert.Contains(t, res.Error, "error reading the CSV")
+	})
+}
+
+func TestHandleImportAccountsHeader(t *testing.T) {
+	server := newTestServer(t, &fakeImportStorage{fakeStorage: newFakeStorage()})
+
+	for _, header := range []string{"first_name\n", "first_name,last_name,password\n", ""} {
+		req := httptest.NewRequest(http.MethodPost, "/account/import", strings.NewReader(header))
+		rec := httptest.NewRecorder()
+		makeHTTPHandlerFunc(server.handleImportAccounts)(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, header)
+	}
+}
+
+func TestWithContentTypeImport(t *testing.T) {
+	server := newTestServer(t, newFakeStorage())
+	handler := server.withContentType(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for path, want := range map[string]int{"/account/import": http.StatusOK, "/account": http.StatusUnsupportedMediaType} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("a,b\n"))
+		req.Header.Set("Content-Type", "text/csv")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.Code, path)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTSecretRotation(t *testing.T) {
+	acc := &Account{Number: 1234}
+
+	t.Setenv("JWT_SECRETS", "old")
+	oldToken, err := createJWT(acc, "session", time.Minute)
+	assert.Nil(t, err)
+
+	t.Setenv("JWT_SECRETS", "new, old")
+	newToken, err := createJWT(acc, "session", time.Minute)
+	assert.Nil(t, err)
+
+	_, err = validateJWT(oldToken)
+	assert.Nil(t, err, "tokens signed with the previous secret are still accepted")
+	_, err = validateJWT(newToken)
+	assert.Nil(t, err)
+
+	t.Setenv("JWT_SECRETS", "new")
+	_, err = validateJWT(oldToken)
+	assert.NotNil(t, err, "tokens signed with a retired secret are rejected")
+}
+
+func TestJWTExpiry(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	acc := &Account{Number: 1234}
+
+	token, err := createJWT(acc, "session", time.Minute)
+	assert.Nil(t, err)
+	_, err = validateJWT(token)
+	assert.Nil(t, err)
+
+	expired, err := createJWT(acc, "session", -time.Minute)
+	assert.Nil(t, err)
+	_, err = validateJWT(expired)
+	assert.NotNil(t, err, "expired tokens are rejected")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maskNumber hides all but the last 4 digits of an account number or id,
+// and every digit of shorter ones.
+func maskNumber(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	if len(s) <= 4 {
+		return "****"
+	}
+	return "****" + s[len(s)-4:]
+}
+
+// sanitizePath masks the numeric segments of a URL path, which are account
+// ids and numbers: /account/123456/transfers becomes
+// /account/****3456/transfers.
+func sanitizePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if n, err := strconv.ParseInt(seg, 10, 64); err == nil {
+			segments[i] = maskNumber(n)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+var (
+	logSecretField = regexp.MustCompile(`(?i)"(password|newPassword|currentPassword|token|x-jwt-token)"\s*:\s*"[^"]*"`)
+	logSecretParam = regexp.MustCompile(`(?i)\b(password|token)=[^&\s]+`)
+	logJWT         = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// logLongNumber finds runs of 5 or more digits, which is what account
+	// numbers look like, but not the fractional part of a duration.
+	logLongNumber = regexp.MustCompile(`(^|[^0-9.])([0-9]{5,})`)
+)
+
+// sanitizeLog redacts passwords and tokens from a log line, whether they
+// appear in JSON, in a query string or as a bare JWT, and masks anything
+// that looks like an account number.
+func sanitizeLog(line string) string {
+	line = logSecretField.ReplaceAllString(line, `"$1":"[redacted]"`)
+	line = logSecretParam.ReplaceAllString(line, `$1=[redacted]`)
+	line = logJWT.ReplaceAllString(line, "[redacted token]")
+	return logLongNumber.ReplaceAllStringFunc(line, func(m string) string {
+		sub := logLongNumber.FindStringSubmatch(m)
+		return sub[1] + "****" + sub[2][len(sub[2])-4:]
+	})
+}
+
+// sanitizingWriter runs everything written through it past sanitizeLog,
+// so that nothing sensitive reaches the logs whichever code path logs it.
+type sanitizingWriter struct {
+	w io.Writer
+}
+
+func (s sanitizingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, sanitizeLog(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -1,9 +1,33 @@
 package main
 
-import "log"
+import (
+	"flag"
+	"log"
+	"os"
+	// Embedded so DISPLAY_TZ and ?tz= resolve even without a system tz database.
+	_ "time/tzdata"
+)
 
 func main() {
-	storage, err := NewPostgresStorage()
+	log.SetOutput(sanitizingWriter{os.Stderr})
+
+	configPath := flag.String("config", "", "JSON file of settings, overridden by environment variables")
+	flag.Parse()
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setMoneyCurrency(cfg.Currency); err != nil {
+		log.Fatal(err)
+	}
+
+	storage, err := NewPostgresStorage(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -11,7 +35,27 @@ func main() {
 	if err := storage.Init(); err != nil {
 		log.Fatal(err)
 	}
+	defer storage.Close()
 
-	server := NewAPIServer(":3000", storage)
+	var store Storage = storage
+	if cfg.SlowQueryThreshold > 0 {
+		store = newSlowQueryStorage(store, cfg.SlowQueryThreshold)
+	}
+	if cfg.NumberCacheSize > 0 {
+		if store, err = newNumberCacheStorage(store, cfg.NumberCacheSize); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.StartupReconcile {
+		if err := checkBalances(store, cfg.StartupReconcileMax); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	server, err := NewAPIServer(cfg, store, NewNotifier(cfg))
+	if err != nil {
+		log.Fatal(err)
+	}
 	server.Run()
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// maintenanceExempt lists the writes still allowed in maintenance mode:
+// switching it off again, and logging in, without which nobody could read
+// either. Transfer previews only look like writes.
+var maintenanceExempt = map[string]bool{
+	"/maintenance":      true,
+	"/login":            true,
+	"/transfer/preview": true,
+}
+
+type MaintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// withMaintenance rejects every mutating request with 503 Service
+// Unavailable while maintenance mode is on. Reads go through.
+func (s *APIServer) withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.maintenance.Load() || maintenanceExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.maintenanceRetryAfter.Seconds())))
+		WriteJSON(w, http.StatusServiceUnavailable, ApiError{Error: "the service is under maintenance, only reads are available"})
+	})
+}
+
+// handleMaintenance reports maintenance mode on GET and switches it on or
+// off on PUT.
+func (s *APIServer) handleMaintenance(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		req := new(MaintenanceRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return err
+		}
+		s.maintenance.Store(req.Enabled)
+		log.Printf("maintenance mode set to %t", req.Enabled)
+	default:
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	return WriteJSON(w, http.StatusOK, MaintenanceRequest{Enabled: s.maintenance.Load()})
+}
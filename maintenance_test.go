@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithMaintenance(t *testing.T) {
+	server := newTestServer(t, newFakeStorage())
+	server.maintenanceRetryAfter = 2 * time.Minute
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	handler := server.withMaintenance(next)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodPost, "/transfer").Code)
+
+	server.maintenance.Store(true)
+	rec := serve(http.MethodPost, "/transfer")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "120", rec.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusServiceUnavailable, serve(http.MethodDelete, "/account/1").Code)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodGet, "/account/1").Code, "reads go through")
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodPut, "/maintenance").Code, "maintenance can be switched off")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in minor units of the configured currency, e.g. cents
+// for USD. On the wire it is a decimal in major units: clients may send
+// 12.5, 12.50 or "12.50" and get 12.50 back, while the database stores 1250.
+type Money int64
+
+// moneyCurrency is the configured currency and moneyExponent its number of
+// decimal places. They are package-level because JSON marshalling offers no
+// way to pass them in, and set once by main through setMoneyCurrency.
+var (
+	moneyCurrency = "USD"
+	moneyExponent = 2
+)
+
+// setMoneyCurrency makes code the currency of every Money. It must be
+// called before any is parsed or marshalled.
+func setMoneyCurrency(code string) error {
+	exp, err := currencyExponent(code)
+	if err != nil {
+		return err
+	}
+	moneyCurrency, moneyExponent = code, exp
+	return nil
+}
+
+// currencyExponents lists the ISO 4217 currencies without two decimal
+// places.
+var currencyExponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+}
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// currencyExponent returns the number of decimal places of an ISO 4217
+// currency code.
+func currencyExponent(code string) (int, error) {
+	if !currencyCode.MatchString(code) {
+		return 0, fmt.Errorf("invalid currency code: '%s'", code)
+	}
+	if exp, ok := currencyExponents[code]; ok {
+		return exp, nil
+	}
+	return 2, nil
+}
+
+var decimalAmount = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// ParseMoney parses a decimal amount in major units.
+func ParseMoney(s string) (Money, error) {
+	if !decimalAmount.MatchString(s) {
+		return 0, fmt.Errorf("invalid amount: '%s'", s)
+	}
+	neg := strings.HasPrefix(s, "-")
+	whole, frac, _ := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if len(frac) > moneyExponent {
+		return 0, fmt.Errorf("invalid amount: '%s', at most %d decimal places are allowed", s, moneyExponent)
+	}
+
+	minor, err := strconv.ParseInt(whole+frac+strings.Repeat("0", moneyExponent-len(frac)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount: '%s', out of range", s)
+	}
+	if neg {
+		minor = -minor
+	}
+	return Money(minor), nil
+}
+
+func (m Money) String() string {
+	return formatMinor(int64(m), moneyExponent)
+}
+
+// formatMinor formats an amount in minor units of a currency with exp
+// decimal places as a decimal in major units.
+func formatMinor(m int64, exp int) string {
+	if exp == 0 {
+		return strconv.FormatInt(m, 10)
+	}
+	sign := ""
+	u := uint64(m)
+	if m < 0 {
+		sign = "-"
+		u = -u
+	}
+	digits := strconv.FormatUint(u, 10)
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	split := len(digits) - exp
+	return sign + digits[:split] + "." + digits[split:]
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a string holding a decimal.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	} else if e := strings.IndexAny(s, "eE"); e >= 0 {
+		// Plain JSON numbers may use exponents, which ParseMoney doesn't.
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.Abs(f) >= 1<<53 {
+			return fmt.Errorf("invalid amount: '%s'", s)
+		}
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
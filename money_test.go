@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoneyJSON(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Money
+	}{
+		{`12.50`, 1250},
+		{`12.5`, 1250},
+		{`"12.50"`, 1250},
+		{`12`, 1200},
+		{`0.07`, 7},
+		{`-3.1`, -310},
+		{`1e2`, 10000},
+	} {
+		var m Money
+		assert.Nil(t, json.Unmarshal([]byte(tc.in), &m), tc.in)
+		assert.Equal(t, tc.want, m, tc.in)
+	}
+
+	for _, in := range []string{`12.505`, `"12,50"`, `"abc"`, `true`, `"99999999999999999999"`} {
+		var m Money
+		assert.NotNil(t, json.Unmarshal([]byte(in), &m), in)
+	}
+
+	b, err := json.Marshal(struct{ A, B, C Money }{1250, 7, -310})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"A":12.50,"B":0.07,"C":-3.10}`, string(b))
+}
+
+func TestMoneyCurrencyExponent(t *testing.T) {
+	defer func(code string, exp int) { moneyCurrency, moneyExponent = code, exp }(moneyCurrency, moneyExponent)
+
+	assert.Nil(t, setMoneyCurrency("JPY"))
+	assert.Equal(t, "1250", Money(1250).String())
+	assert.Nil(t, setMoneyCurrency("KWD"))
+	assert.Equal(t, "1.250", Money(1250).String())
+	assert.Equal(t, "KWD", moneyCurrency)
+	assert.NotNil(t, setMoneyCurrency("kwd"))
+	assert.Equal(t, "KWD", moneyCurrency, "left as it was")
+	_, err := ParseMoney("1.2345")
+	assert.NotNil(t, err)
+
+	exp, err := currencyExponent("JPY")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, exp)
+	_, err = currencyExponent("dollars")
+	assert.NotNil(t, err)
+}
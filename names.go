@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	NameCasePreserve = "preserve"
+	NameCaseTitle    = "title"
+)
+
+func validateNameCase(mode string) error {
+	switch mode {
+	case NameCasePreserve, NameCaseTitle:
+		return nil
+	}
+	return fmt.Errorf("NAME_CASE must be %s or %s, got '%s'", NameCasePreserve, NameCaseTitle, mode)
+}
+
+// normalizeName trims the name and collapses runs of whitespace inside it.
+// With NameCaseTitle, every word, and every part of a hyphenated or
+// apostrophized one, is also capitalized: "  mary-JANE  o'neil" becomes
+// "Mary-Jane O'Neil".
+func normalizeName(name, mode string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if mode != NameCaseTitle {
+		return name
+	}
+
+	runes := []rune(strings.ToLower(name))
+	start := true
+	for i, r := range runes {
+		if start && unicode.IsLetter(r) {
+			runes[i] = unicode.ToTitle(r)
+		}
+		start = r == ' ' || r == '-' || r == '\''
+	}
+	return string(runes)
+}
+
+// sanitizeNickname drops control and formatting characters, such as
+// newlines and bidirectional overrides, which could make a nickname render
+// as something else, then trims it and collapses whitespace like
+// normalizeName.
+func sanitizeNickname(nickname string) string {
+	nickname = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return ' '
+		}
+		return r
+	}, nickname)
+	return strings.Join(strings.Fields(nickname), " ")
+}
+
+func (s *APIServer) normalizeName(name string) string {
+	return normalizeName(name, s.nameCase)
+}
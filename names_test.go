@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name, mode, want string
+	}{
+		{" john ", NameCasePreserve, "john"},
+		{"JOHN", NameCasePreserve, "JOHN"},
+		{"van  der\tBerg", NameCasePreserve, "van der Berg"},
+		{" john ", NameCaseTitle, "John"},
+		{"JOHN", NameCaseTitle, "John"},
+		{"  mary-JANE  o'neil", NameCaseTitle, "Mary-Jane O'Neil"},
+		{"élodie", NameCaseTitle, "Élodie"},
+		{"   ", NameCaseTitle, ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, normalizeName(tt.name, tt.mode), "%q in %s mode", tt.name, tt.mode)
+	}
+}
+
+func TestSanitizeNickname(t *testing.T) {
+	tests := []struct {
+		nickname, want string
+	}{
+		{"  Rent ", "Rent"},
+		{"Rainy\tday\nfund", "Rainy day fund"},
+		{"Savings\u202etxt.exe", "Savings txt.exe"},
+		{"Épargne 🏠", "Épargne 🏠"},
+		{"\x00\x1b", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, sanitizeNickname(tt.nickname), "%q", tt.nickname)
+	}
+}
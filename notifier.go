@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Notifier delivers messages, such as verification emails, to account
+// holders.
+type Notifier interface {
+	Send(to, subject, body string) error
+}
+
+// NewNotifier returns an SMTP notifier when an SMTP server is configured and
+// one that drops every message otherwise.
+func NewNotifier(cfg *Config) Notifier {
+	if cfg.SMTPHost == "" {
+		return NoopNotifier{}
+	}
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return &SMTPNotifier{
+		Addr: net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+		From: cfg.SMTPFrom,
+		Auth: auth,
+	}
+}
+
+// NoopNotifier drops every message.
+type NoopNotifier struct{}
+
+func (NoopNotifier) Send(to, subject, body string) error {
+	return nil
+}
+
+// SMTPNotifier sends plain-text emails through an SMTP server.
+type SMTPNotifier struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (n *SMTPNotifier) Send(to, subject, body string) error {
+	// Header values come from user input, so line breaks would let them
+	// inject headers of their own.
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	msg := "From: " + n.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body + "\r\n"
+
+	return smtp.SendMail(n.Addr, n.Auth, n.From, []string{to}, []byte(msg))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// NumberGenerator hands out account numbers and checks numbers chosen by
+// admins for renumbered accounts against the format it produces. Numbers
+// of existing accounts aren't checked, since accounts created before the
+// format was configured don't follow it.
+type NumberGenerator interface {
+	Generate() int64
+	Valid(number int64) bool
+}
+
+// NewNumberGenerator returns a Luhn generator when the config asks for a
+// number format, and the plain random generator otherwise.
+func NewNumberGenerator(cfg *Config) NumberGenerator {
+	if cfg.AccountNumberLength == 0 {
+		return RandomNumberGenerator{Max: cfg.AccountNumberMax}
+	}
+	return LuhnNumberGenerator{
+		Prefix: cfg.AccountNumberPrefix,
+		Length: cfg.AccountNumberLength,
+	}
+}
+
+// defaultAccountNumberMax keeps the original scheme of numbers below a
+// million.
+const defaultAccountNumberMax = 1000000
+
+// RandomNumberGenerator hands out random numbers from 1 up to, but not
+// including, Max (a million when unset). Any number is considered valid.
+type RandomNumberGenerator struct {
+	Max int64
+}
+
+func (g RandomNumberGenerator) Generate() int64 {
+	max := g.Max
+	if max < 2 {
+		max = defaultAccountNumberMax
+	}
+	return 1 + rand.Int63n(max-1)
+}
+
+func (RandomNumberGenerator) Valid(int64) bool {
+	return true
+}
+
+// LuhnNumberGenerator produces Length-digit numbers made of Prefix, random
+// digits and a trailing Luhn check digit.
+type LuhnNumberGenerator struct {
+	Prefix string
+	Length int
+}
+
+func (g LuhnNumberGenerator) Generate() int64 {
+	var b strings.Builder
+	b.WriteString(g.Prefix)
+	// A leading zero would be lost once the number is stored as an integer.
+	if b.Len() == 0 {
+		b.WriteByte(byte('1' + rand.Intn(9)))
+	}
+	for b.Len() < g.Length-1 {
+		b.WriteByte(byte('0' + rand.Intn(10)))
+	}
+	b.WriteByte(luhnCheckDigit(b.String()))
+
+	n, _ := strconv.ParseInt(b.String(), 10, 64)
+	return n
+}
+
+func (g LuhnNumberGenerator) Valid(number int64) bool {
+	s := strconv.FormatInt(number, 10)
+	if len(s) != g.Length || !strings.HasPrefix(s, g.Prefix) {
+		return false
+	}
+	return luhnCheckDigit(s[:len(s)-1]) == s[len(s)-1]
+}
+
+// luhnCheckDigit computes the digit that makes digits+digit pass the Luhn
+// checksum.
+func luhnCheckDigit(digits string) byte {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		// Counting from the check digit the rightmost payload digit is
+		// the second one, so it is the first to be doubled.
+		if (len(digits)-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func validateNumberFormat(prefix string, length int) error {
+	if length == 0 {
+		if prefix != "" {
+			return fmt.Errorf("ACCOUNT_NUMBER_PREFIX requires ACCOUNT_NUMBER_LENGTH")
+		}
+		return nil
+	}
+	for _, c := range prefix {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("ACCOUNT_NUMBER_PREFIX must only contain digits")
+		}
+	}
+	if strings.HasPrefix(prefix, "0") {
+		return fmt.Errorf("ACCOUNT_NUMBER_PREFIX must not start with 0")
+	}
+	// Leave room for at least one random digit and the check digit, and
+	// stay within what fits in an int64.
+	if length < len(prefix)+2 || length > 18 {
+		return fmt.Errorf("ACCOUNT_NUMBER_LENGTH must be between %d and 18", len(prefix)+2)
+	}
+	return nil
+}
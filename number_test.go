@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandomNumberGenerator(t *testing.T) {
+	g := RandomNumberGenerator{Max: 3}
+	for i := 0; i < 100; i++ {
+		n := g.Generate()
+		assert.True(t, n >= 1 && n < 3, "%d out of range", n)
+	}
+}
+
+func TestLuhnCheckDigit(t *testing.T) {
+	// Well-known valid Luhn numbers, split into payload and check digit.
+	assert.Equal(t, byte('3'), luhnCheckDigit("7992739871"))
+	assert.Equal(t, byte('1'), luhnCheckDigit("411111111111111"))
+}
+
+func TestLuhnNumberGenerator(t *testing.T) {
+	g := LuhnNumberGenerator{Prefix: "42", Length: 10}
+	for i := 0; i < 100; i++ {
+		n := g.Generate()
+		assert.True(t, g.Valid(n), "generated number %d should be valid", n)
+
+		check := n % 10
+		wrong := n - check + (check+1)%10
+		assert.False(t, g.Valid(wrong), "number %d has a wrong check digit", wrong)
+	}
+	assert.False(t, g.Valid(1234567897), "number without the prefix")
+}
+
+type collidingStorage struct {
+	*fakeStorage
+	collisions int
+	attempts   int
+}
+
+func (s *collidingStorage) CreateAccount(a *Account) error {
+	s.attempts++
+	if s.attempts <= s.collisions {
+		return fmt.Errorf("%w: '%d'", ErrNumberTaken, a.Number)
+	}
+	return nil
+}
+
+func TestCreateAccountRetriesNumberCollisions(t *testing.T) {
+	req := &CreateAccountRequest{FirstName: "a", LastName: "b", Password: "password", Email: "a@example.com"}
+
+	store := &collidingStorage{fakeStorage: newFakeStorage(), collisions: 2}
+	server := newTestServer(t, store)
+	server.numberRetries = 2
+	_, err := server.createAccount(httptest.NewRequest(http.MethodPost, "/account", nil), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, store.attempts)
+
+	store = &collidingStorage{fakeStorage: newFakeStorage(), collisions: 3}
+	server = newTestServer(t, store)
+	server.numberRetries = 2
+	_, err = server.createAccount(httptest.NewRequest(http.MethodPost, "/account", nil), req)
+	assertStatus(t, http.StatusInternalServerError, err, "the number space is exhausted")
+	assert.Equal(t, 3, store.attempts)
+}
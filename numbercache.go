@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+)
+
+// numberCacheStorage keeps a bounded map of account numbers to ids in front
+// of the Storage it wraps, so that withJWTAuth can tell that a caller is
+// operating their own account without loading it. The map is filled when
+// the storage is wrapped and kept up to date as accounts are created,
+// renumbered and deleted through it; lookups that miss go to the database
+// as before. Accounts deleted by another instance stay in the map, which
+// only lets their requests past withJWTAuth to fail on the missing account
+// or session.
+type numberCacheStorage struct {
+	Storage
+	size int
+
+	mu      sync.RWMutex
+	ids     map[int64]int
+	numbers map[int]int64
+}
+
+// newNumberCacheStorage wraps next, warming the cache up with the up to
+// size accounts logged into most recently.
+func newNumberCacheStorage(next Storage, size int) (*numberCacheStorage, error) {
+	ids, err := next.GetAccountNumbers(size)
+	if err != nil {
+		return nil, err
+	}
+	s := &numberCacheStorage{Storage: next, size: size, ids: make(map[int64]int, len(ids)), numbers: make(map[int]int64, len(ids))}
+	for number, id := range ids {
+		s.put(number, id)
+	}
+	return s, nil
+}
+
+// accountIDCache is implemented by the Storages that can tell an account
+// number's id without a query.
+type accountIDCache interface {
+	cachedAccountID(number int64) (int, bool)
+}
+
+// findAccountIDCache looks for an accountIDCache among storage and the
+// Storages it wraps.
+func findAccountIDCache(storage Storage) (accountIDCache, bool) {
+	for {
+		if c, ok := storage.(accountIDCache); ok {
+			return c, true
+		}
+		d, ok := storage.(storageDecorator)
+		if !ok {
+			return nil, false
+		}
+		storage = d.unwrap()
+	}
+}
+
+func (s *numberCacheStorage) unwrap() Storage {
+	return s.Storage
+}
+
+// cachedAccountID returns the id of the account with number, if cached.
+func (s *numberCacheStorage) cachedAccountID(number int64) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.ids[number]
+	return id, ok
+}
+
+// put caches number, evicting an arbitrary entry when the cache is full so
+// that accounts created since it filled up get cached too.
+func (s *numberCacheStorage) put(number int64, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ids[number]; !ok && len(s.ids) >= s.size {
+		for n, evicted := range s.ids {
+			delete(s.ids, n)
+			delete(s.numbers, evicted)
+			break
+		}
+	}
+	s.ids[number] = id
+	s.numbers[id] = number
+}
+
+func (s *numberCacheStorage) remove(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, s.numbers[id])
+	delete(s.numbers, id)
+}
+
+func (s *numberCacheStorage) CreateAccount(a *Account) error {
+	if err := s.Storage.CreateAccount(a); err != nil {
+		return err
+	}
+	s.put(a.Number, a.ID)
+	return nil
+}
+
+func (s *numberCacheStorage) ImportAccounts(accounts []*Account) ([]error, error) {
+	errs, err := s.Storage.ImportAccounts(accounts)
+	if err != nil {
+		return errs, err
+	}
+	for i, a := range accounts {
+		if errs[i] == nil {
+			s.put(a.Number, a.ID)
+		}
+	}
+	return errs, nil
+}
+
+func (s *numberCacheStorage) ChangeAccountNumber(id int, number int64) (*NumberChange, error) {
+	change, err := s.Storage.ChangeAccountNumber(id, number)
+	if err != nil {
+		return nil, err
+	}
+	s.remove(id)
+	s.put(number, id)
+	return change, nil
+}
+
+func (s *numberCacheStorage) DeleteAccount(id int) error {
+	// Removed first, so that the account can't be authorized from the
+	// cache once it's gone.
+	s.remove(id)
+	return s.Storage.DeleteAccount(id)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeNumberStorage struct {
+	*fakeStorage
+	lookups int
+}
+
+func (s *fakeNumberStorage) GetAccountNumbers(limit int) (map[int64]int, error) {
+	ids := make(map[int64]int)
+	for id, a := range s.accounts {
+		if len(ids) < limit {
+			ids[a.Number] = id
+		}
+	}
+	return ids, nil
+}
+
+func (s *fakeNumberStorage) GetAccountByID(id int) (*Account, error) {
+	s.lookups++
+	return s.fakeStorage.GetAccountByID(id)
+}
+
+func (s *fakeNumberStorage) CreateAccount(a *Account) error {
+	a.ID = len(s.accounts) + 1
+	s.accounts[a.ID] = a
+	return nil
+}
+
+func (s *fakeNumberStorage) DeleteAccount(id int) error {
+	delete(s.accounts, id)
+	return nil
+}
+
+func TestNumberCacheStorage(t *testing.T) {
+	next := &fakeNumberStorage{fakeStorage: newFakeStorage(&Account{ID: 1, Number: 1001})}
+	s, err := newNumberCacheStorage(next, 2)
+	assert.Nil(t, err)
+
+	id, ok := s.cachedAccountID(1001)
+	assert.True(t, ok, "warmed up")
+	assert.Equal(t, 1, id)
+
+	assert.Nil(t, s.CreateAccount(&Account{Number: 2002}))
+	id, ok = s.cachedAccountID(2002)
+	assert.True(t, ok, "created accounts are cached")
+	assert.Equal(t, 2, id)
+	assert.Nil(t, s.CreateAccount(&Account{Number: 3003}))
+	id, ok = s.cachedAccountID(3003)
+	assert.True(t, ok, "a full cache evicts to make room")
+	assert.Equal(t, 3, id)
+	assert.Len(t, s.ids, 2, "the cache is bounded")
+	assert.Len(t, s.numbers, 2)
+
+	assert.Nil(t, s.DeleteAccount(3))
+	_, ok = s.cachedAccountID(3003)
+	assert.False(t, ok, "deleted accounts are dropped")
+}
+
+func TestWithJWTAuthNumberCache(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice := &Account{ID: 1, Number: 1001, OwnerID: 1}
+	bob := &Account{ID: 2, Number: 2002, OwnerID: 2}
+	next := &fakeNumberStorage{fakeStorage: newFakeStorage(alice, bob)}
+	cache, err := newNumberCacheStorage(next, 10)
+	assert.Nil(t, err)
+	// Found under other decorators too.
+	handler := withJWTAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, newSlowQueryStorage(cache, time.Hour))
+
+	request := func(caller *Account, id string) int {
+		token, err := createJWT(caller, "session", time.Minute)
+		assert.Nil(t, err)
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/account/"+id, nil), map[string]string{"id": id})
+		req.Header.Set("x-jwt-token", token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, request(alice, "1"))
+	assert.Equal(t, 0, next.lookups, "operating one's own account needs no query")
+	assert.NotEqual(t, http.StatusNoContent, request(alice, "2"), "alice doesn't own bob's account")
+	assert.Equal(t, 1, next.lookups, "other accounts are still checked")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// handleAccountOwners lists the owners of a joint account on GET and adds a
+// co-owner on POST. withJWTAuth has already checked that the caller is one
+// of the current owners.
+func (s *APIServer) handleAccountOwners(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		req := new(AddOwnerRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return err
+		}
+		owner, err := s.storage.GetAccountByNumber(int(req.Number))
+		if err != nil {
+			return accountLookupError(err)
+		}
+		if err := s.storage.AddAccountOwner(id, owner.OwnerID); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	return s.writeAccountOwners(w, id)
+}
+
+func (s *APIServer) handleRemoveAccountOwner(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodDelete {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	ownerStr := mux.Vars(r)["ownerId"]
+	ownerID, err := strconv.Atoi(ownerStr)
+	if err != nil {
+		return fmt.Errorf("invalid owner id provided: '%s'", ownerStr)
+	}
+
+	if err := s.storage.RemoveAccountOwner(id, ownerID); err != nil {
+		return err
+	}
+	return s.writeAccountOwners(w, id)
+}
+
+func (s *APIServer) writeAccountOwners(w http.ResponseWriter, id int) error {
+	owners, err := s.storage.GetAccountOwners(id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, AccountOwnersResponse{AccountID: id, Owners: owners})
+}
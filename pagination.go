@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxAccountsLimit = 200
+
+// parseAccountPage reads ?limit= with either ?offset= or ?cursor= into
+// filter. Both need a limit, and can't be combined.
+func parseAccountPage(q url.Values, filter *AccountFilter) error {
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAccountsLimit {
+			return fmt.Errorf("invalid limit: '%s', expected 1 to %d", v, maxAccountsLimit)
+		}
+		filter.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid offset: '%s'", v)
+		}
+		filter.Offset = n
+	}
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := decodeAccountCursor(v)
+		if err != nil {
+			return err
+		}
+		filter.After = &cursor
+	}
+
+	switch {
+	case filter.Limit == 0 && (filter.Offset > 0 || filter.After != nil):
+		return fmt.Errorf("offset and cursor require a limit")
+	case filter.Offset > 0 && filter.After != nil:
+		return fmt.Errorf("specify either an offset or a cursor, not both")
+	}
+	return nil
+}
+
+// encodeAccountCursor turns a cursor into the opaque token handed to
+// clients.
+func encodeAccountCursor(c AccountCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.CreatedAt.UnixMicro(), c.ID)))
+}
+
+func decodeAccountCursor(token string) (AccountCursor, error) {
+	invalid := fmt.Errorf("invalid cursor: '%s'", token)
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return AccountCursor{}, invalid
+	}
+	micros, id, ok := strings.Cut(string(b), ".")
+	if !ok {
+		return AccountCursor{}, invalid
+	}
+	us, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return AccountCursor{}, invalid
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 1 {
+		return AccountCursor{}, invalid
+	}
+	return AccountCursor{CreatedAt: time.UnixMicro(us).UTC(), ID: n}, nil
+}
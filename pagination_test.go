@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeListingStorage struct {
+	*fakeStorage
+	listed  []*Account
+	filters []AccountFilter
+}
+
+func (s *fakeListingStorage) GetAllAccounts(filter AccountFilter) ([]*Account, error) {
+	s.filters = append(s.filters, filter)
+	accounts := s.listed
+	if filter.Limit > 0 && len(accounts) > filter.Limit {
+		accounts = accounts[:filter.Limit]
+	}
+	return accounts, nil
+}
+
+func TestAccountCursor(t *testing.T) {
+	cursor := AccountCursor{CreatedAt: time.Date(2024, 3, 1, 12, 0, 0, 123456000, time.UTC), ID: 42}
+	got, err := decodeAccountCursor(encodeAccountCursor(cursor))
+	assert.Nil(t, err)
+	assert.Equal(t, cursor, got)
+
+	for _, token := range []string{"!!", "MTIz", "eC40Mg", "MTIzLjA"} {
+		_, err := decodeAccountCursor(token)
+		assert.Error(t, err, token)
+	}
+}
+
+func TestParseAccountPage(t *testing.T) {
+	cursor := encodeAccountCursor(AccountCursor{CreatedAt: time.Unix(0, 0), ID: 1})
+
+	var filter AccountFilter
+	assert.Nil(t, parseAccountPage(url.Values{"limit": {"10"}, "cursor": {cursor}}, &filter))
+	assert.Equal(t, 10, filter.Limit)
+	assert.NotNil(t, filter.After)
+
+	for _, q := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"201"}},
+		{"offset": {"10"}},
+		{"cursor": {cursor}},
+		{"limit": {"10"}, "offset": {"10"}, "cursor": {cursor}},
+	} {
+		assert.Error(t, parseAccountPage(q, &AccountFilter{}), q.Encode())
+	}
+}
+
+func TestHandleGetAllAccountsPages(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := &fakeListingStorage{
+		fakeStorage: newFakeStorage(),
+		listed:      []*Account{{ID: 1, CreatedAt: created}, {ID: 2, CreatedAt: created}, {ID: 3, CreatedAt: created}},
+	}
+	server := newTestServer(t, store)
+
+	rec := httptest.NewRecorder()
+	makeHTTPHandlerFunc(server.handleGetAllAccounts)(rec, httptest.NewRequest(http.MethodGet, "/account?limit=2", nil))
+	var page AccountPage
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	assert.Len(t, page.Accounts, 2)
+	cursor, err := decodeAccountCursor(page.NextCursor)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2, cursor.ID)
+		assert.True(t, created.Equal(cursor.CreatedAt))
+	}
+
+	rec = httptest.NewRecorder()
+	makeHTTPHandlerFunc(server.handleGetAllAccounts)(rec, httptest.NewRequest(http.MethodGet, "/account?limit=3", nil))
+	page = AccountPage{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&page))
+	assert.Len(t, page.Accounts, 3)
+	assert.Empty(t, page.NextCursor, "no cursor on the last page")
+
+	rec = httptest.NewRecorder()
+	makeHTTPHandlerFunc(server.handleGetAllAccounts)(rec, httptest.NewRequest(http.MethodGet, "/account", nil))
+	var accounts []map[string]any
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&accounts), "unpaged listings are still an array")
+	assert.Len(t, accounts, 3)
+}
+
+func TestHandleGetAllAccountsMasksNumbers(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice := &Account{ID: 1, Number: 123456, OwnerID: 1}
+	bob := &Account{ID: 2, Number: 654321, OwnerID: 2}
+	store := &fakeListingStorage{fakeStorage: newFakeStorage(alice, bob), listed: []*Account{alice, bob}}
+	server := newTestServer(t, store)
+
+	list := func(caller *Account, path string) []any {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if caller != nil {
+			token, err := createJWT(caller, "session", time.Minute)
+			assert.Nil(t, err)
+			req.Header.Set("x-jwt-token", token)
+		}
+		rec := httptest.NewRecorder()
+		makeHTTPHandlerFunc(server.handleGetAllAccounts)(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var accounts []map[string]any
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&accounts))
+		numbers := make([]any, len(accounts))
+		for i, a := range accounts {
+			numbers[i] = a["number"]
+		}
+		return numbers
+	}
+
+	assert.Equal(t, []any{"****3456", "****4321"}, list(nil, "/account?fullNumber=true"), "anonymous callers")
+	assert.Equal(t, []any{"****3456", "****4321"}, list(alice, "/account"), "masked by default")
+	assert.Equal(t, []any{float64(123456), "****4321"}, list(alice, "/account?fullNumber=true"), "only the caller's own")
+	server.admins = map[int64]bool{bob.Number: true}
+	assert.Equal(t, []any{float64(123456), float64(654321)}, list(bob, "/account?fullNumber=true"), "admins")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const passwordResetTokenTTL = time.Hour
+
+type PasswordResetRequest struct {
+	Number int64  `json:"number,omitempty"`
+	Email  string `json:"email,omitempty"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// handlePasswordResetRequest emails a reset link to the account with the
+// given number, or to every account registered with the given email. It
+// answers the same way whether or not any account matched, so it can't be
+// used to find out which accounts exist.
+func (s *APIServer) handlePasswordResetRequest(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	req := new(PasswordResetRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+
+	var accounts []*Account
+	switch {
+	case req.Number != 0 && req.Email != "":
+		return fmt.Errorf("specify either an account number or an email, not both")
+	case req.Number != 0:
+		if account, err := s.storage.GetAccountByNumber(int(req.Number)); err == nil {
+			accounts = append(accounts, account)
+		}
+	case req.Email != "":
+		var err error
+		if accounts, err = s.storage.GetAccountsByEmail(req.Email); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("an account number or an email is required")
+	}
+
+	for _, account := range accounts {
+		s.sendPasswordReset(account)
+	}
+	return WriteJSON(w, http.StatusOK, map[string]string{"message": "if the account exists, a reset link has been emailed"})
+}
+
+func (s *APIServer) sendPasswordReset(account *Account) {
+	if account.Email == "" {
+		return
+	}
+	token, hash, err := generateToken()
+	if err != nil {
+		log.Printf("error generating password reset token for account %s: %v", maskNumber(int64(account.ID)), err)
+		return
+	}
+	if err := s.storage.CreatePasswordResetToken(account.ID, hash, time.Now().UTC().Add(passwordResetTokenTTL)); err != nil {
+		log.Printf("error storing password reset token for account %s: %v", maskNumber(int64(account.ID)), err)
+		return
+	}
+
+	body := fmt.Sprintf("A password reset was requested for account %d. Use this token within the hour to choose a new password: %s\n\nIf you didn't ask for it, ignore this email.", account.Number, token)
+	if err := s.notifier.Send(account.Email, "Reset your gobank password", body); err != nil {
+		log.Printf("error sending password reset email for account %s: %v", maskNumber(int64(account.ID)), err)
+	}
+}
+
+func (s *APIServer) handlePasswordResetConfirm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	req := new(PasswordResetConfirmRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if req.Token == "" {
+		return fmt.Errorf("missing token")
+	}
+	if err := validatePassword(req.Password); err != nil {
+		return err
+	}
+
+	encrypted, err := hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	id, err := s.storage.ResetPassword(hashToken(req.Token), encrypted)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]int{"password reset successfully for account with id": id})
+}
+
+// handleChangePassword replaces the password of the caller's account, given
+// the current one. Every other session of the account is revoked, so that
+// whoever may have learnt the old password is logged out; the one making
+// the change stays logged in. Wrong current passwords count towards the
+// login lockout, as they would on /login.
+func (s *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	req := new(ChangePasswordRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return withStatus(http.StatusUnauthorized, err)
+	}
+	account, err := s.storage.GetAccountByNumber(int(number))
+	if err != nil {
+		return accountLookupError(err)
+	}
+
+	now := time.Now().UTC()
+	if account.Locked(now) {
+		return accountLocked(w, account.LockedUntil.Sub(now))
+	}
+	if !account.ValidatePassword(req.CurrentPassword) {
+		locked, err := s.storage.RecordFailedLogin(account.ID, s.loginMaxFailures, now.Add(s.loginLockout))
+		if err != nil {
+			return err
+		}
+		if locked {
+			return accountLocked(w, s.loginLockout)
+		}
+		return withStatus(http.StatusForbidden, fmt.Errorf("current password is incorrect"))
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		return err
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return fmt.Errorf("new password must differ from the current one")
+	}
+
+	encrypted, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.ChangePassword(account.ID, encrypted, sessionIDFromToken(r)); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]string{"message": "password changed, other sessions have been logged out"})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakePasswordStorage struct {
+	*fakeLoginStorage
+	kept string
+}
+
+func (s *fakePasswordStorage) ChangePassword(accountID int, encryptedPassword, keepSession string) error {
+	s.accounts[accountID].EncryptedPassword = encryptedPassword
+	s.kept = keepSession
+	return nil
+}
+
+func TestHandleChangePassword(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	acc, err := NewAccountWithOptions("a", "b", "password", WithNumber(1001))
+	assert.Nil(t, err)
+	acc.ID = 1
+	store := &fakePasswordStorage{fakeLoginStorage: &fakeLoginStorage{
+		fakeSessionStorage: &fakeSessionStorage{fakeStorage: newFakeStorage(acc)},
+	}}
+	server := newTestServer(t, store)
+	server.loginMaxFailures, server.loginLockout = 2, time.Minute
+	handler := withTokenAuth(makeHTTPHandlerFunc(server.handleChangePassword))
+	token, err := createJWT(acc, "current", time.Minute)
+	assert.Nil(t, err)
+
+	change := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/account/me/password", strings.NewReader(body))
+		req.Header.Set("x-jwt-token", token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	rec := change(`{"currentPassword": "password", "newPassword": "short"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "the policy applies")
+	rec = change(`{"currentPassword": "password", "newPassword": "password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = change(`{"currentPassword": "password", "newPassword": "new password"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, acc.ValidatePassword("new password"))
+	assert.Equal(t, "current", store.kept, "the session making the change stays")
+
+	rec = change(`{"currentPassword": "password", "newPassword": "another one"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = change(`{"currentPassword": "password", "newPassword": "another one"}`)
+	assert.Equal(t, http.StatusLocked, rec.Code, "wrong passwords count towards the lockout")
+	rec = change(`{"currentPassword": "new password", "newPassword": "another one"}`)
+	assert.Equal(t, http.StatusLocked, rec.Code)
+}
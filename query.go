@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// orderTerm is what may go into an ORDER BY: a column, optionally followed
+// by a direction. Anything else is a programming error, since sort orders
+// chosen by clients must be mapped to columns through an allowlist first.
+var orderTerm = regexp.MustCompile(`^[a-z_]+( (asc|desc))?$`)
+
+// groupColumn is what may go into a GROUP BY.
+var groupColumn = regexp.MustCompile(`^[a-z_]+$`)
+
+// selectQuery assembles a select statement. Values only ever enter the SQL
+// as placeholders, through arg.
+type selectQuery struct {
+	base   string
+	conds  []string
+	args   []any
+	group  []string
+	order  []string
+	limit  int
+	offset int
+}
+
+// newSelect starts a query from its select ... from ... part.
+func newSelect(base string) *selectQuery {
+	return &selectQuery{base: base}
+}
+
+// arg adds a value to the query and returns the placeholder to refer to it
+// by.
+func (q *selectQuery) arg(v any) string {
+	q.args = append(q.args, v)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// where adds a condition, to be combined with the others by and.
+func (q *selectQuery) where(cond string) *selectQuery {
+	q.conds = append(q.conds, cond)
+	return q
+}
+
+func (q *selectQuery) groupBy(columns ...string) *selectQuery {
+	for _, c := range columns {
+		if !groupColumn.MatchString(c) {
+			panic(fmt.Sprintf("invalid group by column: %q", c))
+		}
+	}
+	q.group = append(q.group, columns...)
+	return q
+}
+
+func (q *selectQuery) orderBy(terms ...string) *selectQuery {
+	for _, t := range terms {
+		if !orderTerm.MatchString(t) {
+			panic(fmt.Sprintf("invalid order by term: %q", t))
+		}
+	}
+	q.order = append(q.order, terms...)
+	return q
+}
+
+// page limits the query to limit rows after skipping offset. A zero limit
+// returns every row.
+func (q *selectQuery) page(limit, offset int) *selectQuery {
+	q.limit, q.offset = limit, offset
+	return q
+}
+
+// build returns the statement and its arguments. It can be called more
+// than once.
+func (q *selectQuery) build() (string, []any) {
+	args := append([]any(nil), q.args...)
+	placeholder := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(q.base)
+	if len(q.conds) > 0 {
+		sb.WriteString(" where ")
+		sb.WriteString(strings.Join(q.conds, " and "))
+	}
+	if len(q.group) > 0 {
+		sb.WriteString(" group by ")
+		sb.WriteString(strings.Join(q.group, ", "))
+	}
+	if len(q.order) > 0 {
+		sb.WriteString(" order by ")
+		sb.WriteString(strings.Join(q.order, ", "))
+	}
+	if q.limit > 0 {
+		sb.WriteString(" limit " + placeholder(q.limit))
+	}
+	if q.offset > 0 {
+		sb.WriteString(" offset " + placeholder(q.offset))
+	}
+	return sb.String(), args
+}
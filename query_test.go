@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectQuery(t *testing.T) {
+	q := newSelect("select id from account")
+	query, args := q.build()
+	assert.Equal(t, "select id from account", query)
+	assert.Empty(t, args)
+
+	q.where("first_name = " + q.arg("ada")).where("balance > " + q.arg(10))
+	query, args = q.orderBy("created_at desc", "id").page(20, 40).build()
+	assert.Equal(t, "select id from account where first_name = $1 and balance > $2 order by created_at desc, id limit $3 offset $4", query)
+	assert.Equal(t, []any{"ada", 10, 20, 40}, args)
+
+	again, againArgs := q.build()
+	assert.Equal(t, query, again, "build can be called more than once")
+	assert.Equal(t, args, againArgs)
+
+	query, _ = newSelect("select kind, count(*) from ledger").groupBy("kind").orderBy("kind").build()
+	assert.Equal(t, "select kind, count(*) from ledger group by kind order by kind", query)
+
+	assert.Panics(t, func() { newSelect("select 1").orderBy("id; drop table account") })
+	assert.Panics(t, func() { newSelect("select 1").groupBy("kind desc") })
+}
+
+func TestAccountQuery(t *testing.T) {
+	query, args := accountQuery(AccountFilter{MetadataKey: "tier", MetadataValue: "gold", Name: "Ada"}).build()
+	assert.Equal(t, "select "+accountColumns+" from account where metadata ? $1 and metadata ->> $1 = $2 and "+
+		"(lower(first_name) = lower($3) or lower(last_name) = lower($3) or lower(first_name || ' ' || last_name) = lower($3)) order by id", query)
+	assert.Equal(t, []any{"tier", "gold", "Ada"}, args)
+
+	minBalance := Money(1)
+	query, args = accountQuery(AccountFilter{Name: "Ada", MinBalance: &minBalance}).build()
+	assert.Contains(t, query, "and balance >= $2 order by id")
+	assert.Equal(t, []any{"Ada", minBalance}, args)
+
+	from, to := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	query, args = accountQuery(AccountFilter{CreatedFrom: from, CreatedTo: to}).build()
+	assert.Contains(t, query, "where created_at between $1 and $2 order by id")
+	assert.Equal(t, []any{from, to}, args)
+	query, _ = accountQuery(AccountFilter{CreatedTo: to}).build()
+	assert.Contains(t, query, "where created_at <= $1 ")
+
+	after := &AccountCursor{CreatedAt: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), ID: 7}
+	query, args = accountQuery(AccountFilter{Limit: 10, After: after}).build()
+	assert.Equal(t, "select "+accountColumns+" from account where (created_at, id) > ($1, $2) order by created_at, id limit $3", query)
+	assert.Equal(t, []any{after.CreatedAt, 7, 10}, args)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter allows up to limit hits per key within each fixed window.
+type RateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	hits  int
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+// Allow records a hit for key and reports whether it is within the limit,
+// along with how long to wait before the next hit is allowed if it isn't.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	// Forget expired windows now and then so the map doesn't grow with
+	// every client ever seen.
+	if len(l.windows) > 10000 {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.hits >= l.limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+	w.hits++
+	return true, 0
+}
+
+// withRateLimit rejects requests from clients that exceeded the limiter's
+// allowance with 429 Too Many Requests.
+func (s *APIServer) withRateLimit(l *RateLimiter, f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ok, retryAfter := l.Allow(clientIP(r, s.trustedProxies))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			return withStatus(http.StatusTooManyRequests, fmt.Errorf("too many requests, try again later"))
+		}
+		return f(w, r)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(2, time.Hour)
+
+	ok, _ := l.Allow("1.2.3.4")
+	assert.True(t, ok)
+	ok, _ = l.Allow("1.2.3.4")
+	assert.True(t, ok)
+	ok, retryAfter := l.Allow("1.2.3.4")
+	assert.False(t, ok)
+	assert.Greater(t, retryAfter, time.Duration(0))
+
+	ok, _ = l.Allow("5.6.7.8")
+	assert.True(t, ok, "limits are tracked per key")
+}
+
+func TestRateLimiterWindowExpires(t *testing.T) {
+	l := NewRateLimiter(1, 10*time.Millisecond)
+
+	ok, _ := l.Allow("1.2.3.4")
+	assert.True(t, ok)
+	ok, _ = l.Allow("1.2.3.4")
+	assert.False(t, ok)
+
+	time.Sleep(15 * time.Millisecond)
+	ok, _ = l.Allow("1.2.3.4")
+	assert.True(t, ok)
+}
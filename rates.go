@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownCurrency = errors.New("unknown currency")
+	ErrRateUnavailable = errors.New("exchange rate unavailable")
+)
+
+// RateProvider supplies the exchange rates used to show balances in other
+// currencies. Balances are only ever held in the configured currency, so
+// converted amounts are for display.
+type RateProvider interface {
+	// Rate returns what one unit of from is worth in to. It returns
+	// ErrUnknownCurrency for a currency it has never heard of, and any other
+	// error when it can't tell right now.
+	Rate(from, to string) (ExchangeRate, error)
+}
+
+type ExchangeRate struct {
+	Rate float64
+	// At is when the rate was quoted.
+	At time.Time
+}
+
+// staticRates are the fixed rates from the configured currency given by
+// EXCHANGE_RATES, quoted as of the server's start.
+type staticRates struct {
+	base  string
+	rates map[string]float64
+	at    time.Time
+}
+
+func (p staticRates) Rate(from, to string) (ExchangeRate, error) {
+	if from == to {
+		return ExchangeRate{Rate: 1, At: p.at}, nil
+	}
+	if rate, ok := p.rates[to]; ok && from == p.base {
+		return ExchangeRate{Rate: rate, At: p.at}, nil
+	}
+	return ExchangeRate{}, fmt.Errorf("%w: from %s to %s", ErrRateUnavailable, from, to)
+}
+
+// parseExchangeRates parses CODE=rate pairs, each rate being what one unit
+// of the configured currency is worth in CODE.
+func parseExchangeRates(pairs []string) (map[string]float64, error) {
+	rates := make(map[string]float64, len(pairs))
+	for _, pair := range pairs {
+		code, value, ok := strings.Cut(pair, "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !ok {
+			return nil, fmt.Errorf("invalid exchange rate: '%s', expected CODE=rate", pair)
+		}
+		if _, err := currencyExponent(code); err != nil {
+			return nil, err
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("invalid exchange rate: '%s', the rate must be a positive number", pair)
+		}
+		rates[code] = rate
+	}
+	return rates, nil
+}
+
+// convertBalance converts a balance to the display currency at the
+// provider's current rate.
+func (s *APIServer) convertBalance(balance Money, currency string) (*DisplayBalance, error) {
+	exp, err := currencyExponent(currency)
+	if err != nil {
+		return nil, err
+	}
+	rate, err := s.rates.Rate(moneyCurrency, currency)
+	if errors.Is(err, ErrUnknownCurrency) {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("error getting the exchange rate from %s to %s: %v", moneyCurrency, currency, err)
+		return nil, withStatus(http.StatusServiceUnavailable, fmt.Errorf("no exchange rate from %s to %s is available right now", moneyCurrency, currency))
+	}
+
+	amount := math.Round(float64(balance) * rate.Rate * math.Pow10(exp-moneyExponent))
+	if math.Abs(amount) >= 1<<63 {
+		return nil, fmt.Errorf("balance is too large to convert to %s", currency)
+	}
+	return &DisplayBalance{
+		Currency: currency,
+		Amount:   json.Number(formatMinor(int64(amount), exp)),
+		Rate:     rate.Rate,
+		RateAt:   rate.At,
+	}, nil
+}
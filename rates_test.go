@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRates struct {
+	err error
+}
+
+func (p fakeRates) Rate(from, to string) (ExchangeRate, error) {
+	if p.err != nil {
+		return ExchangeRate{}, p.err
+	}
+	return staticRates{base: "USD", rates: map[string]float64{"EUR": 0.92, "JPY": 151.3}}.Rate(from, to)
+}
+
+func TestHandleAccountBalanceDisplay(t *testing.T) {
+	store := &fakeBalanceStorage{fakeStorage: newFakeStorage()}
+	server := newTestServer(t, store)
+
+	tests := []struct {
+		name   string
+		query  string
+		rates  RateProvider
+		status int
+		amount string
+	}{
+		{"converted", "?display=EUR", fakeRates{}, http.StatusOK, "11.50"},
+		{"lower case", "?display=eur", fakeRates{}, http.StatusOK, "11.50"},
+		{"no decimals", "?display=JPY", fakeRates{}, http.StatusOK, "1891"},
+		{"same currency", "?display=USD", fakeRates{}, http.StatusOK, "12.50"},
+		{"invalid code", "?display=EURO", fakeRates{}, http.StatusBadRequest, ""},
+		{"unknown currency", "?display=XYZ", fakeRates{err: fmt.Errorf("%w: XYZ", ErrUnknownCurrency)}, http.StatusBadRequest, ""},
+		{"no rate", "?display=GBP", fakeRates{}, http.StatusServiceUnavailable, ""},
+		{"provider down", "?display=EUR", fakeRates{err: fmt.Errorf("rates service timed out")}, http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.rates = tt.rates
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/account/1/balance"+tt.query, nil), map[string]string{"id": "1"})
+			rec := httptest.NewRecorder()
+			makeHTTPHandlerFunc(server.handleAccountBalance)(rec, req)
+			assert.Equal(t, tt.status, rec.Code, rec.Body.String())
+			if tt.amount != "" {
+				assert.Contains(t, rec.Body.String(), `"balance":12.50`)
+				assert.Contains(t, rec.Body.String(), `"amount":`+tt.amount+`,`)
+			}
+		})
+	}
+}
+
+func TestParseExchangeRates(t *testing.T) {
+	rates, err := parseExchangeRates([]string{"eur=0.92", " GBP = 0.79"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{"EUR": 0.92, "GBP": 0.79}, rates)
+
+	for _, pair := range []string{"EUR", "EURO=1", "EUR=0", "EUR=-1", "EUR=abc"} {
+		_, err := parseExchangeRates([]string{pair})
+		assert.NotNil(t, err, pair)
+	}
+}
+
+func TestStaticRates(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := staticRates{base: "USD", rates: map[string]float64{"EUR": 0.92}, at: at}
+
+	rate, err := p.Rate("USD", "EUR")
+	assert.Nil(t, err)
+	assert.Equal(t, ExchangeRate{Rate: 0.92, At: at}, rate)
+	_, err = p.Rate("EUR", "USD")
+	assert.ErrorIs(t, err, ErrRateUnavailable, "only rates from the base currency are known")
+}
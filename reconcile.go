@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// checkBalances is the reconciliation run at startup: every discrepancy is
+// logged, and an error returned when there are more than max of them.
+func checkBalances(storage Storage, max int) error {
+	start := time.Now()
+	discrepancies, err := storage.GetBalanceDiscrepancies()
+	if err != nil {
+		return fmt.Errorf("reconciling balances: %w", err)
+	}
+	for _, d := range discrepancies {
+		log.Printf("account %d: balance %s, ledger %s", d.AccountID, d.Balance, d.LedgerBalance)
+	}
+	if len(discrepancies) > max {
+		return fmt.Errorf("%d accounts disagree with their ledger, at most %d allowed", len(discrepancies), max)
+	}
+	log.Printf("reconciled balances in %s, %d discrepancies", time.Since(start).Round(time.Millisecond), len(discrepancies))
+	return nil
+}
+
+// handleReconcile lists the accounts whose balance disagrees with their
+// ledger. The list is empty as long as every balance change went through
+// the ledger, so anything in it points at a bug in a money path or at a
+// change made to the database by hand.
+func (s *APIServer) handleReconcile(w http.ResponseWriter, r *http.Request) error {
+	loc, err := s.requestLocation(r)
+	if err != nil {
+		return err
+	}
+	discrepancies, err := s.storage.GetBalanceDiscrepancies()
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, ReconcileResponse{Discrepancies: discrepancies, CheckedAt: time.Now().In(loc)})
+}
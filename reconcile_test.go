@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeReconcileStorage struct {
+	*fakeStorage
+	ledger map[int]Money
+}
+
+func (s *fakeReconcileStorage) GetBalanceDiscrepancies() ([]*BalanceDiscrepancy, error) {
+	discrepancies := make([]*BalanceDiscrepancy, 0)
+	for id, a := range s.accounts {
+		if a.Balance != s.ledger[id] {
+			discrepancies = append(discrepancies, &BalanceDiscrepancy{AccountID: id, Number: a.Number, Balance: a.Balance, LedgerBalance: s.ledger[id], Difference: a.Balance - s.ledger[id]})
+		}
+	}
+	return discrepancies, nil
+}
+
+func TestHandleReconcile(t *testing.T) {
+	storage := &fakeReconcileStorage{
+		fakeStorage: newFakeStorage(&Account{ID: 1, Number: 1001, Balance: 500}, &Account{ID: 2, Number: 1002, Balance: 700}),
+		ledger:      map[int]Money{1: 500, 2: 650},
+	}
+	server := newTestServer(t, storage)
+
+	rec := httptest.NewRecorder()
+	makeHTTPHandlerFunc(server.handleReconcile)(rec, httptest.NewRequest(http.MethodGet, "/reconcile", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var res ReconcileResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	if assert.Len(t, res.Discrepancies, 1) {
+		assert.Equal(t, 2, res.Discrepancies[0].AccountID)
+		assert.Equal(t, Money(50), res.Discrepancies[0].Difference)
+	}
+}
+
+func TestCheckBalances(t *testing.T) {
+	storage := &fakeReconcileStorage{
+		fakeStorage: newFakeStorage(&Account{ID: 1, Balance: 500}, &Account{ID: 2, Balance: 700}),
+		ledger:      map[int]Money{1: 500, 2: 650},
+	}
+	assert.NotNil(t, checkBalances(storage, 0))
+	assert.Nil(t, checkBalances(storage, 1), "a discrepancy within the threshold is only logged")
+
+	storage.ledger[2] = 700
+	assert.Nil(t, checkBalances(storage, 0))
+}
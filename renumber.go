@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// handleChangeNumber reissues an account's number. The old number is kept
+// in the account's history and never handed out again, so that
+// handleAccountByNumber can still resolve it.
+func (s *APIServer) handleChangeNumber(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPut {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+
+	req := new(ChangeNumberRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if req.Number <= 0 || !s.numbers.Valid(req.Number) {
+		return fmt.Errorf("invalid account number")
+	}
+
+	change, err := s.storage.ChangeAccountNumber(id, req.Number)
+	if errors.Is(err, ErrNumberTaken) {
+		return withStatus(http.StatusConflict, err)
+	}
+	if err != nil {
+		return accountLookupError(err)
+	}
+	return WriteJSON(w, http.StatusOK, change)
+}
+
+// handleAccountByNumber finds the account a number belongs to, or belonged
+// to before it was changed.
+func (s *APIServer) handleAccountByNumber(w http.ResponseWriter, r *http.Request) error {
+	number, err := strconv.ParseInt(mux.Vars(r)["number"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid account number")
+	}
+	account, former, err := s.storage.GetAccountByAnyNumber(number)
+	if err != nil {
+		return accountLookupError(err)
+	}
+	return WriteJSON(w, http.StatusOK, NumberLookup{Account: account, Former: former})
+}
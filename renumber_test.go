@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRenumberStorage struct {
+	*fakeStorage
+	former map[int64]int
+}
+
+func (s *fakeRenumberStorage) ChangeAccountNumber(id int, number int64) (*NumberChange, error) {
+	account, err := s.GetAccountByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.former[number]; ok {
+		return nil, fmt.Errorf("%w: '%d'", ErrNumberTaken, number)
+	}
+	if _, err := s.GetAccountByNumber(int(number)); err == nil {
+		return nil, fmt.Errorf("%w: '%d'", ErrNumberTaken, number)
+	}
+	change := &NumberChange{AccountID: id, OldNumber: account.Number, NewNumber: number, ChangedAt: time.Now().UTC()}
+	s.former[account.Number] = id
+	account.Number = number
+	return change, nil
+}
+
+func (s *fakeRenumberStorage) GetAccountByAnyNumber(number int64) (*Account, bool, error) {
+	if id, ok := s.former[number]; ok {
+		account, err := s.GetAccountByID(id)
+		return account, true, err
+	}
+	account, err := s.GetAccountByNumber(int(number))
+	return account, false, err
+}
+
+func TestHandleChangeNumber(t *testing.T) {
+	store := &fakeRenumberStorage{
+		fakeStorage: newFakeStorage(&Account{ID: 1, Number: 1001}, &Account{ID: 2, Number: 2002}),
+		former:      map[int64]int{},
+	}
+	server := newTestServer(t, store)
+	change := makeHTTPHandlerFunc(server.handleChangeNumber)
+	lookup := makeHTTPHandlerFunc(server.handleAccountByNumber)
+
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"changed", "1", `{"number": 3003}`, http.StatusOK},
+		{"collides", "2", `{"number": 3003}`, http.StatusConflict},
+		{"former number", "2", `{"number": 1001}`, http.StatusConflict},
+		{"invalid", "2", `{"number": 0}`, http.StatusBadRequest},
+		{"no account", "9", `{"number": 4004}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodPut, "/account/"+tt.id+"/number", strings.NewReader(tt.body)), map[string]string{"id": tt.id})
+			rec := httptest.NewRecorder()
+			change(rec, req)
+			assert.Equal(t, tt.status, rec.Code, rec.Body.String())
+		})
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/accounts/by-number/1001", nil), map[string]string{"number": "1001"})
+	rec := httptest.NewRecorder()
+	lookup(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"former":true`)
+	assert.Contains(t, rec.Body.String(), `"number":3003`)
+}
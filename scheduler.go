@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	schedulerInterval = 30 * time.Second
+	// maxScheduleAhead bounds how far into the future transfers may be
+	// scheduled.
+	maxScheduleAhead = 366 * 24 * time.Hour
+)
+
+func (s *APIServer) handleScheduleTransfer(w http.ResponseWriter, r *http.Request) error {
+	req := new(ScheduleTransferRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if !req.ExecuteAt.After(now) {
+		return fmt.Errorf("executeAt must be in the future")
+	}
+	if req.ExecuteAt.After(now.Add(maxScheduleAhead)) {
+		return fmt.Errorf("transfers can be scheduled at most a year ahead")
+	}
+
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return fmt.Errorf("permission denied")
+	}
+	// Resolving the transfer now catches unknown accounts and missing
+	// permissions up front rather than when it is due. They are checked
+	// again then, see checkScheduledTransfer.
+	transfer, err := s.prepareTransfer(number, &req.TransferRequest)
+	if err != nil {
+		return err
+	}
+	caller, err := s.storage.GetAccountByNumber(int(number))
+	if err != nil {
+		return accountLookupError(err)
+	}
+
+	st := &ScheduledTransfer{
+		FromAccount: transfer.FromAccount,
+		ToAccount:   transfer.ToAccount,
+		Amount:      transfer.Amount,
+		Fee:         transfer.Fee,
+		Description: transfer.Description,
+		Category:    transfer.Category,
+		ExecuteAt:   req.ExecuteAt.UTC(),
+		Status:      ScheduledTransferPending,
+		CreatedAt:   now,
+		ScheduledBy: caller.ID,
+	}
+	if err := s.storage.CreateScheduledTransfer(st); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, st)
+}
+
+// handleListScheduledTransfers lists the pending transfers scheduled out of
+// the caller's account.
+func (s *APIServer) handleListScheduledTransfers(w http.ResponseWriter, r *http.Request) error {
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return fmt.Errorf("permission denied")
+	}
+	account, err := s.storage.GetAccountByNumber(int(number))
+	if err != nil {
+		return accountLookupError(err)
+	}
+
+	transfers, err := s.storage.GetPendingScheduledTransfers(account.ID)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, transfers)
+}
+
+func (s *APIServer) handleCancelScheduledTransfer(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return fmt.Errorf("permission denied")
+	}
+
+	st, err := s.storage.GetScheduledTransfer(id)
+	if errors.Is(err, ErrScheduledTransferNotFound) {
+		return withStatus(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	from, err := s.storage.GetAccountByID(st.FromAccount)
+	if err != nil {
+		return err
+	}
+	if ok, err := canOperate(s.storage, number, from); err != nil || !ok {
+		return fmt.Errorf("permission denied")
+	}
+
+	err = s.storage.CancelScheduledTransfer(id)
+	if errors.Is(err, ErrScheduledTransferNotFound) {
+		return withStatus(http.StatusConflict, err)
+	}
+	if err != nil {
+		return err
+	}
+	st.Status = ScheduledTransferCancelled
+	return WriteJSON(w, http.StatusOK, st)
+}
+
+// runScheduler makes the scheduled transfers as they fall due, until ctx is
+// done.
+func (s *APIServer) runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		s.executeDueTransfers(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *APIServer) executeDueTransfers(ctx context.Context) {
+	for ctx.Err() == nil {
+		st, transfer, err := s.storage.ExecuteDueScheduledTransfer(time.Now().UTC(), s.checkScheduledTransfer)
+		if err != nil {
+			log.Printf("error executing scheduled transfers: %v", err)
+			return
+		}
+		if st == nil {
+			return
+		}
+		if transfer == nil {
+			log.Printf("scheduled transfer %d failed: %s", st.ID, st.FailureReason)
+			continue
+		}
+		s.publishTransfer(transfer)
+	}
+}
+
+// checkScheduledTransfer repeats the checks made when the transfer was
+// scheduled: its holder may have lost access to the source account, or
+// MAX_TRANSFER_AMOUNT been lowered, since.
+func (s *APIServer) checkScheduledTransfer(st *ScheduledTransfer) (string, error) {
+	from, err := s.storage.GetAccountByID(st.FromAccount)
+	if err != nil {
+		return "", err
+	}
+	caller, err := s.storage.GetAccountByID(st.ScheduledBy)
+	if errors.Is(err, ErrAccountNotFound) {
+		return "the account that scheduled the transfer was deleted", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !caller.Verified {
+		return "account not verified", nil
+	}
+	ok, err := canOperate(s.storage, caller.Number, from)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "permission denied", nil
+	}
+	if err := s.checkTransferAmount(from, st.Amount, st.Fee); err != nil {
+		return err.Error(), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSchedulerStorage struct {
+	*fakeStorage
+	due []*ScheduledTransfer
+}
+
+func (s *fakeSchedulerStorage) ExecuteDueScheduledTransfer(_ time.Time, check ScheduledTransferCheck) (*ScheduledTransfer, *Transfer, error) {
+	if len(s.due) == 0 {
+		return nil, nil, nil
+	}
+	st := s.due[0]
+	s.due = s.due[1:]
+	if reason, err := check(st); err != nil || reason != "" {
+		st.Status, st.FailureReason = ScheduledTransferFailed, reason
+		return st, nil, err
+	}
+	if st.Amount > 100 {
+		st.Status, st.FailureReason = ScheduledTransferFailed, "insufficient funds"
+		return st, nil, nil
+	}
+	st.Status = ScheduledTransferDone
+	return st, &Transfer{ID: st.ID, FromAccount: st.FromAccount, ToAccount: st.ToAccount, Amount: st.Amount, FromBalance: 100 - st.Amount}, nil
+}
+
+func TestExecuteDueTransfers(t *testing.T) {
+	store := &fakeSchedulerStorage{
+		fakeStorage: newFakeStorage(&Account{ID: 1, Number: 1001, OwnerID: 1, Verified: true}),
+		due: []*ScheduledTransfer{
+			{ID: 1, FromAccount: 1, ToAccount: 2, Amount: 500, ScheduledBy: 1},
+			{ID: 2, FromAccount: 1, ToAccount: 2, Amount: 40, ScheduledBy: 1},
+		},
+	}
+	server := newTestServer(t, store)
+	updates, unsubscribe := server.balances.Subscribe(1)
+	defer unsubscribe()
+
+	server.executeDueTransfers(context.Background())
+
+	assert.Empty(t, store.due, "a failed transfer doesn't stop the ones after it")
+	select {
+	case u := <-updates:
+		assert.Equal(t, Money(60), u.Balance)
+	default:
+		t.Fatal("the executed transfer wasn't published")
+	}
+}
+
+func TestCheckScheduledTransfer(t *testing.T) {
+	from := &Account{ID: 1, Number: 1001, OwnerID: 1, Balance: 1000, Verified: true}
+	coOwner := &Account{ID: 2, Number: 1002, OwnerID: 2, Verified: true}
+	removed := &Account{ID: 3, Number: 1003, OwnerID: 3, Verified: true}
+	unverified := &Account{ID: 4, Number: 1004, OwnerID: 4}
+	store := newFakeStorage(from, coOwner, removed, unverified)
+	store.owners[from.ID] = append(store.owners[from.ID], coOwner.OwnerID)
+	server := newTestServer(t, store)
+	server.maxTransferAmount = 100
+
+	tests := []struct {
+		name   string
+		st     *ScheduledTransfer
+		reason string
+	}{
+		{"holder", &ScheduledTransfer{FromAccount: 1, Amount: 50, ScheduledBy: 1}, ""},
+		{"co-owner", &ScheduledTransfer{FromAccount: 1, Amount: 50, ScheduledBy: 2}, ""},
+		{"owner removed since", &ScheduledTransfer{FromAccount: 1, Amount: 50, ScheduledBy: 3}, "permission denied"},
+		{"unverified", &ScheduledTransfer{FromAccount: 1, Amount: 50, ScheduledBy: 4}, "account not verified"},
+		{"scheduler deleted", &ScheduledTransfer{FromAccount: 1, Amount: 50, ScheduledBy: 9}, "the account that scheduled the transfer was deleted"},
+		{"limit lowered since", &ScheduledTransfer{FromAccount: 1, Amount: 150, ScheduledBy: 1}, "amount exceeds the maximum of 1.00 per transfer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, err := server.checkScheduledTransfer(tt.st)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+
+	_, err := server.checkScheduledTransfer(&ScheduledTransfer{FromAccount: 9, ScheduledBy: 1})
+	assert.ErrorIs(t, err, ErrAccountNotFound, "left pending")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Request schemas looked up in Config.SchemaDir.
+const (
+	SchemaCreateAccount = "create_account"
+	SchemaTransfer      = "transfer"
+)
+
+// loadSchemas compiles <dir>/<name>.json for each name. An empty dir
+// disables schema validation altogether.
+func loadSchemas(dir string, names ...string) (map[string]*jsonschema.Schema, error) {
+	schemas := make(map[string]*jsonschema.Schema)
+	if dir == "" {
+		return schemas, nil
+	}
+
+	for _, name := range names {
+		path := filepath.Join(dir, name+".json")
+		schema, err := jsonschema.Compile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling schema %s: %w", path, err)
+		}
+		schemas[name] = schema
+	}
+	return schemas, nil
+}
+
+// withSchema validates the JSON body of POST requests against the named
+// schema before handing them to f. When no such schema was loaded the request
+// is passed through untouched.
+func (s *APIServer) withSchema(name string, f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		schema, ok := s.schemas[name]
+		if !ok || r.Method != http.MethodPost {
+			return f(w, r)
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+
+		if err := schema.Validate(v); err != nil {
+			var verr *jsonschema.ValidationError
+			if !errors.As(err, &verr) {
+				return err
+			}
+			return &ValidationError{Fields: schemaFieldErrors(verr)}
+		}
+		return f(w, r)
+	}
+}
+
+// schemaFieldErrors flattens the tree of schema errors into its leaves,
+// which are the ones that describe what is actually wrong with the input.
+func schemaFieldErrors(err *jsonschema.ValidationError) []FieldError {
+	if len(err.Causes) == 0 {
+		field := strings.TrimPrefix(err.InstanceLocation, "/")
+		if field == "" {
+			field = "(body)"
+		}
+		return []FieldError{{Field: field, Message: err.Message}}
+	}
+
+	var fields []FieldError
+	for _, cause := range err.Causes {
+		fields = append(fields, schemaFieldErrors(cause)...)
+	}
+	return fields
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithSchema(t *testing.T) {
+	schemas, err := loadSchemas("schemas", SchemaCreateAccount)
+	assert.Nil(t, err)
+	s := &APIServer{schemas: schemas}
+
+	called := false
+	handler := s.withSchema(SchemaCreateAccount, func(w http.ResponseWriter, r *http.Request) error {
+		called = true
+		return nil
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(`{"firstName": "", "password": "short"}`))
+	err = handler(httptest.NewRecorder(), r)
+	assert.False(t, called)
+
+	verr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	fields := make(map[string]bool)
+	for _, f := range verr.Fields {
+		fields[f.Field] = true
+	}
+	assert.True(t, fields["firstName"])
+	assert.True(t, fields["password"])
+	assert.True(t, fields["(body)"], "missing lastName is reported against the body")
+
+	r = httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(`{"firstName": "a", "lastName": "b", "password": "longEnough", "email": "a@example.com"}`))
+	assert.Nil(t, handler(httptest.NewRecorder(), r))
+	assert.True(t, called)
+}
+
+func TestTransferSchema(t *testing.T) {
+	schemas, err := loadSchemas("schemas", SchemaTransfer)
+	assert.Nil(t, err)
+	s := &APIServer{schemas: schemas}
+	handler := s.withSchema(SchemaTransfer, func(w http.ResponseWriter, r *http.Request) error { return nil })
+
+	for body, valid := range map[string]bool{
+		`{"fromAccount": 1, "toAccount": 2, "amount": 10, "category": "food"}`:             true,
+		`{"fromAccount": 1, "external": {"iban": "GB82WEST12345698765432"}, "amount": 10}`: true,
+		`{"fromAccount": 1, "external": {"bic": "WESTGB2L"}, "amount": 10}`:                false,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/transfer", strings.NewReader(body))
+		assert.Equal(t, valid, handler(httptest.NewRecorder(), r) == nil, body)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// maxUserAgentLength caps the User-Agent stored with a session.
+const maxUserAgentLength = 512
+
+// issueToken starts a session for account and returns the JWT that carries
+// it. The session id travels as the token's jti claim; the device and
+// address the request came from are recorded with the session.
+func (s *APIServer) issueToken(r *http.Request, account *Account) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	session := &Session{
+		ID:         hex.EncodeToString(b),
+		AccountID:  account.ID,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(s.jwtTTL),
+		UserAgent:  truncate(r.UserAgent(), maxUserAgentLength),
+		ClientIP:   truncate(clientIP(r, s.trustedProxies), 45),
+	}
+	if err := s.storage.CreateSession(session); err != nil {
+		return "", err
+	}
+	return createJWT(account, session.ID, s.jwtTTL)
+}
+
+// sessionIDFromToken returns the session the request's JWT belongs to, or
+// "" when it has no valid token.
+func sessionIDFromToken(r *http.Request) string {
+	token, err := validateJWT(tokenFromRequest(r))
+	if err != nil || !token.Valid {
+		return ""
+	}
+	sessionID, _ := token.Claims.(jwt.MapClaims)["jti"].(string)
+	return sessionID
+}
+
+// withSessions rejects requests carrying a JWT whose session has been
+// revoked, and records when every other session was last used. Requests
+// without a valid token are passed on for the handlers to deal with.
+func (s *APIServer) withSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := tokenFromRequest(r)
+		if tokenString == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, err := validateJWT(tokenString)
+		if err != nil || !token.Valid {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sessionID, _ := token.Claims.(jwt.MapClaims)["jti"].(string)
+		active, err := s.storage.TouchSession(sessionID, time.Now().UTC())
+		if err != nil {
+			log.Printf("error checking session: %v", err)
+			WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "error occured while checking the session"})
+			return
+		}
+		if !active {
+			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "session expired or revoked, please log in again"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAccountSessions lists the active sessions of an account.
+func (s *APIServer) handleAccountSessions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	loc, err := s.requestLocation(r)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s.storage.GetSessions(id)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		session.CreatedAt = session.CreatedAt.In(loc)
+		session.LastUsedAt = session.LastUsedAt.In(loc)
+		session.ExpiresAt = session.ExpiresAt.In(loc)
+	}
+	return WriteJSON(w, http.StatusOK, sessions)
+}
+
+// handleRevokeSession ends a session of an account; the token carrying it
+// stops working immediately.
+func (s *APIServer) handleRevokeSession(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodDelete {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	sessionID := mux.Vars(r)["sessionId"]
+
+	err = s.storage.RevokeSession(id, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return withStatus(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]string{"revoked": sessionID})
+}
+
+// truncate shortens s to at most n bytes without splitting a UTF-8
+// sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
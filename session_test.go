@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSessionStorage struct {
+	*fakeStorage
+	active  map[string]bool
+	created []*Session
+}
+
+func (s *fakeSessionStorage) CreateSession(session *Session) error {
+	s.created = append(s.created, session)
+	return nil
+}
+
+func (s *fakeSessionStorage) TouchSession(id string, _ time.Time) (bool, error) {
+	return s.active[id], nil
+}
+
+func TestWithSessions(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	acc := &Account{ID: 1, Number: 1001}
+	store := &fakeSessionStorage{fakeStorage: newFakeStorage(acc), active: map[string]bool{"live": true}}
+	server := newTestServer(t, store)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	handler := server.withSessions(next)
+
+	for _, tc := range []struct {
+		name   string
+		token  func() string
+		status int
+	}{
+		{"no token", func() string { return "" }, http.StatusNoContent},
+		{"invalid token", func() string { return "garbage" }, http.StatusNoContent},
+		{"active session", func() string { tok, _ := createJWT(acc, "live", time.Minute); return tok }, http.StatusNoContent},
+		{"revoked session", func() string { tok, _ := createJWT(acc, "revoked", time.Minute); return tok }, http.StatusUnauthorized},
+		{"token without session", func() string { tok, _ := createJWT(acc, "", time.Minute); return tok }, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/account/1", nil)
+			if tok := tc.token(); tok != "" {
+				req.Header.Set("x-jwt-token", tok)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tc.status, rec.Code)
+		})
+	}
+}
+
+func TestIssueTokenRecordsDevice(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	acc := &Account{ID: 1, Number: 1001}
+	store := &fakeSessionStorage{fakeStorage: newFakeStorage(acc)}
+	server := newTestServer(t, store)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	req.Header.Set("User-Agent", "gobank-cli/1.0 "+strings.Repeat("x", 1000))
+
+	token, err := server.issueToken(req, acc)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	if assert.Len(t, store.created, 1) {
+		session := store.created[0]
+		assert.Equal(t, "203.0.113.7", session.ClientIP)
+		assert.True(t, strings.HasPrefix(session.UserAgent, "gobank-cli/1.0"))
+		assert.Len(t, session.UserAgent, maxUserAgentLength)
+	}
+}
+
+type fakeLoginStorage struct {
+	*fakeSessionStorage
+	logins   chan int
+	failures int
+}
+
+func (s *fakeLoginStorage) RecordLogin(accountID int, _ time.Time) error {
+	s.logins <- accountID
+	return nil
+}
+
+// RecordFailedLogin keeps the count on the account itself, mirroring the
+// update PostgresStorage makes.
+func (s *fakeLoginStorage) RecordFailedLogin(accountID, maxFailures int, lockUntil time.Time) (bool, error) {
+	acc := s.accounts[accountID]
+	s.failures++
+	if s.failures >= maxFailures {
+		s.failures = 0
+		acc.LockedUntil = &lockUntil
+		return true, nil
+	}
+	return false, nil
+}
+
+func TestHandleLoginRecordsLogin(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	acc, err := NewAccountWithOptions("a", "b", "password", WithNumber(1001))
+	assert.Nil(t, err)
+	acc.ID, acc.Verified = 1, true
+	store := &fakeLoginStorage{
+		fakeSessionStorage: &fakeSessionStorage{fakeStorage: newFakeStorage(acc)},
+		logins:             make(chan int, 1),
+	}
+	server := newTestServer(t, store)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"number": 1001, "password": "password"}`))
+	rec := httptest.NewRecorder()
+	makeHTTPHandlerFunc(server.handleLogin)(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	select {
+	case id := <-store.logins:
+		assert.Equal(t, 1, id)
+	case <-time.After(time.Second):
+		t.Fatal("login was not recorded")
+	}
+}
+
+func TestHandleLoginLockout(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	acc, err := NewAccountWithOptions("a", "b", "password", WithNumber(1001))
+	assert.Nil(t, err)
+	acc.ID, acc.Verified = 1, true
+	store := &fakeLoginStorage{
+		fakeSessionStorage: &fakeSessionStorage{fakeStorage: newFakeStorage(acc)},
+		logins:             make(chan int, 1),
+	}
+	server := newTestServer(t, store)
+	server.loginMaxFailures = 3
+	server.loginLockout = time.Minute
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body := `{"number": 1001, "password": "` + password + `"}`
+		rec := httptest.NewRecorder()
+		makeHTTPHandlerFunc(server.handleLogin)(rec, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body)))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusBadRequest, login("wrong").Code)
+	assert.Equal(t, http.StatusBadRequest, login("wrong").Code)
+	rec := login("wrong")
+	assert.Equal(t, http.StatusLocked, rec.Code, "the third failure locks the account")
+	assert.Equal(t, "61", rec.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusLocked, login("password").Code, "even the right password is refused while locked")
+
+	expired := time.Now().Add(-time.Second)
+	acc.LockedUntil = &expired
+	assert.Equal(t, http.StatusOK, login("password").Code, "the lock expires")
+}
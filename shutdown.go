@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// connCounter counts the connections a server has open, through its
+// ConnState hook.
+type connCounter struct {
+	open atomic.Int64
+}
+
+func (c *connCounter) track(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		c.open.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		c.open.Add(-1)
+	}
+}
+
+// shutdown stops server gracefully, giving in-flight requests up to the
+// configured timeout to finish before the remaining connections are closed.
+func (s *APIServer) shutdown(server *http.Server, conns *connCounter) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	log.Printf("shutting down, waiting up to %s for in-flight requests", s.shutdownTimeout)
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("shutdown timed out with %d connections still open, closing them", conns.open.Load())
+		return server.Close()
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownForcesCloseAfterTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	conns := new(connCounter)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}),
+		ConnState: conns.track,
+	}
+	go server.Serve(ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+
+	s := &APIServer{shutdownTimeout: 50 * time.Millisecond}
+	begin := time.Now()
+	assert.Nil(t, s.shutdown(server, conns))
+	assert.Less(t, time.Since(begin), time.Second, "a hung handler doesn't block shutdown")
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// slowQueryStorage times every call to the Storage it wraps and logs the
+// ones that take threshold or longer, by method name only: arguments are
+// left out, as they hold account details. ExportAccounts is timed with the
+// callback, i.e. including writing the export out; idempotency keys, kept
+// by the wrapped storage, aren't timed.
+type slowQueryStorage struct {
+	next      Storage
+	threshold time.Duration
+	logf      func(format string, v ...any)
+}
+
+func newSlowQueryStorage(next Storage, threshold time.Duration) *slowQueryStorage {
+	return &slowQueryStorage{next: next, threshold: threshold, logf: log.Printf}
+}
+
+func (s *slowQueryStorage) observe(method string, start time.Time) {
+	if d := time.Since(start); d >= s.threshold {
+		s.logf("warning: slow storage call %s took %s", method, d.Round(time.Millisecond))
+	}
+}
+
+func (s *slowQueryStorage) unwrap() Storage {
+	return s.next
+}
+
+func (s *slowQueryStorage) CreateAccount(a *Account) error {
+	defer s.observe("CreateAccount", time.Now())
+	return s.next.CreateAccount(a)
+}
+
+func (s *slowQueryStorage) RecordLogin(accountID int, at time.Time) error {
+	defer s.observe("RecordLogin", time.Now())
+	return s.next.RecordLogin(accountID, at)
+}
+
+func (s *slowQueryStorage) RecordFailedLogin(accountID, maxFailures int, lockUntil time.Time) (bool, error) {
+	defer s.observe("RecordFailedLogin", time.Now())
+	return s.next.RecordFailedLogin(accountID, maxFailures, lockUntil)
+}
+
+func (s *slowQueryStorage) DeleteAccount(id int) error {
+	defer s.observe("DeleteAccount", time.Now())
+	return s.next.DeleteAccount(id)
+}
+
+func (s *slowQueryStorage) CreateDeletionToken(accountID int, hash string, expiresAt time.Time) error {
+	defer s.observe("CreateDeletionToken", time.Now())
+	return s.next.CreateDeletionToken(accountID, hash, expiresAt)
+}
+
+func (s *slowQueryStorage) ConsumeDeletionToken(accountID int, hash string) error {
+	defer s.observe("ConsumeDeletionToken", time.Now())
+	return s.next.ConsumeDeletionToken(accountID, hash)
+}
+
+func (s *slowQueryStorage) GetAccountByID(id int) (*Account, error) {
+	defer s.observe("GetAccountByID", time.Now())
+	return s.next.GetAccountByID(id)
+}
+
+func (s *slowQueryStorage) GetAccountByNumber(number int) (*Account, error) {
+	defer s.observe("GetAccountByNumber", time.Now())
+	return s.next.GetAccountByNumber(number)
+}
+
+func (s *slowQueryStorage) GetAccountByAnyNumber(number int64) (*Account, bool, error) {
+	defer s.observe("GetAccountByAnyNumber", time.Now())
+	return s.next.GetAccountByAnyNumber(number)
+}
+
+func (s *slowQueryStorage) ChangeAccountNumber(id int, number int64) (*NumberChange, error) {
+	defer s.observe("ChangeAccountNumber", time.Now())
+	return s.next.ChangeAccountNumber(id, number)
+}
+
+func (s *slowQueryStorage) GetAccountsByIDs(ids []int) (map[int]*Account, error) {
+	defer s.observe("GetAccountsByIDs", time.Now())
+	return s.next.GetAccountsByIDs(ids)
+}
+
+func (s *slowQueryStorage) GetAccountNumbers(limit int) (map[int64]int, error) {
+	defer s.observe("GetAccountNumbers", time.Now())
+	return s.next.GetAccountNumbers(limit)
+}
+
+func (s *slowQueryStorage) ImportAccounts(accounts []*Account) ([]error, error) {
+	defer s.observe("ImportAccounts", time.Now())
+	return s.next.ImportAccounts(accounts)
+}
+
+func (s *slowQueryStorage) ExportAccounts(filter AccountFilter, fn func(*Account) error) error {
+	defer s.observe("ExportAccounts", time.Now())
+	return s.next.ExportAccounts(filter, fn)
+}
+
+func (s *slowQueryStorage) UpdateAccount(a *Account) error {
+	defer s.observe("UpdateAccount", time.Now())
+	return s.next.UpdateAccount(a)
+}
+
+func (s *slowQueryStorage) GetAllAccounts(filter AccountFilter) ([]*Account, error) {
+	defer s.observe("GetAllAccounts", time.Now())
+	return s.next.GetAllAccounts(filter)
+}
+
+func (s *slowQueryStorage) CreateTransfer(t *Transfer) error {
+	defer s.observe("CreateTransfer", time.Now())
+	return s.next.CreateTransfer(t)
+}
+
+func (s *slowQueryStorage) CreateTransfers(transfers []*Transfer) error {
+	defer s.observe("CreateTransfers", time.Now())
+	return s.next.CreateTransfers(transfers)
+}
+
+func (s *slowQueryStorage) CreateExternalTransfer(et *ExternalTransfer) error {
+	defer s.observe("CreateExternalTransfer", time.Now())
+	return s.next.CreateExternalTransfer(et)
+}
+
+func (s *slowQueryStorage) GetEvents(since int64, limit int) ([]*Event, error) {
+	defer s.observe("GetEvents", time.Now())
+	return s.next.GetEvents(since, limit)
+}
+
+func (s *slowQueryStorage) GetAuditLog(filter AuditFilter) ([]*AuditEntry, error) {
+	defer s.observe("GetAuditLog", time.Now())
+	return s.next.GetAuditLog(filter)
+}
+
+func (s *slowQueryStorage) GetBalanceDiscrepancies() ([]*BalanceDiscrepancy, error) {
+	defer s.observe("GetBalanceDiscrepancies", time.Now())
+	return s.next.GetBalanceDiscrepancies()
+}
+
+func (s *slowQueryStorage) CountAccountsByOwner(ownerID int) (int, error) {
+	defer s.observe("CountAccountsByOwner", time.Now())
+	return s.next.CountAccountsByOwner(ownerID)
+}
+
+func (s *slowQueryStorage) CreateVerificationToken(accountID int, hash string, expiresAt time.Time) error {
+	defer s.observe("CreateVerificationToken", time.Now())
+	return s.next.CreateVerificationToken(accountID, hash, expiresAt)
+}
+
+func (s *slowQueryStorage) VerifyAccount(hash string) (int, error) {
+	defer s.observe("VerifyAccount", time.Now())
+	return s.next.VerifyAccount(hash)
+}
+
+func (s *slowQueryStorage) GetAccountsByEmail(email string) ([]*Account, error) {
+	defer s.observe("GetAccountsByEmail", time.Now())
+	return s.next.GetAccountsByEmail(email)
+}
+
+func (s *slowQueryStorage) CreatePasswordResetToken(accountID int, hash string, expiresAt time.Time) error {
+	defer s.observe("CreatePasswordResetToken", time.Now())
+	return s.next.CreatePasswordResetToken(accountID, hash, expiresAt)
+}
+
+func (s *slowQueryStorage) ResetPassword(hash, encryptedPassword string) (int, error) {
+	defer s.observe("ResetPassword", time.Now())
+	return s.next.ResetPassword(hash, encryptedPassword)
+}
+
+func (s *slowQueryStorage) ChangePassword(accountID int, encryptedPassword, keepSession string) error {
+	defer s.observe("ChangePassword", time.Now())
+	return s.next.ChangePassword(accountID, encryptedPassword, keepSession)
+}
+
+func (s *slowQueryStorage) Ready() error {
+	defer s.observe("Ready", time.Now())
+	return s.next.Ready()
+}
+
+func (s *slowQueryStorage) GetAccountOwners(accountID int) ([]int, error) {
+	defer s.observe("GetAccountOwners", time.Now())
+	return s.next.GetAccountOwners(accountID)
+}
+
+func (s *slowQueryStorage) IsAccountOwner(accountID, ownerID int) (bool, error) {
+	defer s.observe("IsAccountOwner", time.Now())
+	return s.next.IsAccountOwner(accountID, ownerID)
+}
+
+func (s *slowQueryStorage) AddAccountOwner(accountID, ownerID int) error {
+	defer s.observe("AddAccountOwner", time.Now())
+	return s.next.AddAccountOwner(accountID, ownerID)
+}
+
+func (s *slowQueryStorage) RemoveAccountOwner(accountID, ownerID int) error {
+	defer s.observe("RemoveAccountOwner", time.Now())
+	return s.next.RemoveAccountOwner(accountID, ownerID)
+}
+
+func (s *slowQueryStorage) GetTransfers(accountID int, filter TransferFilter) ([]*Transfer, error) {
+	defer s.observe("GetTransfers", time.Now())
+	return s.next.GetTransfers(accountID, filter)
+}
+
+func (s *slowQueryStorage) GetTransfer(id int) (*Transfer, error) {
+	defer s.observe("GetTransfer", time.Now())
+	return s.next.GetTransfer(id)
+}
+
+func (s *slowQueryStorage) CreateSession(session *Session) error {
+	defer s.observe("CreateSession", time.Now())
+	return s.next.CreateSession(session)
+}
+
+func (s *slowQueryStorage) TouchSession(id string, at time.Time) (bool, error) {
+	defer s.observe("TouchSession", time.Now())
+	return s.next.TouchSession(id, at)
+}
+
+func (s *slowQueryStorage) GetSessions(accountID int) ([]*Session, error) {
+	defer s.observe("GetSessions", time.Now())
+	return s.next.GetSessions(accountID)
+}
+
+func (s *slowQueryStorage) RevokeSession(accountID int, id string) error {
+	defer s.observe("RevokeSession", time.Now())
+	return s.next.RevokeSession(accountID, id)
+}
+
+func (s *slowQueryStorage) CreateScheduledTransfer(st *ScheduledTransfer) error {
+	defer s.observe("CreateScheduledTransfer", time.Now())
+	return s.next.CreateScheduledTransfer(st)
+}
+
+func (s *slowQueryStorage) GetScheduledTransfer(id int) (*ScheduledTransfer, error) {
+	defer s.observe("GetScheduledTransfer", time.Now())
+	return s.next.GetScheduledTransfer(id)
+}
+
+func (s *slowQueryStorage) GetPendingScheduledTransfers(accountID int) ([]*ScheduledTransfer, error) {
+	defer s.observe("GetPendingScheduledTransfers", time.Now())
+	return s.next.GetPendingScheduledTransfers(accountID)
+}
+
+func (s *slowQueryStorage) CancelScheduledTransfer(id int) error {
+	defer s.observe("CancelScheduledTransfer", time.Now())
+	return s.next.CancelScheduledTransfer(id)
+}
+
+func (s *slowQueryStorage) ExecuteDueScheduledTransfer(now time.Time, check ScheduledTransferCheck) (*ScheduledTransfer, *Transfer, error) {
+	defer s.observe("ExecuteDueScheduledTransfer", time.Now())
+	return s.next.ExecuteDueScheduledTransfer(now, check)
+}
+
+func (s *slowQueryStorage) GetBalanceAsOf(accountID int, at time.Time) (Money, error) {
+	defer s.observe("GetBalanceAsOf", time.Now())
+	return s.next.GetBalanceAsOf(accountID, at)
+}
+
+func (s *slowQueryStorage) RecordBalanceSnapshots(at time.Time) error {
+	defer s.observe("RecordBalanceSnapshots", time.Now())
+	return s.next.RecordBalanceSnapshots(at)
+}
+
+func (s *slowQueryStorage) DeleteExpiredTokens(now time.Time) (int64, error) {
+	defer s.observe("DeleteExpiredTokens", time.Now())
+	return s.next.DeleteExpiredTokens(now)
+}
+
+func (s *slowQueryStorage) GetStats(since time.Time) (*Stats, error) {
+	defer s.observe("GetStats", time.Now())
+	return s.next.GetStats(since)
+}
+
+func (s *slowQueryStorage) GetSpending(accountID int, from, to time.Time) ([]*CategorySpending, error) {
+	defer s.observe("GetSpending", time.Now())
+	return s.next.GetSpending(accountID, from, to)
+}
+
+func (s *slowQueryStorage) ClaimOutboxMessages(now, leaseUntil time.Time, limit int) ([]*OutboxMessage, error) {
+	defer s.observe("ClaimOutboxMessages", time.Now())
+	return s.next.ClaimOutboxMessages(now, leaseUntil, limit)
+}
+
+func (s *slowQueryStorage) MarkOutboxMessageSent(id int64, at time.Time) error {
+	defer s.observe("MarkOutboxMessageSent", time.Now())
+	return s.next.MarkOutboxMessageSent(id, at)
+}
+
+func (s *slowQueryStorage) MarkOutboxMessageFailed(id int64, nextAttempt *time.Time, reason string) error {
+	defer s.observe("MarkOutboxMessageFailed", time.Now())
+	return s.next.MarkOutboxMessageFailed(id, nextAttempt, reason)
+}
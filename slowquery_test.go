@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSlowStorage struct {
+	*fakeStorage
+	delay time.Duration
+}
+
+func (s *fakeSlowStorage) GetAccountByNumber(number int) (*Account, error) {
+	time.Sleep(s.delay)
+	return s.fakeStorage.GetAccountByNumber(number)
+}
+
+func TestSlowQueryStorage(t *testing.T) {
+	next := &fakeSlowStorage{fakeStorage: newFakeStorage(&Account{ID: 1, Number: 123456})}
+	var logged []string
+	store := newSlowQueryStorage(next, 20*time.Millisecond)
+	store.logf = func(format string, v ...any) { logged = append(logged, fmt.Sprintf(format, v...)) }
+
+	account, err := store.GetAccountByNumber(123456)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, account.ID)
+	assert.Empty(t, logged, "fast calls aren't logged")
+
+	next.delay = 30 * time.Millisecond
+	_, err = store.GetAccountByNumber(123456)
+	assert.Nil(t, err)
+	if assert.Len(t, logged, 1) {
+		assert.Contains(t, logged[0], "GetAccountByNumber")
+		assert.NotContains(t, logged[0], "123456", "arguments are left out")
+	}
+}
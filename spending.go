@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// defaultCategories are the spending categories transfers may be tagged
+// with when TRANSFER_CATEGORIES isn't set.
+var defaultCategories = []string{"bills", "entertainment", "food", "health", "housing", "shopping", "transport", "other"}
+
+// categoryName is what a category may look like; it has to fit the
+// category columns.
+var categoryName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,29}$`)
+
+// uncategorized is what spending on transfers without a category is
+// reported as.
+const uncategorized = "uncategorized"
+
+func validateCategories(categories []string) error {
+	for _, c := range categories {
+		if !categoryName.MatchString(c) || c == uncategorized {
+			return fmt.Errorf("invalid transfer category: '%s', expected up to 30 lowercase letters, digits, '-' and '_'", c)
+		}
+	}
+	return nil
+}
+
+func normalizeCategory(category string) string {
+	return strings.ToLower(strings.TrimSpace(category))
+}
+
+// handleAccountSpending sums what the account spent on transfers between
+// the from and to dates (YYYY-MM-DD, both optional and included), by
+// category. Fees aren't counted.
+func (s *APIServer) handleAccountSpending(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	loc, err := s.requestLocation(r)
+	if err != nil {
+		return err
+	}
+	from, to, err := parseDateRange(r.URL.Query(), loc)
+	if err != nil {
+		return err
+	}
+
+	categories, err := s.storage.GetSpending(id, from, to)
+	if err != nil {
+		return err
+	}
+	resp := SpendingResponse{Categories: categories}
+	for _, c := range categories {
+		resp.Total += c.Amount
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
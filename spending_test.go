@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSpendingStorage struct {
+	*fakeStorage
+	from, to time.Time
+}
+
+func (s *fakeSpendingStorage) GetSpending(accountID int, from, to time.Time) ([]*CategorySpending, error) {
+	s.from, s.to = from, to
+	return []*CategorySpending{
+		{Category: "food", Amount: 1250, Transfers: 3},
+		{Category: uncategorized, Amount: 500, Transfers: 1},
+	}, nil
+}
+
+func TestHandleAccountSpending(t *testing.T) {
+	store := &fakeSpendingStorage{fakeStorage: newFakeStorage()}
+	server := newTestServer(t, store)
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/account/1/spending?from=2024-03-01&to=2024-03-31", nil), map[string]string{"id": "1"})
+	rec := httptest.NewRecorder()
+	makeHTTPHandlerFunc(server.handleAccountSpending)(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var resp SpendingResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Len(t, resp.Categories, 2)
+	assert.Equal(t, Money(1750), resp.Total)
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), store.from)
+	assert.Equal(t, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), store.to, "the to date is included")
+}
+
+func TestPrepareTransferCategory(t *testing.T) {
+	from := &Account{ID: 1, Number: 1001, OwnerID: 1}
+	to := &Account{ID: 2, Number: 1002, OwnerID: 2}
+	server := newTestServer(t, newFakeStorage(from, to))
+	server.categoryList = []string{"food"}
+	server.categories = map[string]bool{"food": true}
+
+	transfer, err := server.prepareTransfer(from.Number, &TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 10, Category: " Food "})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "food", transfer.Category)
+	}
+
+	_, err = server.prepareTransfer(from.Number, &TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 10, Category: "rent"})
+	assert.Equal(t, []string{"category"}, invalidFields(err))
+}
+
+func TestValidateCategories(t *testing.T) {
+	assert.Nil(t, validateCategories(defaultCategories))
+	for _, c := range []string{"", "Food", "eating out", uncategorized, "a_category_name_that_is_too_long"} {
+		assert.Error(t, validateCategories([]string{c}), c)
+	}
+}
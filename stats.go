@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStatsWindow = 24 * time.Hour
+	maxStatsWindow     = 366 * 24 * time.Hour
+	// statsCacheTTL is how long aggregates are served from memory before
+	// the tables are scanned again.
+	statsCacheTTL = 30 * time.Second
+)
+
+// statsCache holds the latest Stats computed for each window.
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[time.Duration]*Stats
+}
+
+func (c *statsCache) get(window time.Duration, now time.Time) *Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stats, ok := c.entries[window]; ok && now.Sub(stats.GeneratedAt) < statsCacheTTL {
+		return stats
+	}
+	return nil
+}
+
+func (c *statsCache) put(window time.Duration, stats *Stats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[time.Duration]*Stats)
+	}
+	c.entries[window] = stats
+}
+
+// handleStats returns bank-wide totals, with the transfers of the last
+// window (a Go duration, 24h by default). Results are up to statsCacheTTL
+// old.
+func (s *APIServer) handleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+
+	window := defaultStatsWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxStatsWindow {
+			return fmt.Errorf("invalid window: '%s', expected a positive duration of at most %s", v, maxStatsWindow)
+		}
+		window = d
+	}
+
+	now := time.Now().UTC()
+	stats := s.stats.get(window, now)
+	if stats == nil {
+		var err error
+		if stats, err = s.storage.GetStats(now.Add(-window)); err != nil {
+			return err
+		}
+		stats.GeneratedAt = now
+		s.stats.put(window, stats)
+	}
+
+	// The counters are live, unlike the cached aggregates.
+	res := *stats
+	res.Idempotency = s.idempotencyMetrics.snapshot()
+	return WriteJSON(w, http.StatusOK, &res)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeStatsStorage struct {
+	*fakeStorage
+	calls []time.Time
+}
+
+func (s *fakeStatsStorage) GetStats(since time.Time) (*Stats, error) {
+	s.calls = append(s.calls, since)
+	return &Stats{AccountCount: 3, TotalBalance: 1500, Since: since}, nil
+}
+
+func TestHandleStats(t *testing.T) {
+	store := &fakeStatsStorage{fakeStorage: newFakeStorage()}
+	server := newTestServer(t, store)
+	handler := makeHTTPHandlerFunc(server.handleStats)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	rec := get("/stats")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var stats Stats
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&stats))
+	assert.Equal(t, int64(3), stats.AccountCount)
+	assert.Equal(t, Money(1500), stats.TotalBalance)
+	assert.WithinDuration(t, time.Now().Add(-24*time.Hour), stats.Since, time.Minute)
+
+	get("/stats")
+	assert.Len(t, store.calls, 1, "the second request is served from the cache")
+	get("/stats?window=1h")
+	assert.Len(t, store.calls, 2, "windows are cached separately")
+
+	for _, window := range []string{"abc", "-1h", "9000h"} {
+		assert.Equal(t, http.StatusBadRequest, get("/stats?window="+window).Code, window)
+	}
+}
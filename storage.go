@@ -2,41 +2,274 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrAccountNotFound   = errors.New("account not found")
+	ErrSelfTransfer      = errors.New("cannot transfer to the same account")
+	ErrInvalidToken      = errors.New("invalid or expired token")
+	ErrSessionNotFound   = errors.New("no such active session")
+	ErrNumberTaken       = errors.New("account number already taken")
+	ErrVersionConflict   = errors.New("account was changed since it was read")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+
+	ErrScheduledTransferNotFound = errors.New("scheduled transfer not found")
+	ErrTransferNotFound          = errors.New("transfer not found")
 )
 
+// storageDecorator is implemented by the Storages wrapping another one,
+// such as slowQueryStorage.
+type storageDecorator interface {
+	unwrap() Storage
+}
+
 type Storage interface {
 	CreateAccount(*Account) error
+	RecordLogin(accountID int, at time.Time) error
+	RecordFailedLogin(accountID, maxFailures int, lockUntil time.Time) (bool, error)
 	DeleteAccount(int) error
+	CreateDeletionToken(accountID int, hash string, expiresAt time.Time) error
+	ConsumeDeletionToken(accountID int, hash string) error
 	GetAccountByID(int) (*Account, error)
 	GetAccountByNumber(int) (*Account, error)
+	GetAccountByAnyNumber(number int64) (*Account, bool, error)
+	ChangeAccountNumber(id int, number int64) (*NumberChange, error)
+	GetAccountsByIDs(ids []int) (map[int]*Account, error)
+	GetAccountNumbers(limit int) (map[int64]int, error)
+	ImportAccounts(accounts []*Account) ([]error, error)
+	ExportAccounts(filter AccountFilter, fn func(*Account) error) error
 	UpdateAccount(*Account) error
-	GetAllAccounts() ([]*Account, error)
+	GetAllAccounts(AccountFilter) ([]*Account, error)
+	CreateTransfer(*Transfer) error
+	CreateTransfers([]*Transfer) error
+	CreateExternalTransfer(*ExternalTransfer) error
+	GetEvents(since int64, limit int) ([]*Event, error)
+	GetAuditLog(filter AuditFilter) ([]*AuditEntry, error)
+	GetBalanceDiscrepancies() ([]*BalanceDiscrepancy, error)
+	CountAccountsByOwner(ownerID int) (int, error)
+	CreateVerificationToken(accountID int, hash string, expiresAt time.Time) error
+	VerifyAccount(hash string) (int, error)
+	GetAccountsByEmail(email string) ([]*Account, error)
+	CreatePasswordResetToken(accountID int, hash string, expiresAt time.Time) error
+	ResetPassword(hash, encryptedPassword string) (int, error)
+	ChangePassword(accountID int, encryptedPassword, keepSession string) error
+	Ready() error
+	GetAccountOwners(accountID int) ([]int, error)
+	IsAccountOwner(accountID, ownerID int) (bool, error)
+	AddAccountOwner(accountID, ownerID int) error
+	RemoveAccountOwner(accountID, ownerID int) error
+	GetTransfers(accountID int, filter TransferFilter) ([]*Transfer, error)
+	GetTransfer(id int) (*Transfer, error)
+	CreateSession(session *Session) error
+	TouchSession(id string, at time.Time) (bool, error)
+	GetSessions(accountID int) ([]*Session, error)
+	RevokeSession(accountID int, id string) error
+	CreateScheduledTransfer(st *ScheduledTransfer) error
+	GetScheduledTransfer(id int) (*ScheduledTransfer, error)
+	GetPendingScheduledTransfers(accountID int) ([]*ScheduledTransfer, error)
+	CancelScheduledTransfer(id int) error
+	ExecuteDueScheduledTransfer(now time.Time, check ScheduledTransferCheck) (*ScheduledTransfer, *Transfer, error)
+	GetBalanceAsOf(accountID int, at time.Time) (Money, error)
+	RecordBalanceSnapshots(at time.Time) error
+	DeleteExpiredTokens(now time.Time) (int64, error)
+	GetStats(since time.Time) (*Stats, error)
+	GetSpending(accountID int, from, to time.Time) ([]*CategorySpending, error)
+	ClaimOutboxMessages(now, leaseUntil time.Time, limit int) ([]*OutboxMessage, error)
+	MarkOutboxMessageSent(id int64, at time.Time) error
+	MarkOutboxMessageFailed(id int64, nextAttempt *time.Time, reason string) error
 }
 
+// PostgresStorage sends writes to the primary database and the read-only
+// lookups that can tolerate replication lag to replica, which is the primary
+// itself when no replica is configured.
 type PostgresStorage struct {
-	db *sql.DB
+	db      *sql.DB
+	replica *sql.DB
+
+	// schema is created by Init when set; connections already have it as
+	// their search_path.
+	schema string
+	// outbox makes transfers queue webhook messages, which is only worth
+	// it when something delivers them.
+	outbox bool
+	// events, when set, writes the events of transfers after they have
+	// committed rather than within their transaction.
+	events *eventQueue
+	// stmts are prepared by Init.
+	stmts statements
+
+	// migrated is set once Init has brought the schema up to date.
+	migrated atomic.Bool
 }
 
-func NewPostgresStorage() (*PostgresStorage, error) {
-	connStr := "user=postgres dbname=postgres password=gobank sslmode=disable"
-	db, err := sql.Open("postgres", connStr)
+func NewPostgresStorage(cfg *Config) (*PostgresStorage, error) {
+	s, err := openPostgresStorage(cfg.DatabaseDSN())
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
+	s.schema = cfg.DBSchema
+	s.outbox = cfg.WebhookURL != "" && cfg.Features.Enabled(FeatureWebhooks)
+	if cfg.AsyncEventQueue > 0 {
+		s.events = newEventQueue(cfg.AsyncEventQueue, cfg.AsyncEventWorkers, s.writeEvent)
+	}
+
+	if cfg.ReplicaDSN != "" {
+		replica, err := openDB(withSearchPath(cfg.ReplicaDSN, cfg.DBSchema))
+		if err != nil {
+			s.db.Close()
+			return nil, fmt.Errorf("error connecting to read replica: %w", err)
+		}
+		s.replica = replica
+	}
+	return s, nil
+}
+
+func openPostgresStorage(connStr string) (*PostgresStorage, error) {
+	db, err := openDB(connStr)
+	if err != nil {
 		return nil, err
 	}
 
 	return &PostgresStorage{
-		db: db,
+		db:      db,
+		replica: db,
 	}, nil
 }
 
+func openDB(connStr string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
 func (s *PostgresStorage) Init() error {
-	return s.createAccountTable()
+	if s.schema != "" {
+		if _, err := s.db.Exec("create schema if not exists " + pq.QuoteIdentifier(s.schema)); err != nil {
+			return err
+		}
+	}
+	if err := s.createAccountTable(); err != nil {
+		return err
+	}
+	if err := s.createTransferTable(); err != nil {
+		return err
+	}
+	if err := s.createLedgerTable(); err != nil {
+		return err
+	}
+	if err := s.createEventTable(); err != nil {
+		return err
+	}
+	if err := s.migrate(); err != nil {
+		return err
+	}
+	if err := s.prepareStatements(); err != nil {
+		return err
+	}
+	s.migrated.Store(true)
+	return nil
+}
+
+// Ready reports whether the storage can serve requests: the schema has been
+// migrated and the databases answer.
+func (s *PostgresStorage) Ready() error {
+	if !s.migrated.Load() {
+		return fmt.Errorf("migrations have not run")
+	}
+	if err := s.db.Ping(); err != nil {
+		return err
+	}
+	if s.replica != s.db {
+		return s.replica.Ping()
+	}
+	return nil
+}
+
+// statements are the most common queries, prepared once rather than
+// parsed by the server on every call. database/sql prepares them again on
+// each connection they end up used on, and tx.Stmt binds them to a
+// transaction.
+type statements struct {
+	insertAccount  *sql.Stmt
+	getAccountByID *sql.Stmt
+	updateAccount  *sql.Stmt
+	deleteAccount  *sql.Stmt
+}
+
+const (
+	insertAccountQuery = `
+	insert into account (first_name, last_name, encrypted_password, number, balance, created_at, min_balance, metadata, email, is_verified)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id, version`
+	getAccountByIDQuery = "select " + accountColumns + " from account where id = $1"
+	updateAccountQuery  = `
+	update account set first_name = $1, last_name = $2, min_balance = $3, metadata = $4, max_accounts = $5, nickname = $6, version = version + 1
+	where id = $7 and version = $8 returning version`
+	deleteAccountQuery = "delete from account where id = $1"
+)
+
+// prepareStatements prepares the statements, which is done by Init rather
+// than NewPostgresStorage because preparing checks the tables, which may
+// only exist once migrated. Account lookups are prepared on the replica,
+// which serves them.
+func (s *PostgresStorage) prepareStatements() error {
+	for _, p := range []struct {
+		name  string
+		stmt  **sql.Stmt
+		db    *sql.DB
+		query string
+	}{
+		{"insertAccount", &s.stmts.insertAccount, s.db, insertAccountQuery},
+		{"getAccountByID", &s.stmts.getAccountByID, s.replica, getAccountByIDQuery},
+		{"updateAccount", &s.stmts.updateAccount, s.db, updateAccountQuery},
+		{"deleteAccount", &s.stmts.deleteAccount, s.db, deleteAccountQuery},
+	} {
+		stmt, err := p.db.Prepare(p.query)
+		if err != nil {
+			s.closeStatements()
+			return fmt.Errorf("error preparing %s: %w", p.name, err)
+		}
+		*p.stmt = stmt
+	}
+	return nil
+}
+
+func (s *PostgresStorage) closeStatements() {
+	for _, stmt := range []*sql.Stmt{s.stmts.insertAccount, s.stmts.getAccountByID, s.stmts.updateAccount, s.stmts.deleteAccount} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	s.stmts = statements{}
+}
+
+// Close writes the events still queued, then closes the prepared
+// statements and the databases.
+func (s *PostgresStorage) Close() error {
+	if s.events != nil {
+		s.events.close()
+	}
+	s.closeStatements()
+	if s.replica != s.db {
+		s.replica.Close()
+	}
+	return s.db.Close()
 }
 
 func (s *PostgresStorage) createAccountTable() error {
@@ -54,6 +287,220 @@ func (s *PostgresStorage) createAccountTable() error {
 	return err
 }
 
+// migrations add what was introduced after the tables were first created,
+// so that existing databases pick it up too. They must be safe to rerun.
+var migrations = []string{
+	`alter table account add column if not exists min_balance bigint not null default 0`,
+	`alter table account add column if not exists metadata jsonb not null default '{}'`,
+	`alter table transfer add column if not exists description varchar(140) not null default ''`,
+	`alter table ledger add column if not exists description varchar(140) not null default ''`,
+	`alter table account add column if not exists owner_id integer`,
+	`update account set owner_id = id where owner_id is null`,
+	`create index if not exists account_owner_id_idx on account (owner_id)`,
+	`alter table account add column if not exists max_accounts integer`,
+	`alter table account add column if not exists email varchar(254) not null default ''`,
+	// Accounts that existed before verification was introduced count as
+	// verified; new ones are inserted unverified explicitly.
+	`alter table account add column if not exists is_verified boolean not null default true`,
+	`create table if not exists verification_token (
+			token_hash varchar(64) primary key,
+			account_id integer not null,
+			expires_at timestamp not null
+		)`,
+	`create table if not exists password_reset_token (
+			token_hash varchar(64) primary key,
+			account_id integer not null,
+			expires_at timestamp not null
+		)`,
+	`create index if not exists account_email_idx on account (lower(email))`,
+	`create index if not exists account_last_name_idx on account (lower(last_name))`,
+	`create table if not exists account_owners (
+			account_id integer not null references account (id) on delete cascade,
+			owner_id integer not null,
+			primary key (account_id, owner_id)
+		)`,
+	`insert into account_owners (account_id, owner_id)
+		select id, owner_id from account
+		on conflict do nothing`,
+	`create index if not exists account_owners_owner_id_idx on account_owners (owner_id)`,
+	`create index if not exists transfer_from_account_idx on transfer (from_account, created_at)`,
+	`create index if not exists transfer_to_account_idx on transfer (to_account, created_at)`,
+	`create table if not exists idempotency_key (
+			key varchar(255) primary key,
+			request_hash varchar(64) not null,
+			account_id integer,
+			created_at timestamp not null
+		)`,
+	`create index if not exists idempotency_key_created_at_idx on idempotency_key (created_at)`,
+	`create table if not exists session (
+			id varchar(32) primary key,
+			account_id integer not null references account (id) on delete cascade,
+			created_at timestamp not null,
+			last_used_at timestamp not null,
+			expires_at timestamp not null,
+			revoked_at timestamp
+		)`,
+	`create index if not exists session_account_id_idx on session (account_id, expires_at)`,
+	`alter table session add column if not exists user_agent varchar(512) not null default ''`,
+	`alter table session add column if not exists client_ip varchar(45) not null default ''`,
+	`create table if not exists scheduled_transfers (
+			id serial primary key,
+			from_account integer not null references account (id) on delete cascade,
+			to_account integer not null references account (id) on delete cascade,
+			amount bigint not null,
+			fee bigint not null,
+			description varchar(140) not null default '',
+			execute_at timestamp not null,
+			status varchar(16) not null default 'pending',
+			failure_reason text not null default '',
+			transfer_id integer,
+			created_at timestamp not null
+		)`,
+	`create index if not exists scheduled_transfers_due_idx on scheduled_transfers (execute_at) where status = 'pending'`,
+	`create index if not exists scheduled_transfers_from_account_idx on scheduled_transfers (from_account)`,
+	`create table if not exists balance_snapshot (
+			account_id integer not null references account (id) on delete cascade,
+			taken_at timestamp not null,
+			balance bigint not null,
+			primary key (account_id, taken_at)
+		)`,
+	`create index if not exists ledger_account_created_at_idx on ledger (account_id, created_at)`,
+	// Fails if existing accounts share a number; those have to be
+	// renumbered by hand first.
+	`create unique index if not exists account_number_key on account (number)`,
+	`alter table account add column if not exists last_login_at timestamp`,
+	`alter table account add column if not exists failed_logins integer not null default 0`,
+	`alter table account add column if not exists locked_until timestamp`,
+	`create table if not exists outbox (
+			id bigserial primary key,
+			type varchar(30) not null,
+			payload jsonb not null,
+			created_at timestamp not null default (now() at time zone 'utc'),
+			attempts integer not null default 0,
+			next_attempt_at timestamp,
+			sent_at timestamp,
+			last_error text not null default ''
+		)`,
+	`create index if not exists outbox_due_idx on outbox (next_attempt_at) where sent_at is null`,
+	// The balance check backs up the one made in execTransfer. It is added
+	// as not valid so that accounts already below their minimum don't fail
+	// the migration.
+	`do $$
+	begin
+		if not exists (select 1 from pg_constraint where conname = 'account_balance_check' and conrelid = 'account'::regclass) then
+			alter table account add constraint account_balance_check check (balance >= min_balance) not valid;
+		end if;
+	end $$`,
+	`alter table transfer add column if not exists category varchar(30) not null default ''`,
+	`alter table ledger add column if not exists category varchar(30) not null default ''`,
+	`alter table scheduled_transfers add column if not exists category varchar(30) not null default ''`,
+	`create index if not exists account_created_at_id_idx on account (created_at, id)`,
+	`alter table transfer add column if not exists status varchar(20) not null default 'completed'`,
+	`alter table transfer add column if not exists failure_reason text not null default ''`,
+	// account_id has no foreign key: the log outlives deleted accounts.
+	`create table if not exists audit_log (
+			id bigserial primary key,
+			account_id integer not null,
+			action varchar(30) not null,
+			source_ip varchar(45) not null default '',
+			user_agent varchar(512) not null default '',
+			admin_number bigint,
+			created_at timestamp not null default (now() at time zone 'utc')
+		)`,
+	`create index if not exists audit_log_account_id_idx on audit_log (account_id, id)`,
+	`create table if not exists account_deletion_token (
+			token_hash varchar(64) primary key,
+			account_id integer not null references account (id) on delete cascade,
+			expires_at timestamp not null
+		)`,
+	`create table if not exists external_transfer (
+			id serial primary key,
+			from_account integer not null,
+			iban varchar(34) not null default '',
+			routing_number varchar(9) not null default '',
+			account_number varchar(17) not null default '',
+			amount bigint not null,
+			fee bigint not null,
+			description text not null default '',
+			status varchar(20) not null,
+			created_at timestamp not null
+		)`,
+	`create index if not exists external_transfer_pending_idx on external_transfer (created_at) where status = 'external_pending'`,
+	`create table if not exists account_number_history (
+			number bigint primary key,
+			account_id integer not null,
+			replaced_at timestamp not null
+		)`,
+	`alter table account add column if not exists version integer not null default 1`,
+	`alter table account add column if not exists nickname varchar(30) not null default ''`,
+	// Numbers of up to 18 digits can be configured, more than an integer
+	// holds. A no-op once the column is bigint.
+	`alter table account alter column number type bigint`,
+	// Balances are int64 minor units like the amounts moved in and out of
+	// them; an integer overflows well below MAX_TRANSFER_AMOUNT.
+	`alter table account alter column balance type bigint`,
+	// The account whose holder scheduled the transfer, whose permission is
+	// checked again when it is due. Older ones were scheduled by the
+	// holder of the source account, as far as can be told.
+	`alter table scheduled_transfers add column if not exists scheduled_by integer`,
+	`update scheduled_transfers set scheduled_by = from_account where scheduled_by is null`,
+	`alter table ledger add column if not exists external_transfer_id integer`,
+}
+
+func (s *PostgresStorage) migrate() error {
+	for _, query := range migrations {
+		if _, err := s.db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accountColumns lists the account columns in the order scanIntoAccount
+// expects them.
+const accountColumns = "id, first_name, last_name, encrypted_password, number, balance, created_at, min_balance, metadata, owner_id, max_accounts, email, is_verified, last_login_at, locked_until, version, nickname"
+
+func (s *PostgresStorage) createTransferTable() error {
+	query := `create table if not exists transfer (
+			id serial primary key,
+			from_account integer not null,
+			to_account integer not null,
+			amount bigint not null,
+			fee bigint not null,
+			created_at timestamp
+		)`
+
+	_, err := s.db.Exec(query)
+	return err
+}
+
+func (s *PostgresStorage) createLedgerTable() error {
+	query := `create table if not exists ledger (
+			id serial primary key,
+			account_id integer not null,
+			transfer_id integer,
+			amount bigint not null,
+			kind varchar(20) not null,
+			created_at timestamp
+		)`
+
+	_, err := s.db.Exec(query)
+	return err
+}
+
+func (s *PostgresStorage) createEventTable() error {
+	query := `create table if not exists event (
+			id bigserial primary key,
+			type varchar(30) not null,
+			account_id integer not null,
+			payload jsonb not null,
+			created_at timestamp not null default (now() at time zone 'utc')
+		)`
+
+	_, err := s.db.Exec(query)
+	return err
+}
+
 func (s *PostgresStorage) dropAccountTable() error {
 	query := `drop table if exists account;`
 
@@ -62,64 +509,1580 @@ func (s *PostgresStorage) dropAccountTable() error {
 }
 
 func (s *PostgresStorage) CreateAccount(a *Account) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.insertAccount(tx, a); err != nil {
+		return err
+	}
+	if err := insertEvent(tx, EventAccountCreated, a.ID, a); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ImportAccounts creates the accounts in a single transaction. An account
+// that can't be created doesn't stop the others: its error is returned at
+// its index, and nil for the accounts that made it. The events of the
+// accounts created are inserted last, so that the event lock is only held
+// while committing.
+func (s *PostgresStorage) ImportAccounts(accounts []*Account) ([]error, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	errs := make([]error, len(accounts))
+	for i, a := range accounts {
+		if _, err := tx.Exec("savepoint import_account"); err != nil {
+			return nil, err
+		}
+		if errs[i] = s.insertAccount(tx, a); errs[i] != nil {
+			a.ID = 0
+			if _, err := tx.Exec("rollback to savepoint import_account"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, err := tx.Exec("release savepoint import_account"); err != nil {
+			return nil, err
+		}
+	}
+	for i, a := range accounts {
+		if errs[i] != nil {
+			continue
+		}
+		if err := insertEvent(tx, EventAccountCreated, a.ID, a); err != nil {
+			return nil, err
+		}
+	}
+	return errs, tx.Commit()
+}
+
+// insertAccount stores a new account along with its ownership and, when it
+// starts with money, the ledger entry for its opening balance. The caller
+// inserts its event.
+func (s *PostgresStorage) insertAccount(tx *sql.Tx, a *Account) error {
+	metadata, err := encodeMetadata(a.Metadata)
+	if err != nil {
+		return err
+	}
+
+	// Numbers that were replaced stay reserved for their account.
+	var former bool
+	if err := tx.QueryRow("select exists (select 1 from account_number_history where number = $1)", a.Number).Scan(&former); err != nil {
+		return err
+	}
+	if former {
+		return fmt.Errorf("%w: '%d'", ErrNumberTaken, a.Number)
+	}
+
+	err = tx.Stmt(s.stmts.insertAccount).QueryRow(a.FirstName, a.LastName, a.EncryptedPassword, a.Number, a.Balance, a.CreatedAt, a.MinBalance, metadata, a.Email, a.Verified).Scan(&a.ID, &a.Version)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "account_number_key" {
+		return fmt.Errorf("%w: '%d'", ErrNumberTaken, a.Number)
+	}
+	if err != nil {
+		return err
+	}
+	// Accounts created without an owner are their own owner.
+	if a.OwnerID == 0 {
+		a.OwnerID = a.ID
+	}
+	if _, err := tx.Exec("update account set owner_id = $1 where id = $2", a.OwnerID, a.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("insert into account_owners (account_id, owner_id) values ($1, $2)", a.ID, a.OwnerID); err != nil {
+		return err
+	}
+	if a.Balance != 0 {
+		entry := &LedgerEntry{AccountID: a.ID, Amount: a.Balance, Kind: LedgerOpeningBalance, CreatedAt: a.CreatedAt}
+		if err := insertLedgerEntry(tx, entry); err != nil {
+			return err
+		}
+	}
+	if a.audit != nil {
+		a.audit.AccountID = a.ID
+		if err := insertAuditEntry(tx, a.audit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertAuditEntry records an audit entry within the transaction of the
+// change it describes.
+func insertAuditEntry(tx *sql.Tx, e *AuditEntry) error {
 	query := `
-	insert into account (first_name, last_name, encrypted_password, number, balance, created_at) 
-    VALUES ($1, $2, $3, $4, $5, $6)`
+	insert into audit_log (account_id, action, source_ip, user_agent, admin_number)
+	values ($1, $2, $3, $4, $5) returning id, created_at`
+	return tx.QueryRow(query, e.AccountID, e.Action, e.SourceIP, e.UserAgent, e.AdminNumber).Scan(&e.ID, &e.CreatedAt)
+}
+
+// GetBalanceDiscrepancies compares every balance to the sum of the
+// account's ledger entries in a single aggregate query, returning the
+// accounts where they differ. It reads from the primary: the replica may
+// lag behind by part of a transaction's worth of rows.
+func (s *PostgresStorage) GetBalanceDiscrepancies() ([]*BalanceDiscrepancy, error) {
+	rows, err := s.db.Query(`
+	select a.id, a.number, a.balance, coalesce(l.total, 0)
+	from account a
+	left join (select account_id, sum(amount) as total from ledger group by account_id) l on l.account_id = a.id
+	where a.balance <> coalesce(l.total, 0)
+	order by a.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discrepancies := make([]*BalanceDiscrepancy, 0)
+	for rows.Next() {
+		d := new(BalanceDiscrepancy)
+		if err := rows.Scan(&d.AccountID, &d.Number, &d.Balance, &d.LedgerBalance); err != nil {
+			return nil, err
+		}
+		d.Difference = d.Balance - d.LedgerBalance
+		discrepancies = append(discrepancies, d)
+	}
+	return discrepancies, rows.Err()
+}
+
+// GetAuditLog returns the audit entries matching the filter, newest first.
+func (s *PostgresStorage) GetAuditLog(filter AuditFilter) ([]*AuditEntry, error) {
+	q := newSelect("select id, account_id, action, source_ip, user_agent, admin_number, created_at from audit_log")
+	if filter.AccountID != 0 {
+		q.where("account_id = " + q.arg(filter.AccountID))
+	}
+	query, args := q.orderBy("id desc").page(filter.Limit, 0).build()
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	_, err := s.db.Query(query, a.FirstName, a.LastName, a.EncryptedPassword, a.Number, a.Balance, a.CreatedAt)
+	entries := make([]*AuditEntry, 0)
+	for rows.Next() {
+		e := new(AuditEntry)
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.Action, &e.SourceIP, &e.UserAgent, &e.AdminNumber, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// RecordLogin stores a successful login, which also clears the count of
+// failed ones.
+func (s *PostgresStorage) RecordLogin(accountID int, at time.Time) error {
+	_, err := s.db.Exec("update account set last_login_at = $1, failed_logins = 0 where id = $2", at, accountID)
 	return err
 }
 
+// RecordFailedLogin counts a failed login. The maxFailures-th in a row locks
+// the account until lockUntil and starts the count over; it reports whether
+// that happened.
+func (s *PostgresStorage) RecordFailedLogin(accountID, maxFailures int, lockUntil time.Time) (bool, error) {
+	query := `update account set
+		failed_logins = case when failed_logins + 1 >= $2 then 0 else failed_logins + 1 end,
+		locked_until = case when failed_logins + 1 >= $2 then $3 else locked_until end
+	where id = $1
+	returning failed_logins = 0`
+
+	var locked bool
+	err := s.db.QueryRow(query, accountID, maxFailures, lockUntil).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, accountID)
+	}
+	return locked, err
+}
+
 func (s *PostgresStorage) DeleteAccount(id int) error {
-	_, err := s.db.Query("delete from account where id = $1", id)
-	return err
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmt(s.stmts.deleteAccount).Exec(id); err != nil {
+		return err
+	}
+	if err := insertEvent(tx, EventAccountDeleted, id, map[string]int{"id": id}); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *PostgresStorage) GetAccountByNumber(number int) (*Account, error) {
-	rows, err := s.db.Query("select * from account where number = $1", number)
+	rows, err := s.db.Query("select "+accountColumns+" from account where number = $1", number)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
 	if rows.Next() {
 		return scanIntoAccount(rows)
 	}
-	return nil, fmt.Errorf("no records found for account with number: '%d'", number)
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w with number: '%d'", ErrAccountNotFound, number)
+}
+
+// GetAccountNumbers maps the numbers of up to limit accounts to their ids,
+// those logged into most recently first.
+func (s *PostgresStorage) GetAccountNumbers(limit int) (map[int64]int, error) {
+	rows, err := s.replica.Query("select number, id from account order by last_login_at desc nulls last, id limit $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int64]int)
+	for rows.Next() {
+		var number int64
+		var id int
+		if err := rows.Scan(&number, &id); err != nil {
+			return nil, err
+		}
+		ids[number] = id
+	}
+	return ids, rows.Err()
+}
+
+// GetAccountByAnyNumber finds the account with the number, or else the one
+// that had it before it was changed, in which case former is set.
+func (s *PostgresStorage) GetAccountByAnyNumber(number int64) (*Account, bool, error) {
+	account, err := s.GetAccountByNumber(int(number))
+	if !errors.Is(err, ErrAccountNotFound) {
+		return account, false, err
+	}
+	var id int
+	err = s.db.QueryRow("select account_id from account_number_history where number = $1", number).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, false, fmt.Errorf("%w with number: '%d'", ErrAccountNotFound, number)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	account, err = s.GetAccountByID(id)
+	return account, true, err
+}
+
+// ChangeAccountNumber gives the account a new number, keeping the old one
+// in its history. Sessions are revoked, since their tokens carry the old
+// number; references from other tables are by id and stay valid.
+func (s *PostgresStorage) ChangeAccountNumber(id int, number int64) (*NumberChange, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	change := &NumberChange{AccountID: id, NewNumber: number, ChangedAt: time.Now().UTC()}
+	err = tx.QueryRow("select number from account where id = $1 for update", id).Scan(&change.OldNumber)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var former bool
+	if err := tx.QueryRow("select exists (select 1 from account_number_history where number = $1)", number).Scan(&former); err != nil {
+		return nil, err
+	}
+	if former || number == change.OldNumber {
+		return nil, fmt.Errorf("%w: '%d'", ErrNumberTaken, number)
+	}
+	_, err = tx.Exec("update account set number = $1 where id = $2", number, id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "account_number_key" {
+		return nil, fmt.Errorf("%w: '%d'", ErrNumberTaken, number)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("insert into account_number_history (number, account_id, replaced_at) values ($1, $2, $3)", change.OldNumber, id, change.ChangedAt); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("update session set revoked_at = $2 where account_id = $1 and revoked_at is null", id, change.ChangedAt); err != nil {
+		return nil, err
+	}
+	if err := insertEvent(tx, EventAccountNumberChanged, id, change); err != nil {
+		return nil, err
+	}
+	return change, tx.Commit()
 }
 
 func (s *PostgresStorage) GetAccountByID(id int) (*Account, error) {
-	rows, err := s.db.Query("select * from account where id = $1", id)
+	rows, err := s.stmts.getAccountByID.Query(id)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
 	if rows.Next() {
 		return scanIntoAccount(rows)
 	}
-	return nil, fmt.Errorf("no records found for account with id: '%d'", id)
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, id)
 }
 
-func (s *PostgresStorage) UpdateAccount(account *Account) error {
-	return nil
+// UpdateAccount saves the editable fields of the account. The balance is
+// left alone: it only ever changes through transfers. The account must
+// still be at the version it was read at, otherwise ErrVersionConflict is
+// returned; on success a.Version is the new version.
+func (s *PostgresStorage) UpdateAccount(a *Account) error {
+	metadata, err := encodeMetadata(a.Metadata)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.Stmt(s.stmts.updateAccount).QueryRow(a.FirstName, a.LastName, a.MinBalance, metadata, a.MaxAccounts, a.Nickname, a.ID, a.Version).Scan(&a.Version)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := tx.QueryRow("select exists (select 1 from account where id = $1)", a.ID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: '%d'", ErrVersionConflict, a.ID)
+		}
+		return fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, a.ID)
+	}
+	if err != nil {
+		return balanceCheckError(err)
+	}
+	if err := insertEvent(tx, EventAccountUpdated, a.ID, a); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) CountAccountsByOwner(ownerID int) (int, error) {
+	var n int
+	err := s.db.QueryRow("select count(*) from account where owner_id = $1", ownerID).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStorage) CreateVerificationToken(accountID int, hash string, expiresAt time.Time) error {
+	_, err := s.db.Exec("insert into verification_token (token_hash, account_id, expires_at) values ($1, $2, $3)", hash, accountID, expiresAt)
+	return err
+}
+
+// VerifyAccount consumes the verification token with the given hash and
+// marks its account verified, returning the account id.
+func (s *PostgresStorage) VerifyAccount(hash string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(`
+	delete from verification_token
+	where token_hash = $1 and expires_at > (now() at time zone 'utc')
+	returning account_id`, hash).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("update account set is_verified = true where id = $1", id); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
 }
 
-func (s *PostgresStorage) GetAllAccounts() ([]*Account, error) {
-	rows, err := s.db.Query("select * from account")
+// GetAccountOwners returns the ids of everyone who may operate the account,
+// starting with its primary owner.
+func (s *PostgresStorage) GetAccountOwners(accountID int) ([]int, error) {
+	rows, err := s.db.Query(`
+	select o.owner_id from account_owners o
+	join account a on a.id = o.account_id
+	where o.account_id = $1
+	order by o.owner_id <> a.owner_id, o.owner_id`, accountID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	accounts := make([]*Account, 0)
+	owners := make([]int, 0)
 	for rows.Next() {
-		account, err := scanIntoAccount(rows)
-		if err != nil {
+		var id int
+		if err := rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		accounts = append(accounts, account)
+		owners = append(owners, id)
 	}
-	return accounts, nil
+	return owners, rows.Err()
 }
 
-func scanIntoAccount(rows *sql.Rows) (*Account, error) {
-	a := new(Account)
-	err := rows.Scan(&a.ID, &a.FirstName, &a.LastName, &a.EncryptedPassword, &a.Number, &a.Balance, &a.CreatedAt)
-	return a, err
+func (s *PostgresStorage) IsAccountOwner(accountID, ownerID int) (bool, error) {
+	var ok bool
+	err := s.db.QueryRow("select exists (select 1 from account_owners where account_id = $1 and owner_id = $2)", accountID, ownerID).Scan(&ok)
+	return ok, err
+}
+
+func (s *PostgresStorage) AddAccountOwner(accountID, ownerID int) error {
+	_, err := s.db.Exec("insert into account_owners (account_id, owner_id) values ($1, $2) on conflict do nothing", accountID, ownerID)
+	return err
+}
+
+// RemoveAccountOwner removes a co-owner from the account. The primary owner
+// can't be removed.
+func (s *PostgresStorage) RemoveAccountOwner(accountID, ownerID int) error {
+	res, err := s.db.Exec(`
+	delete from account_owners o using account a
+	where a.id = o.account_id and o.account_id = $1 and o.owner_id = $2 and a.owner_id <> $2`, accountID, ownerID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%d is not a co-owner of account %d", ownerID, accountID)
+	}
+	return nil
+}
+
+// ReserveIdempotencyKey claims key for a request with the given hash. It
+// returns nil when the key was free and the record of the earlier request
+// otherwise. Keys older than ttl are forgotten first.
+func (s *PostgresStorage) ReserveIdempotencyKey(key, requestHash string, ttl time.Duration) (*IdempotencyRecord, error) {
+	if _, err := s.db.Exec("delete from idempotency_key where created_at < $1", time.Now().UTC().Add(-ttl)); err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.Exec(`
+	insert into idempotency_key (key, request_hash, created_at)
+	values ($1, $2, $3)
+	on conflict do nothing`, key, requestHash, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return nil, err
+	}
+
+	rec := &IdempotencyRecord{Key: key}
+	var accountID sql.NullInt64
+	err = s.db.QueryRow("select request_hash, account_id, created_at from idempotency_key where key = $1", key).Scan(&rec.RequestHash, &accountID, &rec.CreatedAt)
+	if err == sql.ErrNoRows {
+		// Expired and deleted by a concurrent reservation in between.
+		return s.ReserveIdempotencyKey(key, requestHash, ttl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec.AccountID = int(accountID.Int64)
+	return rec, nil
+}
+
+func (s *PostgresStorage) CompleteIdempotencyKey(key string, accountID int) error {
+	_, err := s.db.Exec("update idempotency_key set account_id = $1 where key = $2", accountID, key)
+	return err
+}
+
+// ReleaseIdempotencyKey drops a reservation whose request failed, so that
+// the client can retry with the same key.
+func (s *PostgresStorage) ReleaseIdempotencyKey(key string) error {
+	_, err := s.db.Exec("delete from idempotency_key where key = $1 and account_id is null", key)
+	return err
+}
+
+func (s *PostgresStorage) CreateSession(session *Session) error {
+	// Sessions are only kept around for a day after they expire.
+	if _, err := s.db.Exec("delete from session where account_id = $1 and expires_at < $2", session.AccountID, session.CreatedAt.Add(-24*time.Hour)); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`
+	insert into session (id, account_id, created_at, last_used_at, expires_at, user_agent, client_ip)
+	values ($1, $2, $3, $4, $5, $6, $7)`, session.ID, session.AccountID, session.CreatedAt, session.LastUsedAt, session.ExpiresAt, session.UserAgent, session.ClientIP)
+	return err
+}
+
+// sessionTouchInterval is how stale last_used_at may get before
+// TouchSession writes it again, so that most authenticated requests only
+// read the session.
+const sessionTouchInterval = time.Minute
+
+// TouchSession records that the session was used at the given time and
+// reports whether it is still active. last_used_at is only updated once it
+// is older than sessionTouchInterval.
+func (s *PostgresStorage) TouchSession(id string, at time.Time) (bool, error) {
+	var active bool
+	err := s.db.QueryRow(`
+	with active as (
+		select id, last_used_at from session
+		where id = $1 and revoked_at is null and expires_at > $2
+	), touched as (
+		update session set last_used_at = $2
+		where id in (select id from active where last_used_at < $3)
+	)
+	select exists (select 1 from active)`, id, at, at.Add(-sessionTouchInterval)).Scan(&active)
+	return active, err
+}
+
+// GetSessions returns the active sessions of an account, most recently used
+// first.
+func (s *PostgresStorage) GetSessions(accountID int) ([]*Session, error) {
+	rows, err := s.db.Query(`
+	select id, account_id, created_at, last_used_at, expires_at, user_agent, client_ip
+	from session
+	where account_id = $1 and revoked_at is null and expires_at > $2
+	order by last_used_at desc`, accountID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*Session, 0)
+	for rows.Next() {
+		session := new(Session)
+		if err := rows.Scan(&session.ID, &session.AccountID, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &session.UserAgent, &session.ClientIP); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *PostgresStorage) RevokeSession(accountID int, id string) error {
+	res, err := s.db.Exec(`
+	update session set revoked_at = $3
+	where id = $1 and account_id = $2 and revoked_at is null`, id, accountID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: '%s'", ErrSessionNotFound, id)
+	}
+	return nil
+}
+
+// GetAccountsByIDs loads several accounts in a single query. Ids without an
+// account are missing from the result.
+func (s *PostgresStorage) GetAccountsByIDs(ids []int) (map[int]*Account, error) {
+	accounts := make(map[int]*Account, len(ids))
+	if len(ids) == 0 {
+		return accounts, nil
+	}
+
+	ids64 := make([]int64, len(ids))
+	for i, id := range ids {
+		ids64[i] = int64(id)
+	}
+	rows, err := s.replica.Query("select "+accountColumns+" from account where id = any($1)", pq.Array(ids64))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts[account.ID] = account
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// accountQuery selects the accounts matching filter, in id order.
+func accountQuery(filter AccountFilter) *selectQuery {
+	q := newSelect("select " + accountColumns + " from account")
+	if filter.MetadataKey != "" {
+		key := q.arg(filter.MetadataKey)
+		q.where("metadata ? " + key)
+		if filter.MetadataValue != "" {
+			q.where("metadata ->> " + key + " = " + q.arg(filter.MetadataValue))
+		}
+	}
+	if filter.Name != "" {
+		name := q.arg(filter.Name)
+		q.where(fmt.Sprintf("(lower(first_name) = lower(%[1]s) or lower(last_name) = lower(%[1]s) or lower(first_name || ' ' || last_name) = lower(%[1]s))", name))
+	}
+	if filter.MinBalance != nil {
+		q.where("balance >= " + q.arg(*filter.MinBalance))
+	}
+	// created_at leads account_created_at_id_idx, which serves these too.
+	switch from, to := filter.CreatedFrom, filter.CreatedTo; {
+	case !from.IsZero() && !to.IsZero():
+		q.where(fmt.Sprintf("created_at between %s and %s", q.arg(from.UTC()), q.arg(to.UTC())))
+	case !from.IsZero():
+		q.where("created_at >= " + q.arg(from.UTC()))
+	case !to.IsZero():
+		q.where("created_at <= " + q.arg(to.UTC()))
+	}
+	if filter.Limit == 0 {
+		return q.orderBy("id")
+	}
+
+	// Paging by (created_at, id) rather than by offset alone keeps pages
+	// stable while accounts are being created, and cheap however deep
+	// they go, thanks to account_created_at_id_idx.
+	if filter.After != nil {
+		q.where(fmt.Sprintf("(created_at, id) > (%s, %s)", q.arg(filter.After.CreatedAt.UTC()), q.arg(filter.After.ID)))
+	}
+	return q.orderBy("created_at", "id").page(filter.Limit, filter.Offset)
+}
+
+// ExportAccounts calls fn with every account matching filter in id order,
+// reading them one row at a time. It stops at the first error fn returns.
+func (s *PostgresStorage) ExportAccounts(filter AccountFilter, fn func(*Account) error) error {
+	query, args := accountQuery(filter).build()
+	rows, err := s.replica.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(account); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetStats aggregates every account, and the transfers created since the
+// given time. It scans both tables, so callers should cache the result.
+func (s *PostgresStorage) GetStats(since time.Time) (*Stats, error) {
+	stats := &Stats{Since: since}
+	err := s.replica.QueryRow("select count(*), coalesce(sum(balance), 0) from account").Scan(&stats.AccountCount, &stats.TotalBalance)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `select count(*), coalesce(sum(amount), 0), coalesce(sum(fee), 0)
+	from transfer
+	where created_at >= $1 and status = 'completed'`
+	err = s.replica.QueryRow(query, since.UTC()).Scan(&stats.TransferCount, &stats.TransferVolume, &stats.FeesCollected)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// GetSpending sums the amounts the account transferred out in [from, to)
+// by category, either bound being open when zero.
+func (s *PostgresStorage) GetSpending(accountID int, from, to time.Time) ([]*CategorySpending, error) {
+	// Transfers without a category are summed up as uncategorized.
+	q := newSelect("select coalesce(nullif(category, ''), 'uncategorized') spent_on, -sum(amount), count(*) from ledger")
+	q.where("account_id = " + q.arg(accountID))
+	q.where("kind = " + q.arg(LedgerTransferOut))
+	if !from.IsZero() {
+		q.where("created_at >= " + q.arg(from.UTC()))
+	}
+	if !to.IsZero() {
+		q.where("created_at < " + q.arg(to.UTC()))
+	}
+	query, args := q.groupBy("spent_on").orderBy("spent_on").build()
+
+	rows, err := s.replica.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	spending := make([]*CategorySpending, 0)
+	for rows.Next() {
+		c := new(CategorySpending)
+		if err := rows.Scan(&c.Category, &c.Amount, &c.Transfers); err != nil {
+			return nil, err
+		}
+		spending = append(spending, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return spending, nil
+}
+
+func (s *PostgresStorage) GetAccountsByEmail(email string) ([]*Account, error) {
+	rows, err := s.db.Query("select "+accountColumns+" from account where lower(email) = lower($1)", email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*Account, 0)
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (s *PostgresStorage) CreateDeletionToken(accountID int, hash string, expiresAt time.Time) error {
+	_, err := s.db.Exec("insert into account_deletion_token (token_hash, account_id, expires_at) values ($1, $2, $3)", hash, accountID, expiresAt)
+	return err
+}
+
+// ConsumeDeletionToken uses up the deletion token with the given hash,
+// which must have been issued for the account and not have expired.
+func (s *PostgresStorage) ConsumeDeletionToken(accountID int, hash string) error {
+	res, err := s.db.Exec(`
+	delete from account_deletion_token
+	where token_hash = $1 and account_id = $2 and expires_at > (now() at time zone 'utc')`, hash, accountID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (s *PostgresStorage) CreatePasswordResetToken(accountID int, hash string, expiresAt time.Time) error {
+	_, err := s.db.Exec("insert into password_reset_token (token_hash, account_id, expires_at) values ($1, $2, $3)", hash, accountID, expiresAt)
+	return err
+}
+
+// ResetPassword consumes the reset token with the given hash and replaces
+// the password of its account, returning the account id. Every other reset
+// token of the account is invalidated along the way, its sessions revoked
+// and any lockout cleared, since the reset may be taking the account back
+// from someone else.
+func (s *PostgresStorage) ResetPassword(hash, encryptedPassword string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(`
+	delete from password_reset_token
+	where token_hash = $1 and expires_at > (now() at time zone 'utc')
+	returning account_id`, hash).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("delete from password_reset_token where account_id = $1", id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("update account set encrypted_password = $1, failed_logins = 0, locked_until = null where id = $2", encryptedPassword, id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("update session set revoked_at = $2 where account_id = $1 and revoked_at is null", id, time.Now().UTC()); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// ChangePassword stores the new password of the account and revokes all of
+// its sessions but keepSession, along with any pending reset tokens.
+func (s *PostgresStorage) ChangePassword(accountID int, encryptedPassword, keepSession string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("update account set encrypted_password = $1 where id = $2", encryptedPassword, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, accountID)
+	}
+	if _, err := tx.Exec(`
+	update session set revoked_at = $3
+	where account_id = $1 and id <> $2 and revoked_at is null`, accountID, keepSession, time.Now().UTC()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("delete from password_reset_token where account_id = $1", accountID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) GetAllAccounts(filter AccountFilter) ([]*Account, error) {
+	query, args := accountQuery(filter).build()
+	rows, err := s.replica.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*Account, 0)
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// GetTransfers returns the transfers into or out of the account, newest
+// first.
+func (s *PostgresStorage) GetTransfers(accountID int, filter TransferFilter) ([]*Transfer, error) {
+	q := newSelect("select " + transferColumns + " from transfer")
+	id := q.arg(accountID)
+	switch filter.Direction {
+	case DirectionIn:
+		q.where("to_account = " + id)
+	case DirectionOut:
+		q.where("from_account = " + id)
+	default:
+		q.where(fmt.Sprintf("(from_account = %[1]s or to_account = %[1]s)", id))
+	}
+	if !filter.From.IsZero() {
+		q.where("created_at >= " + q.arg(filter.From.UTC()))
+	}
+	if !filter.To.IsZero() {
+		q.where("created_at < " + q.arg(filter.To.UTC()))
+	}
+	query, args := q.orderBy("created_at desc", "id desc").page(filter.Limit, filter.Offset).build()
+
+	rows, err := s.replica.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := make([]*Transfer, 0)
+	for rows.Next() {
+		t, err := scanIntoTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+const transferColumns = "id, from_account, to_account, amount, fee, description, category, created_at, status, failure_reason"
+
+func scanIntoTransfer(row interface{ Scan(...any) error }) (*Transfer, error) {
+	t := new(Transfer)
+	err := row.Scan(&t.ID, &t.FromAccount, &t.ToAccount, &t.Amount, &t.Fee, &t.Description, &t.Category, &t.CreatedAt, &t.Status, &t.FailureReason)
+	return t, err
+}
+
+func (s *PostgresStorage) GetTransfer(id int) (*Transfer, error) {
+	t, err := scanIntoTransfer(s.db.QueryRow("select "+transferColumns+" from transfer where id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w with id: '%d'", ErrTransferNotFound, id)
+	}
+	return t, err
+}
+
+// CreateTransfer moves t.Amount from t.FromAccount to t.ToAccount and
+// debits t.Fee from the source, recording every movement in the ledger.
+// Either all of it happens or none of it does. A transfer turned down for
+// lack of funds is still recorded, as failed, so that it shows in the
+// history of the accounts.
+func (s *PostgresStorage) CreateTransfer(t *Transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := execTransfer(tx, t, s.outbox); err != nil {
+		if errors.Is(err, ErrInsufficientFunds) {
+			tx.Rollback()
+			if ferr := insertFailedTransfer(s.db, t, err.Error()); ferr != nil {
+				log.Printf("error recording failed transfer: %v", ferr)
+			}
+		}
+		return err
+	}
+	return s.commitTransfers(tx, t)
+}
+
+// insertFailedTransfer records t as a transfer that didn't happen, with no
+// ledger entries or balance changes.
+func insertFailedTransfer(db interface {
+	QueryRow(string, ...any) *sql.Row
+}, t *Transfer, reason string) error {
+	t.Status, t.FailureReason = TransferStatusFailed, reason
+	query := `
+	insert into transfer (from_account, to_account, amount, fee, description, category, created_at, status, failure_reason)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	return db.QueryRow(query, t.FromAccount, t.ToAccount, t.Amount, t.Fee, t.Description, t.Category, t.CreatedAt, t.Status, t.FailureReason).Scan(&t.ID)
+}
+
+const scheduledTransferColumns = "id, from_account, to_account, amount, fee, description, category, execute_at, status, failure_reason, transfer_id, created_at, scheduled_by"
+
+func scanIntoScheduledTransfer(row interface{ Scan(...any) error }) (*ScheduledTransfer, error) {
+	st := new(ScheduledTransfer)
+	var transferID, scheduledBy sql.NullInt64
+	err := row.Scan(&st.ID, &st.FromAccount, &st.ToAccount, &st.Amount, &st.Fee, &st.Description, &st.Category, &st.ExecuteAt, &st.Status, &st.FailureReason, &transferID, &st.CreatedAt, &scheduledBy)
+	if transferID.Valid {
+		id := int(transferID.Int64)
+		st.TransferID = &id
+	}
+	// Scheduled by an instance that predates the column.
+	st.ScheduledBy = st.FromAccount
+	if scheduledBy.Valid {
+		st.ScheduledBy = int(scheduledBy.Int64)
+	}
+	return st, err
+}
+
+func (s *PostgresStorage) CreateScheduledTransfer(st *ScheduledTransfer) error {
+	query := `
+	insert into scheduled_transfers (from_account, to_account, amount, fee, description, category, execute_at, status, created_at, scheduled_by)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`
+
+	return s.db.QueryRow(query, st.FromAccount, st.ToAccount, st.Amount, st.Fee, st.Description, st.Category, st.ExecuteAt, st.Status, st.CreatedAt, st.ScheduledBy).Scan(&st.ID)
+}
+
+func (s *PostgresStorage) GetScheduledTransfer(id int) (*ScheduledTransfer, error) {
+	st, err := scanIntoScheduledTransfer(s.db.QueryRow("select "+scheduledTransferColumns+" from scheduled_transfers where id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w with id: '%d'", ErrScheduledTransferNotFound, id)
+	}
+	return st, err
+}
+
+// GetPendingScheduledTransfers returns the transfers scheduled out of the
+// account that haven't been made yet, soonest first.
+func (s *PostgresStorage) GetPendingScheduledTransfers(accountID int) ([]*ScheduledTransfer, error) {
+	rows, err := s.db.Query("select "+scheduledTransferColumns+" from scheduled_transfers where from_account = $1 and status = $2 order by execute_at, id", accountID, ScheduledTransferPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := make([]*ScheduledTransfer, 0)
+	for rows.Next() {
+		st, err := scanIntoScheduledTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, st)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+// CancelScheduledTransfer cancels a scheduled transfer that is still
+// pending.
+func (s *PostgresStorage) CancelScheduledTransfer(id int) error {
+	res, err := s.db.Exec("update scheduled_transfers set status = $1 where id = $2 and status = $3", ScheduledTransferCancelled, id, ScheduledTransferPending)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w with id: '%d', or it is no longer pending", ErrScheduledTransferNotFound, id)
+	}
+	return nil
+}
+
+// ExecuteDueScheduledTransfer makes the oldest pending transfer that is due
+// at now, unless check refuses it, and records the outcome on it. The
+// returned transfer is nil when the transfer failed, and both are nil when
+// nothing is due. Rows being executed elsewhere are skipped, so several
+// instances can run schedulers side by side.
+func (s *PostgresStorage) ExecuteDueScheduledTransfer(now time.Time, check ScheduledTransferCheck) (*ScheduledTransfer, *Transfer, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	st, err := scanIntoScheduledTransfer(tx.QueryRow(`
+	select `+scheduledTransferColumns+` from scheduled_transfers
+	where status = $1 and execute_at <= $2
+	order by execute_at, id
+	limit 1
+	for update skip locked`, ScheduledTransferPending, now))
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := &Transfer{
+		FromAccount: st.FromAccount,
+		ToAccount:   st.ToAccount,
+		Amount:      st.Amount,
+		Fee:         st.Fee,
+		Description: st.Description,
+		Category:    st.Category,
+		CreatedAt:   now,
+	}
+	reason, err := check(st)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reason == "" {
+		if _, err := tx.Exec("savepoint scheduled_transfer"); err != nil {
+			return nil, nil, err
+		}
+		if err := execTransfer(tx, t, s.outbox); err != nil {
+			if _, rerr := tx.Exec("rollback to savepoint scheduled_transfer"); rerr != nil {
+				return nil, nil, rerr
+			}
+			reason = err.Error()
+		}
+	}
+	if reason != "" {
+		if err := insertFailedTransfer(tx, t, reason); err != nil {
+			return nil, nil, err
+		}
+		st.Status, st.FailureReason, st.TransferID, t = ScheduledTransferFailed, reason, &t.ID, nil
+	} else {
+		st.Status, st.TransferID = ScheduledTransferDone, &t.ID
+	}
+
+	if _, err := tx.Exec("update scheduled_transfers set status = $1, failure_reason = $2, transfer_id = $3 where id = $4", st.Status, st.FailureReason, st.TransferID, st.ID); err != nil {
+		return nil, nil, err
+	}
+	if t == nil {
+		err = tx.Commit()
+	} else {
+		err = s.commitTransfers(tx, t)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return st, t, nil
+}
+
+// GetBalanceAsOf returns the balance the account had at the given time. It
+// starts from the latest snapshot taken before then and adds the ledger
+// entries booked since; without a snapshot it works back from the current
+// balance instead, which also covers money that predates the ledger.
+func (s *PostgresStorage) GetBalanceAsOf(accountID int, at time.Time) (Money, error) {
+	var (
+		balance Money
+		takenAt time.Time
+	)
+	err := s.replica.QueryRow(`
+	select balance, taken_at from balance_snapshot
+	where account_id = $1 and taken_at <= $2
+	order by taken_at desc limit 1`, accountID, at).Scan(&balance, &takenAt)
+	if err == nil {
+		var booked Money
+		err := s.replica.QueryRow(`
+		select coalesce(sum(amount), 0) from ledger
+		where account_id = $1 and created_at >= $2 and created_at < $3`, accountID, takenAt, at).Scan(&booked)
+		return balance + booked, err
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var later Money
+	err = s.replica.QueryRow(`
+	select a.balance, coalesce(sum(l.amount), 0)
+	from account a left join ledger l on l.account_id = a.id and l.created_at >= $2
+	where a.id = $1
+	group by a.id`, accountID, at).Scan(&balance, &later)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, accountID)
+	}
+	return balance - later, err
+}
+
+// RecordBalanceSnapshots stores the balance every account had at the given
+// time. Snapshots that already exist are left alone.
+func (s *PostgresStorage) RecordBalanceSnapshots(at time.Time) error {
+	_, err := s.db.Exec(`
+	insert into balance_snapshot (account_id, taken_at, balance)
+	select a.id, $1, a.balance - coalesce(sum(l.amount), 0)
+	from account a left join ledger l on l.account_id = a.id and l.created_at >= $1
+	where not exists (select 1 from balance_snapshot b where b.account_id = a.id and b.taken_at = $1)
+	group by a.id
+	on conflict do nothing`, at)
+	return err
+}
+
+// DeleteExpiredTokens deletes the verification, password reset and
+// deletion tokens that expired before now, and the sessions that did a day
+// before, as CreateSession does. It returns how many rows it deleted.
+func (s *PostgresStorage) DeleteExpiredTokens(now time.Time) (int64, error) {
+	var deleted int64
+	for _, q := range []struct {
+		query  string
+		before time.Time
+	}{
+		{"delete from verification_token where expires_at < $1", now},
+		{"delete from password_reset_token where expires_at < $1", now},
+		{"delete from account_deletion_token where expires_at < $1", now},
+		{"delete from session where expires_at < $1", now.Add(-24 * time.Hour)},
+	} {
+		res, err := s.db.Exec(q.query, q.before)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// BatchTransferError reports which transfer of a batch made it fail.
+type BatchTransferError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchTransferError) Error() string {
+	return fmt.Sprintf("transfer %d: %s", e.Index, e.Err)
+}
+
+func (e *BatchTransferError) Unwrap() error {
+	return e.Err
+}
+
+// CreateTransfers executes all transfers in a single database transaction:
+// if any of them fails, none of them is applied and a *BatchTransferError
+// is returned.
+func (s *PostgresStorage) CreateTransfers(transfers []*Transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, t := range transfers {
+		if err := execTransfer(tx, t, s.outbox); err != nil {
+			return &BatchTransferError{Index: i, Err: err}
+		}
+	}
+	return s.commitTransfers(tx, transfers...)
+}
+
+// commitTransfers commits tx, in which transfers were executed, along with
+// their events: as the last statements of tx, as insertEvent requires, or,
+// when events are written asynchronously, queued once tx has committed.
+func (s *PostgresStorage) commitTransfers(tx *sql.Tx, transfers ...*Transfer) error {
+	events := make([]*Event, len(transfers))
+	for i, t := range transfers {
+		payload, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		events[i] = &Event{Type: EventTransferCreated, AccountID: t.FromAccount, Payload: payload}
+	}
+
+	if s.events == nil {
+		for _, e := range events {
+			if err := insertEvent(tx, e.Type, e.AccountID, e.Payload); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, e := range events {
+		s.events.enqueue(e)
+	}
+	return nil
+}
+
+// CreateExternalTransfer debits the source of et and records et for
+// settlement, in one transaction, with its event and webhook message as
+// for a transfer within the bank.
+func (s *PostgresStorage) CreateExternalTransfer(et *ExternalTransfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance, minBalance Money
+	err = tx.QueryRow("select balance, min_balance from account where id = $1 for update", et.FromAccount).Scan(&balance, &minBalance)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, et.FromAccount)
+	}
+	if err != nil {
+		return err
+	}
+	if balance-(et.Amount+et.Fee) < minBalance {
+		return ErrInsufficientFunds
+	}
+	err = tx.QueryRow("update account set balance = balance - $1 where id = $2 returning balance", et.Amount+et.Fee, et.FromAccount).Scan(&et.FromBalance)
+	if err != nil {
+		return balanceCheckError(err)
+	}
+
+	query := `
+	insert into external_transfer (from_account, iban, routing_number, account_number, amount, fee, description, status, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	et.Status = TransferStatusExternalPending
+	d := et.Destination
+	if err := tx.QueryRow(query, et.FromAccount, d.IBAN, d.RoutingNumber, d.AccountNumber, et.Amount, et.Fee, et.Description, et.Status, et.CreatedAt).Scan(&et.ID); err != nil {
+		return err
+	}
+
+	entries := []*LedgerEntry{{AccountID: et.FromAccount, Amount: -et.Amount, Kind: LedgerExternalOut}}
+	if et.Fee > 0 {
+		entries = append(entries, &LedgerEntry{AccountID: et.FromAccount, Amount: -et.Fee, Kind: LedgerFee})
+	}
+	for _, e := range entries {
+		e.ExternalTransferID = et.ID
+		e.Description = et.Description
+		e.CreatedAt = et.CreatedAt
+		if err := insertLedgerEntry(tx, e); err != nil {
+			return err
+		}
+	}
+	if s.outbox {
+		if err := insertOutboxMessage(tx, EventExternalTransferCreated, et); err != nil {
+			return err
+		}
+	}
+
+	if s.events == nil {
+		if err := insertEvent(tx, EventExternalTransferCreated, et.FromAccount, et); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	payload, err := json.Marshal(et)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.events.enqueue(&Event{Type: EventExternalTransferCreated, AccountID: et.FromAccount, Payload: payload})
+	return nil
+}
+
+// balanceCheckError reports a violation of account_balance_check as
+// ErrInsufficientFunds, which is what it means.
+func balanceCheckError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23514" && pqErr.Constraint == "account_balance_check" {
+		return fmt.Errorf("%w: balance would drop below the minimum balance", ErrInsufficientFunds)
+	}
+	return err
+}
+
+// execTransfer moves the money of t within tx. With outbox set it also
+// queues the transfer for webhook delivery. Its event is left to
+// commitTransfers. The balances, the transfer and its ledger entries are
+// all written in tx, so that an error in any of them, returned to the
+// caller to roll tx back, leaves no trace of the transfer.
+func execTransfer(tx *sql.Tx, t *Transfer, outbox bool) error {
+	if t.FromAccount == t.ToAccount {
+		return ErrSelfTransfer
+	}
+
+	var balance, minBalance Money
+	for _, id := range lockOrder(t.FromAccount, t.ToAccount) {
+		var b, mb Money
+		err := tx.QueryRow("select balance, min_balance from account where id = $1 for update", id).Scan(&b, &mb)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, id)
+		}
+		if err != nil {
+			return err
+		}
+		if id == t.FromAccount {
+			balance, minBalance = b, mb
+		}
+	}
+	if balance-(t.Amount+t.Fee) < minBalance {
+		return ErrInsufficientFunds
+	}
+
+	err := tx.QueryRow("update account set balance = balance + $1 where id = $2 returning balance", t.Amount, t.ToAccount).Scan(&t.ToBalance)
+	if err != nil {
+		return balanceCheckError(err)
+	}
+	err = tx.QueryRow("update account set balance = balance - $1 where id = $2 returning balance", t.Amount+t.Fee, t.FromAccount).Scan(&t.FromBalance)
+	if err != nil {
+		return balanceCheckError(err)
+	}
+
+	query := `
+	insert into transfer (from_account, to_account, amount, fee, description, category, created_at, status)
+	values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+	t.Status = TransferStatusCompleted
+	if err := tx.QueryRow(query, t.FromAccount, t.ToAccount, t.Amount, t.Fee, t.Description, t.Category, t.CreatedAt, t.Status).Scan(&t.ID); err != nil {
+		return err
+	}
+
+	// The category goes on the transferred amount only; the fee isn't
+	// spending on anything the sender chose.
+	entries := []*LedgerEntry{
+		{AccountID: t.FromAccount, Amount: -t.Amount, Kind: LedgerTransferOut, Category: t.Category},
+		{AccountID: t.ToAccount, Amount: t.Amount, Kind: LedgerTransferIn, Category: t.Category},
+	}
+	if t.Fee > 0 {
+		entries = append(entries, &LedgerEntry{AccountID: t.FromAccount, Amount: -t.Fee, Kind: LedgerFee})
+	}
+	for _, e := range entries {
+		e.TransferID = t.ID
+		e.Description = t.Description
+		e.CreatedAt = t.CreatedAt
+		if err := insertLedgerEntry(tx, e); err != nil {
+			return err
+		}
+	}
+	if outbox {
+		if err := insertOutboxMessage(tx, EventTransferCreated, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockOrder returns the accounts of a transfer in the order their rows must
+// be locked. Always locking the lower id first means two opposite transfers
+// between the same accounts queue up instead of deadlocking.
+func lockOrder(from, to int) []int {
+	if from < to {
+		return []int{from, to}
+	}
+	return []int{to, from}
+}
+
+// eventLockKey identifies the advisory lock serializing event inserts.
+const eventLockKey = 727001
+
+// insertEvent appends an event to the stream. It takes the transaction of
+// the change it describes so that consumers never see an event for a change
+// that was rolled back, nor miss one that was committed. It must be the last
+// statement of that transaction: the lock it takes, held until commit, makes
+// event ids become visible in order, so a consumer polling with ?since= can
+// never skip an event committed after a later one.
+func insertEvent(tx *sql.Tx, typ string, accountID int, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("select pg_advisory_xact_lock($1)", eventLockKey); err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into event (type, account_id, payload) values ($1, $2, $3)", typ, accountID, b)
+	return err
+}
+
+// writeEvent inserts an event queued by an eventQueue in a transaction of
+// its own.
+func (s *PostgresStorage) writeEvent(e *Event) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertEvent(tx, e.Type, e.AccountID, e.Payload); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertOutboxMessage queues a webhook message within the transaction making
+// the change it reports, so that it is delivered if and only if the change
+// is committed.
+func insertOutboxMessage(tx *sql.Tx, typ string, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into outbox (type, payload, next_attempt_at) values ($1, $2, now() at time zone 'utc')", typ, b)
+	return err
+}
+
+// ClaimOutboxMessages returns up to limit messages due for delivery at now,
+// oldest first, and leases them until leaseUntil: if the dispatcher dies
+// before marking them, they are picked up again once the lease runs out.
+// Concurrent dispatchers skip each other's messages.
+func (s *PostgresStorage) ClaimOutboxMessages(now, leaseUntil time.Time, limit int) ([]*OutboxMessage, error) {
+	query := `update outbox set next_attempt_at = $2, attempts = attempts + 1
+	where id in (
+		select id from outbox
+		where sent_at is null and next_attempt_at <= $1
+		order by id
+		limit $3
+		for update skip locked
+	)
+	returning id, type, payload, created_at, attempts`
+
+	rows, err := s.db.Query(query, now, leaseUntil, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]*OutboxMessage, 0)
+	for rows.Next() {
+		m := new(OutboxMessage)
+		var payload []byte
+		if err := rows.Scan(&m.ID, &m.Type, &payload, &m.CreatedAt, &m.Attempts); err != nil {
+			return nil, err
+		}
+		m.Payload = payload
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+func (s *PostgresStorage) MarkOutboxMessageSent(id int64, at time.Time) error {
+	_, err := s.db.Exec("update outbox set sent_at = $1, last_error = '' where id = $2", at, id)
+	return err
+}
+
+// MarkOutboxMessageFailed records a failed delivery, to be retried at
+// nextAttempt, or never again when it is nil.
+func (s *PostgresStorage) MarkOutboxMessageFailed(id int64, nextAttempt *time.Time, reason string) error {
+	_, err := s.db.Exec("update outbox set next_attempt_at = $1, last_error = $2 where id = $3", nextAttempt, reason, id)
+	return err
+}
+
+func (s *PostgresStorage) GetEvents(since int64, limit int) ([]*Event, error) {
+	rows, err := s.db.Query("select id, type, account_id, payload, created_at from event where id > $1 order by id limit $2", since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*Event, 0)
+	for rows.Next() {
+		e := new(Event)
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.Type, &e.AccountID, &payload, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Payload = payload
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func insertLedgerEntry(tx *sql.Tx, e *LedgerEntry) error {
+	query := `
+	insert into ledger (account_id, transfer_id, external_transfer_id, amount, kind, description, category, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	// Entries that aren't part of a transfer, like opening balances, have
+	// no transfer id.
+	var transferID, externalTransferID *int
+	if e.TransferID != 0 {
+		transferID = &e.TransferID
+	}
+	if e.ExternalTransferID != 0 {
+		externalTransferID = &e.ExternalTransferID
+	}
+	return tx.QueryRow(query, e.AccountID, transferID, externalTransferID, e.Amount, e.Kind, e.Description, e.Category, e.CreatedAt).Scan(&e.ID)
+}
+
+func scanIntoAccount(rows *sql.Rows) (*Account, error) {
+	a := new(Account)
+	var (
+		metadata    []byte
+		ownerID     sql.NullInt64
+		maxAccounts sql.NullInt64
+		lastLogin   sql.NullTime
+		lockedUntil sql.NullTime
+	)
+	err := rows.Scan(&a.ID, &a.FirstName, &a.LastName, &a.EncryptedPassword, &a.Number, &a.Balance, &a.CreatedAt, &a.MinBalance, &metadata, &ownerID, &maxAccounts, &a.Email, &a.Verified, &lastLogin, &lockedUntil, &a.Version, &a.Nickname)
+	if err != nil {
+		return nil, err
+	}
+	if lastLogin.Valid {
+		a.LastLoginAt = &lastLogin.Time
+	}
+	if lockedUntil.Valid {
+		a.LockedUntil = &lockedUntil.Time
+	}
+	a.OwnerID = a.ID
+	if ownerID.Valid {
+		a.OwnerID = int(ownerID.Int64)
+	}
+	if maxAccounts.Valid {
+		n := int(maxAccounts.Int64)
+		a.MaxAccounts = &n
+	}
+	if err := json.Unmarshal(metadata, &a.Metadata); err != nil {
+		return nil, err
+	}
+	if len(a.Metadata) == 0 {
+		a.Metadata = nil
+	}
+	return a, nil
+}
+
+func encodeMetadata(metadata map[string]string) ([]byte, error) {
+	if metadata == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(metadata)
 }
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestStorage connects to the database named by GOBANK_TEST_DSN, skipping
+// the test when it isn't set.
+func newTestStorage(t testing.TB) *PostgresStorage {
+	t.Helper()
+
+	dsn := os.Getenv("GOBANK_TEST_DSN")
+	if dsn == "" {
+		t.Skip("GOBANK_TEST_DSN not set")
+	}
+
+	s, err := openPostgresStorage(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStorageReleasesConnections(t *testing.T) {
+	s := newTestStorage(t)
+	s.db.SetMaxIdleConns(2)
+
+	for i := 0; i < 50; i++ {
+		acc, err := NewAccount("a", "b", "testPass")
+		assert.Nil(t, err)
+		assert.Nil(t, s.CreateAccount(acc))
+
+		_, err = s.GetAllAccounts(AccountFilter{})
+		assert.Nil(t, err)
+		_, err = s.GetAccountByNumber(int(acc.Number))
+		assert.Nil(t, err)
+	}
+
+	assert.LessOrEqual(t, s.db.Stats().OpenConnections, 2)
+}
+
+// BenchmarkGetAccountByID measures the prepared lookup against the same
+// query parsed on every call:
+//
+//	GOBANK_TEST_DSN=... go test -run - -bench GetAccountByID
+func BenchmarkGetAccountByID(b *testing.B) {
+	s := newTestStorage(b)
+	acc, err := NewAccount("a", "b", "testPass")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := s.CreateAccount(acc); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.GetAccountByID(acc.ID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unprepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rows, err := s.replica.Query(getAccountByIDQuery, acc.ID)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for rows.Next() {
+				if _, err := scanIntoAccount(rows); err != nil {
+					b.Fatal(err)
+				}
+			}
+			rows.Close()
+		}
+	})
+}
+
+func TestLockOrder(t *testing.T) {
+	assert.Equal(t, []int{3, 7}, lockOrder(3, 7))
+	assert.Equal(t, []int{3, 7}, lockOrder(7, 3), "opposite transfers lock in the same order")
+}
+
+func TestExecTransferRejectsSelfTransfer(t *testing.T) {
+	// The check happens before the transaction is touched.
+	err := execTransfer(nil, &Transfer{FromAccount: 4, ToAccount: 4, Amount: 10}, false)
+	assert.ErrorIs(t, err, ErrSelfTransfer)
+}
+
+func TestCreateAccountRecordsOpeningBalance(t *testing.T) {
+	s := newTestStorage(t)
+
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	acc.Balance = 500
+	assert.Nil(t, s.CreateAccount(acc))
+
+	var amount Money
+	var kind string
+	err = s.db.QueryRow("select amount, kind from ledger where account_id = $1", acc.ID).Scan(&amount, &kind)
+	assert.Nil(t, err)
+	assert.Equal(t, Money(500), amount)
+	assert.Equal(t, LedgerOpeningBalance, kind)
+}
+
+func TestGetBalanceDiscrepancies(t *testing.T) {
+	s := newTestStorage(t)
+
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	acc.Balance = 500
+	assert.Nil(t, s.CreateAccount(acc))
+
+	discrepancies, err := s.GetBalanceDiscrepancies()
+	assert.Nil(t, err)
+	for _, d := range discrepancies {
+		assert.NotEqual(t, acc.ID, d.AccountID, "the opening balance is in the ledger")
+	}
+
+	_, err = s.db.Exec("update account set balance = balance + 1 where id = $1", acc.ID)
+	assert.Nil(t, err)
+	discrepancies, err = s.GetBalanceDiscrepancies()
+	assert.Nil(t, err)
+	found := false
+	for _, d := range discrepancies {
+		if d.AccountID == acc.ID {
+			found = true
+			assert.Equal(t, Money(1), d.Difference)
+		}
+	}
+	assert.True(t, found, "a balance changed outside the ledger is reported")
+}
+
+func TestCreateAccountRecordsAudit(t *testing.T) {
+	s := newTestStorage(t)
+
+	admin := int64(1001)
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	acc.audit = &AuditEntry{Action: AuditActionAccountCreated, SourceIP: "203.0.113.7", UserAgent: "curl/8.0", AdminNumber: &admin}
+	assert.Nil(t, s.CreateAccount(acc))
+
+	entries, err := s.GetAuditLog(AuditFilter{AccountID: acc.ID})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "203.0.113.7", entries[0].SourceIP)
+		assert.Equal(t, "curl/8.0", entries[0].UserAgent)
+		assert.Equal(t, &admin, entries[0].AdminNumber)
+	}
+}
+
+func TestBalanceCheckConstraint(t *testing.T) {
+	s := newTestStorage(t)
+
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	acc.Balance = 500
+	assert.Nil(t, s.CreateAccount(acc))
+
+	_, err = s.db.Exec("update account set balance = -1 where id = $1", acc.ID)
+	assert.ErrorIs(t, balanceCheckError(err), ErrInsufficientFunds)
+
+	acc.MinBalance = 600
+	assert.ErrorIs(t, s.UpdateAccount(acc), ErrInsufficientFunds)
+}
+
+func TestDatabaseDSN(t *testing.T) {
+	cfg := &Config{
+		DBHost:     "db.internal",
+		DBPort:     "5432",
+		DBUser:     "gobank",
+		DBPassword: "p@ss:w/rd? #%'",
+		DBName:     "bank",
+		DBSSLMode:  "disable",
+		DBSchema:   "tenant_a",
+	}
+	dsn := cfg.DatabaseDSN()
+
+	u, err := url.Parse(dsn)
+	if assert.Nil(t, err) {
+		password, _ := u.User.Password()
+		assert.Equal(t, cfg.DBPassword, password)
+		assert.Equal(t, "db.internal:5432", u.Host)
+		assert.Equal(t, "/bank", u.Path)
+		assert.Equal(t, "tenant_a", u.Query().Get("search_path"))
+	}
+	conninfo, err := pq.ParseURL(dsn)
+	assert.Nil(t, err)
+	assert.Contains(t, conninfo, `password='p@ss:w/rd? #%\''`)
+}
+
+func TestWithSearchPath(t *testing.T) {
+	assert.Equal(t, "host=db", withSearchPath("host=db", ""))
+	assert.Equal(t, "host=db search_path=tenant_a", withSearchPath("host=db", "tenant_a"))
+	assert.Equal(t, "postgres://u@db/bank?search_path=tenant_a&sslmode=disable", withSearchPath("postgres://u@db/bank?sslmode=disable", "tenant_a"))
+}
+
+func TestSchemaName(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"tenant_a":            true,
+		"_bank2":              true,
+		"Tenant":              false,
+		"2bank":               false,
+		"bank; drop table x":  false,
+		`bank" cascade --`:    false,
+		"a_very_long_name_xx": true,
+	} {
+		assert.Equal(t, ok, schemaName.MatchString(name), name)
+	}
+}
+
+func TestGetAccountNotFound(t *testing.T) {
+	s := newTestStorage(t)
+
+	_, err := s.GetAccountByID(-1)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+	_, err = s.GetAccountByNumber(-1)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+}
+
+func TestChangeAccountNumber(t *testing.T) {
+	s := newTestStorage(t)
+
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CreateAccount(acc))
+	other, err := NewAccount("c", "d", "testPass")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CreateAccount(other))
+
+	_, err = s.ChangeAccountNumber(acc.ID, other.Number)
+	assert.ErrorIs(t, err, ErrNumberTaken, "another account's number")
+
+	old := acc.Number
+	change, err := s.ChangeAccountNumber(acc.ID, old+1_000_000_007)
+	assert.Nil(t, err)
+	assert.Equal(t, old, change.OldNumber)
+
+	found, former, err := s.GetAccountByAnyNumber(old)
+	assert.Nil(t, err)
+	assert.True(t, former)
+	assert.Equal(t, acc.ID, found.ID)
+	assert.Equal(t, change.NewNumber, found.Number)
+
+	_, err = s.ChangeAccountNumber(other.ID, old)
+	assert.ErrorIs(t, err, ErrNumberTaken, "a number that was replaced")
+	_, err = s.ChangeAccountNumber(-1, old+1)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+}
+
+func TestUpdateAccountVersion(t *testing.T) {
+	s := newTestStorage(t)
+
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CreateAccount(acc))
+	assert.Equal(t, 1, acc.Version)
+
+	stale := *acc
+	acc.FirstName = "c"
+	assert.Nil(t, s.UpdateAccount(acc))
+	assert.Equal(t, 2, acc.Version)
+
+	stale.FirstName = "d"
+	assert.ErrorIs(t, s.UpdateAccount(&stale), ErrVersionConflict)
+	got, err := s.GetAccountByID(acc.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "c", got.FirstName, "a stale write does not clobber the account")
+}
+
+func TestTransferRollsBackOnLedgerError(t *testing.T) {
+	s := newTestStorage(t)
+
+	// Ledger inserts of transfers with this description fail, as if the
+	// ledger write broke after the balances were updated.
+	const failing = "ledger insert fails"
+	_, err := s.db.Exec("alter table ledger add constraint ledger_failure_injected check (description <> '" + failing + "') not valid")
+	assert.Nil(t, err)
+	t.Cleanup(func() { s.db.Exec("alter table ledger drop constraint if exists ledger_failure_injected") })
+
+	from, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	from.Balance = 500
+	assert.Nil(t, s.CreateAccount(from))
+	to, err := NewAccount("c", "d", "testPass")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CreateAccount(to))
+
+	single := &Transfer{FromAccount: from.ID, ToAccount: to.ID, Amount: 100, Description: failing, CreatedAt: time.Now().UTC()}
+	assert.NotNil(t, s.CreateTransfer(single))
+	batch := []*Transfer{
+		{FromAccount: from.ID, ToAccount: to.ID, Amount: 50, CreatedAt: time.Now().UTC()},
+		{FromAccount: from.ID, ToAccount: to.ID, Amount: 100, Description: failing, CreatedAt: time.Now().UTC()},
+	}
+	assert.NotNil(t, s.CreateTransfers(batch))
+
+	for id, want := range map[int]Money{from.ID: 500, to.ID: 0} {
+		acc, err := s.GetAccountByID(id)
+		assert.Nil(t, err)
+		assert.Equal(t, want, acc.Balance, "balance of account %d", id)
+	}
+	var transfers int
+	assert.Nil(t, s.db.QueryRow("select count(*) from transfer where from_account = $1", from.ID).Scan(&transfers))
+	assert.Equal(t, 0, transfers)
+	discrepancies, err := s.GetBalanceDiscrepancies()
+	assert.Nil(t, err)
+	for _, d := range discrepancies {
+		assert.NotContains(t, []int{from.ID, to.ID}, d.AccountID)
+	}
+}
+
+func TestDeleteExpiredTokens(t *testing.T) {
+	s := newTestStorage(t)
+
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CreateAccount(acc))
+
+	now := time.Now().UTC()
+	assert.Nil(t, s.CreateVerificationToken(acc.ID, "expired-verification", now.Add(-time.Minute)))
+	assert.Nil(t, s.CreatePasswordResetToken(acc.ID, "expired-reset", now.Add(-time.Minute)))
+	assert.Nil(t, s.CreateVerificationToken(acc.ID, "live-verification", now.Add(time.Hour)))
+
+	deleted, err := s.DeleteExpiredTokens(now)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, deleted, int64(2))
+
+	var left int
+	assert.Nil(t, s.db.QueryRow("select count(*) from verification_token where account_id = $1", acc.ID).Scan(&left))
+	assert.Equal(t, 1, left, "tokens that haven't expired are kept")
+}
+
+func TestResetPasswordRevokesSessions(t *testing.T) {
+	s := newTestStorage(t)
+
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CreateAccount(acc))
+	now := time.Now().UTC()
+	session := &Session{ID: fmt.Sprintf("reset-%d", acc.ID), AccountID: acc.ID, CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.Nil(t, s.CreateSession(session))
+	locked, err := s.RecordFailedLogin(acc.ID, 1, now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, locked)
+
+	assert.Nil(t, s.CreatePasswordResetToken(acc.ID, "reset-token", now.Add(time.Hour)))
+	id, err := s.ResetPassword("reset-token", acc.EncryptedPassword)
+	assert.Nil(t, err)
+	assert.Equal(t, acc.ID, id)
+
+	active, err := s.TouchSession(session.ID, now)
+	assert.Nil(t, err)
+	assert.False(t, active, "the session was revoked")
+	got, err := s.GetAccountByID(acc.ID)
+	assert.Nil(t, err)
+	assert.False(t, got.Locked(now), "the lockout was cleared")
+}
+
+func TestCreateExternalTransferRecordsEvent(t *testing.T) {
+	s := newTestStorage(t)
+
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	acc.Balance = 1000
+	assert.Nil(t, s.CreateAccount(acc))
+	var last int64
+	assert.Nil(t, s.db.QueryRow("select coalesce(max(id), 0) from event").Scan(&last))
+
+	et := &ExternalTransfer{
+		FromAccount: acc.ID,
+		Destination: ExternalDestination{IBAN: "GB82WEST12345698765432"},
+		Amount:      100,
+		Status:      TransferStatusExternalPending,
+		CreatedAt:   time.Now().UTC(),
+	}
+	assert.Nil(t, s.CreateExternalTransfer(et))
+
+	events, err := s.GetEvents(last, 10)
+	assert.Nil(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, EventExternalTransferCreated, events[0].Type)
+		assert.Equal(t, acc.ID, events[0].AccountID)
+	}
+	var linked int
+	assert.Nil(t, s.db.QueryRow("select count(*) from ledger where external_transfer_id = $1", et.ID).Scan(&linked))
+	assert.Equal(t, 1, linked)
+}
+
+func TestTouchSessionThrottlesWrites(t *testing.T) {
+	s := newTestStorage(t)
+
+	acc, err := NewAccount("a", "b", "testPass")
+	assert.Nil(t, err)
+	assert.Nil(t, s.CreateAccount(acc))
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	session := &Session{ID: fmt.Sprintf("touch-%d", acc.ID), AccountID: acc.ID, CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.Nil(t, s.CreateSession(session))
+
+	lastUsed := func() time.Time {
+		var at time.Time
+		assert.Nil(t, s.db.QueryRow("select last_used_at from session where id = $1", session.ID).Scan(&at))
+		return at.UTC()
+	}
+
+	active, err := s.TouchSession(session.ID, now.Add(time.Second))
+	assert.Nil(t, err)
+	assert.True(t, active)
+	assert.True(t, now.Equal(lastUsed()), "used again within the interval")
+
+	later := now.Add(sessionTouchInterval + time.Second)
+	active, err = s.TouchSession(session.ID, later)
+	assert.Nil(t, err)
+	assert.True(t, active)
+	assert.True(t, later.Equal(lastUsed()))
+
+	active, err = s.TouchSession("no-such-session", now)
+	assert.Nil(t, err)
+	assert.False(t, active)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const streamHeartbeat = 15 * time.Second
+
+// withQueryToken lets a streaming route take its JWT from ?token= as well,
+// since EventSource can't set headers. Only streaming routes accept it: a
+// token in the URL ends up in proxy logs and browser history, which is a
+// price worth paying only where there is no other way. The token is moved
+// into the Authorization header and dropped from the URL, so nothing past
+// this point sees it there.
+//
+// withSessions has already run by the time the router gets here and found
+// no token, so the session is checked again with the header in place.
+func (s *APIServer) withQueryToken(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	withSession := s.withSessions(handlerFunc)
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		token := q.Get("token")
+		if token == "" {
+			handlerFunc(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		q.Del("token")
+		r.URL.RawQuery = q.Encode()
+		if tokenFromRequest(r) != "" {
+			// A header wins, and was checked already.
+			handlerFunc(w, r)
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		withSession.ServeHTTP(w, r)
+	}
+}
+
+// handleAccountStream pushes the account's balance as server-sent events:
+// once when the client connects and again whenever it changes.
+func (s *APIServer) handleAccountStream(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return withStatus(http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+	}
+
+	// Subscribe before reading the current balance so that no change can
+	// slip in between the two.
+	updates, unsubscribe := s.balances.Subscribe(id)
+	defer unsubscribe()
+
+	account, err := s.storage.GetAccountByID(id)
+	if err != nil {
+		return accountLookupError(err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(u BalanceUpdate) error {
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: balance\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	// From here on the response has started, so errors can no longer be
+	// reported to the client: they just end the stream.
+	if err := send(BalanceUpdate{AccountID: id, Balance: account.Balance, UpdatedAt: time.Now().UTC()}); err != nil {
+		return nil
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case u := <-updates:
+			if err := send(u); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// publishTransfer notifies the subscribers of both accounts of a completed
+// transfer of their new balances.
+func (s *APIServer) publishTransfer(t *Transfer) {
+	s.balances.Publish(BalanceUpdate{AccountID: t.FromAccount, Balance: t.FromBalance, UpdatedAt: t.CreatedAt})
+	s.balances.Publish(BalanceUpdate{AccountID: t.ToAccount, Balance: t.ToBalance, UpdatedAt: t.CreatedAt})
+}
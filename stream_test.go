@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithQueryToken(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	acc := &Account{ID: 1, Number: 1001}
+	store := &fakeSessionStorage{fakeStorage: newFakeStorage(acc), active: map[string]bool{"live": true}}
+	server := newTestServer(t, store)
+
+	live, err := createJWT(acc, "live", time.Minute)
+	assert.Nil(t, err)
+	revoked, err := createJWT(acc, "revoked", time.Minute)
+	assert.Nil(t, err)
+
+	handler := server.withQueryToken(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.Query().Get("token"), "the token doesn't stay in the URL")
+		if _, err := accountNumberFromToken(r); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"active session", "?token=" + live, http.StatusNoContent},
+		{"revoked session", "?token=" + revoked, http.StatusUnauthorized},
+		{"invalid token", "?token=garbage", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/account/1/stream"+tc.query, nil)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			assert.Equal(t, tc.status, rec.Code)
+		})
+	}
+}
+
+func TestQueryTokenOnlyOnStreams(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	acc := &Account{ID: 1, Number: 1001}
+	server := newTestServer(t, newFakeStorage(acc))
+	token, err := createJWT(acc, "session", time.Minute)
+	assert.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/account/1?token="+token, nil))
+	assert.Contains(t, rec.Body.String(), "permission denied")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routeTimeouts extend the request timeout for routes, by path template,
+// that legitimately run longer. A zero duration means no timeout. /events
+// gets a margin over the longest wait it accepts to answer in.
+var routeTimeouts = map[string]time.Duration{
+	"/account/export":      5 * time.Minute,
+	"/account/import":      5 * time.Minute,
+	"/account/{id}/stream": 0,
+	"/events":              maxEventsWait + 10*time.Second,
+}
+
+// withTimeout gives every request a context that is cancelled after the
+// request timeout, so storage calls made with it are abandoned, and
+// answers 503 Service Unavailable if the handler hasn't responded by then.
+// A handler that already started writing its response is waited for, with
+// its context cancelled, since the status can't be changed anymore and it
+// can't be left writing once the request is over. It's registered on the
+// router, which is what knows the path template of a request.
+func (s *APIServer) withTimeout(next http.Handler) http.Handler {
+	if s.requestTimeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.requestTimeout
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				if d, ok := routeTimeouts[tmpl]; ok && (d == 0 || d > timeout) {
+					timeout = d
+				}
+			}
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, h: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case p := <-panicked:
+			panic(p)
+		case <-ctx.Done():
+			if tw.timeOut() {
+				return
+			}
+			select {
+			case <-done:
+			case p := <-panicked:
+				panic(p)
+			}
+		}
+	})
+}
+
+// timeoutWriter passes writes through until the request times out, and
+// drops them afterwards unless the handler had already started responding.
+// The handler gets headers of its own, copied over once it responds, so
+// that a late handler can't race with the timeout response.
+type timeoutWriter struct {
+	w http.ResponseWriter
+	h http.Header
+
+	mu       sync.Mutex
+	wrote    bool
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+// writeHeader sends the handler's headers and status; tw.mu must be held.
+func (tw *timeoutWriter) writeHeader(status int) {
+	tw.wrote = true
+	dst := tw.w.Header()
+	for k, v := range tw.h {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wrote {
+		return
+	}
+	tw.writeHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wrote {
+		tw.writeHeader(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+// Flush lets streaming handlers flush through the writer.
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.wrote {
+		tw.writeHeader(http.StatusOK)
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// timeOut answers 503 unless the handler already responded, and makes
+// the writer drop whatever the handler writes from now on. It reports
+// whether it answered.
+func (tw *timeoutWriter) timeOut() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wrote {
+		return false
+	}
+	tw.timedOut = true
+	WriteJSON(tw.w, http.StatusServiceUnavailable, ApiError{Error: "request timed out"})
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTimeout(t *testing.T) {
+	server := newTestServer(t, newFakeStorage())
+	server.requestTimeout = 20 * time.Millisecond
+
+	router := mux.NewRouter()
+	router.Use(server.withTimeout)
+	router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.Header().Set("X-Late", "1")
+		WriteJSON(w, http.StatusOK, "late")
+	})
+	router.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusCreated, "ok")
+	})
+	router.HandleFunc("/streaming", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		<-r.Context().Done()
+		w.Write([]byte("done"))
+	})
+	router.HandleFunc("/writing", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("started "))
+		time.Sleep(3 * server.requestTimeout)
+		w.Write([]byte("finished"))
+	})
+	router.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok := r.Context().Deadline()
+		assert.True(t, ok)
+		assert.Greater(t, time.Until(deadline), maxEventsWait)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	router.HandleFunc("/account/{id}/stream", func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Deadline()
+		assert.False(t, ok)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/slow", http.StatusServiceUnavailable, `{"error":"request timed out"}`},
+		{"/fast", http.StatusCreated, `"ok"`},
+		{"/streaming", http.StatusOK, "done"},
+		{"/writing", http.StatusOK, "started finished"},
+		{"/events", http.StatusNoContent, ""},
+		{"/account/1/stream", http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.body, strings.TrimSpace(rec.Body.String()))
+			assert.Empty(t, rec.Header().Get("X-Late"))
+		})
+	}
+}
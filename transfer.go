@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxBatchTransfers = 100
+
+// Error codes reported by the transfer endpoints. A transfer request is
+// checked in the order below and fails with the first check it doesn't
+// pass, so that a request that is wrong in several ways always gets the
+// same answer:
+//
+//	401 unauthenticated       no valid JWT
+//	403 account_not_verified  the caller's account isn't verified
+//	400 invalid_request       the body doesn't validate
+//	404 account_not_found     the source account doesn't exist
+//	403 permission_denied     the caller may not operate the source account
+//	404 account_not_found     the destination account doesn't exist
+//	400 self_transfer         both sides are the same account
+//	422 insufficient_funds    the source would drop below its minimum balance
+//	400 amount_too_large      the amount is over MAX_TRANSFER_AMOUNT
+//
+// Checks added later, such as frozen accounts or transfer limits, slot into
+// this list rather than being appended wherever is convenient: account
+// state right after verification, amount limits right after funds.
+const (
+	CodeUnauthenticated    = "unauthenticated"
+	CodeAccountNotVerified = "account_not_verified"
+	CodeInvalidRequest     = "invalid_request"
+	CodeAccountNotFound    = "account_not_found"
+	CodePermissionDenied   = "permission_denied"
+	CodeSelfTransfer       = "self_transfer"
+	CodeInsufficientFunds  = "insufficient_funds"
+	CodeAmountTooLarge     = "amount_too_large"
+)
+
+// transferError attaches the status and code of the transfer errors
+// returned by storage.
+func transferError(err error) error {
+	switch {
+	case errors.Is(err, ErrAccountNotFound):
+		return withCode(http.StatusNotFound, CodeAccountNotFound, err)
+	case errors.Is(err, ErrSelfTransfer):
+		return withCode(http.StatusBadRequest, CodeSelfTransfer, err)
+	case errors.Is(err, ErrInsufficientFunds):
+		return withCode(http.StatusUnprocessableEntity, CodeInsufficientFunds, err)
+	}
+	return err
+}
+
+type BatchTransferRequest struct {
+	// Atomic requests that either every transfer succeeds or none is applied.
+	Atomic    bool               `json:"atomic"`
+	Transfers []*TransferRequest `json:"transfers"`
+}
+
+type BatchTransferResult struct {
+	Index    int             `json:"index"`
+	Success  bool            `json:"success"`
+	Transfer *TransferResult `json:"transfer,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Code     string          `json:"code,omitempty"`
+}
+
+type BatchTransferResponse struct {
+	Atomic  bool                  `json:"atomic"`
+	Results []BatchTransferResult `json:"results"`
+}
+
+// TransferPreview is what a transfer would come to. Total is what would
+// leave the source account, NetAmount what would reach the destination.
+type TransferPreview struct {
+	Amount       Money  `json:"amount"`
+	Fee          Money  `json:"fee"`
+	Total        Money  `json:"total"`
+	NetAmount    Money  `json:"netAmount"`
+	WouldSucceed bool   `json:"wouldSucceed"`
+	Error        string `json:"error,omitempty"`
+	Code         string `json:"code,omitempty"`
+}
+
+// previewCodes are the failures a preview reports as the transfer not
+// going through, rather than failing itself: those about the transfer, as
+// opposed to the request or the caller.
+var previewCodes = map[string]bool{
+	CodeAccountNotFound:   true,
+	CodeSelfTransfer:      true,
+	CodeInsufficientFunds: true,
+	CodeAmountTooLarge:    true,
+}
+
+// prepareTransfer validates a transfer requested by the owner of the account
+// with the given number and resolves it into one ready to be stored.
+func (s *APIServer) prepareTransfer(number int64, req *TransferRequest) (*Transfer, error) {
+	return s.prepareTransferWith(number, req, nil)
+}
+
+// prepareTransferWith is prepareTransfer with the accounts referenced by id
+// already loaded into known, e.g. by GetAccountsByIDs.
+func (s *APIServer) prepareTransferWith(number int64, req *TransferRequest, known map[int]*Account) (*Transfer, error) {
+	if req.External != nil {
+		// Only POST /transfer handles them; see createExternalTransfer.
+		return nil, withCode(http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("external transfers can only be made one at a time, right away"))
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.validateTransferRequest(req); err != nil {
+		return nil, err
+	}
+
+	from, err := s.resolveAccount(req.FromAccount, req.FromNumber, known)
+	if err != nil {
+		return nil, transferError(fmt.Errorf("invalid source account: %w", err))
+	}
+	if ok, err := canOperate(s.storage, number, from); err != nil || !ok {
+		return nil, withCode(http.StatusForbidden, CodePermissionDenied, fmt.Errorf("permission denied"))
+	}
+	to, err := s.resolveAccount(req.ToAccount, req.ToNumber, known)
+	if err != nil {
+		return nil, transferError(fmt.Errorf("invalid destination account: %w", err))
+	}
+	// The two sides may have been given in different ways, so this can
+	// only be checked once both are resolved.
+	if from.ID == to.ID {
+		return nil, transferError(ErrSelfTransfer)
+	}
+	fee := s.fees.CalculateFee(req)
+	if err := s.checkTransferAmount(from, req.Amount, fee); err != nil {
+		return nil, err
+	}
+
+	return &Transfer{
+		FromAccount: from.ID,
+		ToAccount:   to.ID,
+		Amount:      req.Amount,
+		Fee:         fee,
+		Description: sanitizeDescription(req.Description),
+		Category:    normalizeCategory(req.Category),
+		CreatedAt:   time.Now().UTC(),
+		fromOwner:   from.OwnerID,
+		toOwner:     to.OwnerID,
+	}, nil
+}
+
+// checkTransferAmount enforces MAX_TRANSFER_AMOUNT on a transfer from the
+// account.
+func (s *APIServer) checkTransferAmount(from *Account, amount, fee Money) error {
+	if s.maxTransferAmount == 0 || amount <= s.maxTransferAmount {
+		return nil
+	}
+	// Storage checks the funds of every other transfer under lock; this
+	// one only needs the right error, see the order of the codes.
+	if from.Balance-(amount+fee) < from.MinBalance {
+		return transferError(ErrInsufficientFunds)
+	}
+	return withCode(http.StatusBadRequest, CodeAmountTooLarge, fmt.Errorf("amount exceeds the maximum of %s per transfer", s.maxTransferAmount))
+}
+
+// validateTransferRequest checks what depends on the configuration before
+// either account is looked up: categories outside the allowlist. Account
+// numbers aren't checked against the configured format, which accounts
+// numbered before it was set don't follow; unknown ones aren't found.
+func (s *APIServer) validateTransferRequest(req *TransferRequest) error {
+	var errs fieldErrors
+	if c := normalizeCategory(req.Category); c != "" && !s.categories[c] {
+		errs.add("category", "must be one of %s", strings.Join(s.categoryList, ", "))
+	}
+	return errs.err()
+}
+
+// resolveAccount looks an account up by its number when one is given and by
+// its internal id otherwise. Ids are looked up in known instead when it is
+// non-nil, which is then expected to hold every account that exists.
+func (s *APIServer) resolveAccount(id, number int64, known map[int]*Account) (*Account, error) {
+	switch {
+	case id != 0 && number != 0:
+		return nil, fmt.Errorf("specify either an account id or an account number, not both")
+	case number != 0:
+		return s.storage.GetAccountByNumber(int(number))
+	case id != 0 && known != nil:
+		if account, ok := known[int(id)]; ok {
+			return account, nil
+		}
+		return nil, fmt.Errorf("%w with id: '%d'", ErrAccountNotFound, id)
+	case id != 0:
+		return s.storage.GetAccountByID(int(id))
+	default:
+		return nil, fmt.Errorf("no account specified")
+	}
+}
+
+// handlePreviewTransfer runs the checks of POST /transfer, funds included,
+// and reports the fee and whether the transfer would go through, without
+// making it. Funds can still run out before the transfer is made.
+func (s *APIServer) handlePreviewTransfer(w http.ResponseWriter, r *http.Request) error {
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return withCode(http.StatusUnauthorized, CodeUnauthenticated, fmt.Errorf("permission denied"))
+	}
+	req := new(TransferRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if req.External != nil {
+		return withCode(http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("external transfers can't be previewed"))
+	}
+
+	t, err := s.prepareTransfer(number, req)
+	if err == nil {
+		var from *Account
+		if from, err = s.storage.GetAccountByID(t.FromAccount); err != nil {
+			err = transferError(err)
+		} else if from.Balance-(t.Amount+t.Fee) < from.MinBalance {
+			err = transferError(ErrInsufficientFunds)
+		}
+	}
+
+	fee := s.fees.CalculateFee(req)
+	preview := TransferPreview{Amount: req.Amount, Fee: fee, Total: req.Amount + fee, NetAmount: req.Amount, WouldSucceed: err == nil}
+	if err != nil {
+		var serr *StatusError
+		if !errors.As(err, &serr) || !previewCodes[serr.Code] {
+			return err
+		}
+		preview.Error, preview.Code = serr.Err.Error(), serr.Code
+	}
+	return WriteJSON(w, http.StatusOK, preview)
+}
+
+// handleAccountTransfer is /transfer from the account in the path, which
+// withJWTAuth already checked the caller may operate on, so that the body
+// only names the destination and the amount.
+func (s *APIServer) handleAccountTransfer(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	req := new(TransferRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if req.FromAccount != 0 || req.FromNumber != 0 {
+		return &ValidationError{Fields: []FieldError{{Field: "fromAccount", Message: "must not be set, the source is the account in the path"}}}
+	}
+	req.FromAccount = int64(id)
+	return s.createTransfer(w, r, req)
+}
+
+// handleGetTransfer returns a transfer with its status, for clients that
+// poll. Only the owners of either account and admins may see it; to
+// anybody else it doesn't exist.
+func (s *APIServer) handleGetTransfer(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	loc, err := s.requestLocation(r)
+	if err != nil {
+		return err
+	}
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return withCode(http.StatusUnauthorized, CodeUnauthenticated, fmt.Errorf("permission denied"))
+	}
+
+	t, err := s.storage.GetTransfer(id)
+	if errors.Is(err, ErrTransferNotFound) {
+		return withStatus(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	if !s.admins[number] && !s.isTransferParty(number, t) {
+		return withStatus(http.StatusNotFound, fmt.Errorf("%w with id: '%d'", ErrTransferNotFound, id))
+	}
+
+	t.CreatedAt = t.CreatedAt.In(loc)
+	return WriteJSON(w, http.StatusOK, t)
+}
+
+// isTransferParty reports whether the caller may operate on either account
+// of the transfer.
+func (s *APIServer) isTransferParty(number int64, t *Transfer) bool {
+	for _, id := range []int{t.FromAccount, t.ToAccount} {
+		account, err := s.storage.GetAccountByID(id)
+		if err != nil {
+			continue
+		}
+		if ok, err := canOperate(s.storage, number, account); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *APIServer) handleBatchTransfer(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	req := new(BatchTransferRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	if len(req.Transfers) == 0 {
+		return fmt.Errorf("no transfers provided")
+	}
+	if len(req.Transfers) > maxBatchTransfers {
+		return fmt.Errorf("too many transfers, at most %d are allowed per batch", maxBatchTransfers)
+	}
+
+	number, err := accountNumberFromToken(r)
+	if err != nil {
+		return withCode(http.StatusUnauthorized, CodeUnauthenticated, fmt.Errorf("permission denied"))
+	}
+
+	// Load every account referenced by id in one round trip rather than
+	// two queries per transfer.
+	var ids []int
+	for _, tr := range req.Transfers {
+		for _, id := range []int64{tr.FromAccount, tr.ToAccount} {
+			if id != 0 {
+				ids = append(ids, int(id))
+			}
+		}
+	}
+	known, err := s.storage.GetAccountsByIDs(ids)
+	if err != nil {
+		return err
+	}
+
+	res := BatchTransferResponse{
+		Atomic:  req.Atomic,
+		Results: make([]BatchTransferResult, len(req.Transfers)),
+	}
+	transfers := make([]*Transfer, len(req.Transfers))
+	valid := true
+	for i, tr := range req.Transfers {
+		res.Results[i].Index = i
+		transfers[i], err = s.prepareTransferWith(number, tr, known)
+		if err != nil {
+			res.Results[i].Error = err.Error()
+			res.Results[i].Code = errorCode(err)
+			valid = false
+		}
+	}
+
+	if !req.Atomic {
+		for i, t := range transfers {
+			if t == nil {
+				continue
+			}
+			if err := s.storage.CreateTransfer(t); err != nil {
+				res.Results[i].Error = err.Error()
+				res.Results[i].Code = errorCode(transferError(err))
+				continue
+			}
+			s.publishTransfer(t)
+			res.Results[i].Success = true
+			res.Results[i].Transfer = NewTransferResult(t)
+		}
+		return WriteJSON(w, http.StatusOK, res)
+	}
+
+	if !valid {
+		return WriteJSON(w, http.StatusBadRequest, res)
+	}
+	if err := s.storage.CreateTransfers(transfers); err != nil {
+		var batchErr *BatchTransferError
+		if !errors.As(err, &batchErr) {
+			return err
+		}
+		res.Results[batchErr.Index].Error = batchErr.Err.Error()
+		res.Results[batchErr.Index].Code = errorCode(transferError(batchErr.Err))
+		return WriteJSON(w, http.StatusBadRequest, res)
+	}
+	for i, t := range transfers {
+		s.publishTransfer(t)
+		res.Results[i].Success = true
+		res.Results[i].Transfer = NewTransferResult(t)
+	}
+	return WriteJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareTransferRejectsSelfTransfer(t *testing.T) {
+	acc := &Account{ID: 1, Number: 1001, Balance: 500}
+	s := newTestServer(t, newFakeStorage(acc))
+
+	tests := []struct {
+		name string
+		req  *TransferRequest
+	}{
+		{"by id", &TransferRequest{FromAccount: 1, ToAccount: 1, Amount: 10}},
+		{"by number", &TransferRequest{FromNumber: 1001, ToNumber: 1001, Amount: 10}},
+		{"id and number of the same account", &TransferRequest{FromAccount: 1, ToNumber: 1001, Amount: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.prepareTransfer(acc.Number, tt.req)
+			assert.ErrorIs(t, err, ErrSelfTransfer)
+		})
+	}
+}
+
+func TestPrepareTransferWithKnownAccounts(t *testing.T) {
+	from := &Account{ID: 1, Number: 1001, OwnerID: 1}
+	to := &Account{ID: 2, Number: 1002, OwnerID: 2}
+	// The storage is empty: accounts referenced by id must come from known.
+	s := newTestServer(t, newFakeStorage())
+	known := map[int]*Account{from.ID: from, to.ID: to}
+
+	transfer, err := s.prepareTransferWith(from.Number, &TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 10}, known)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, transfer.ToAccount)
+
+	_, err = s.prepareTransferWith(from.Number, &TransferRequest{FromAccount: 1, ToAccount: 3, Amount: 10}, known)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+}
+
+func TestPrepareTransferNumbersOutsideFormat(t *testing.T) {
+	// Numbered before ACCOUNT_NUMBER_LENGTH was set.
+	from := &Account{ID: 1, Number: 1001, OwnerID: 1, Balance: 500}
+	to := &Account{ID: 2, Number: 1002, OwnerID: 2}
+	s := newTestServer(t, newFakeStorage(from, to))
+	s.numbers = LuhnNumberGenerator{Prefix: "42", Length: 10}
+
+	transfer, err := s.prepareTransfer(from.Number, &TransferRequest{FromNumber: 1001, ToNumber: 1002, Amount: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, transfer.ToAccount)
+
+	_, err = s.prepareTransfer(from.Number, &TransferRequest{FromNumber: 1001, ToNumber: 4200000006, Amount: 10})
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+}
+
+type fakeTransferStorage struct {
+	*fakeStorage
+}
+
+func (s *fakeTransferStorage) CreateTransfer(t *Transfer) error {
+	from := s.accounts[t.FromAccount]
+	if from.Balance-(t.Amount+t.Fee) < from.MinBalance {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+// TestTransferCheckOrder pins down which check a transfer request fails
+// first when it is wrong in several ways; see the transfer error codes.
+func TestTransferCheckOrder(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice := &Account{ID: 1, Number: 1001, OwnerID: 1, Balance: 5000, Verified: true}
+	bob := &Account{ID: 2, Number: 1002, OwnerID: 2, Balance: 5000, Verified: true}
+	carol := &Account{ID: 3, Number: 1003, OwnerID: 3, Balance: 5000}
+	server := newTestServer(t, &fakeTransferStorage{newFakeStorage(alice, bob, carol)})
+	server.maxTransferAmount = 2000
+	handler := withVerifiedAccount(makeHTTPHandlerFunc(server.handleTransfer), server.storage)
+
+	tests := []struct {
+		name   string
+		caller *Account
+		body   string
+		status int
+		code   string
+	}{
+		{"no token", nil, `{"fromAccount": 1, "toAccount": 2, "amount": 10}`, http.StatusUnauthorized, CodeUnauthenticated},
+		{"no token and invalid body", nil, `{"amount": 0}`, http.StatusUnauthorized, CodeUnauthenticated},
+		{"unverified", carol, `{"fromAccount": 3, "toAccount": 2, "amount": 10}`, http.StatusForbidden, CodeAccountNotVerified},
+		{"unverified and invalid body", carol, `{"amount": 0}`, http.StatusForbidden, CodeAccountNotVerified},
+		{"invalid body", alice, `{"fromAccount": 1, "toAccount": 2, "amount": 0}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"out of range account", alice, `{"fromAccount": 1, "toAccount": 4294967296, "amount": 10}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"invalid body from another's account", alice, `{"fromAccount": 2, "amount": 10}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"unknown source", alice, `{"fromAccount": 9, "toAccount": 2, "amount": 10}`, http.StatusNotFound, CodeAccountNotFound},
+		{"another's account", alice, `{"fromAccount": 2, "toAccount": 1, "amount": 10}`, http.StatusForbidden, CodePermissionDenied},
+		{"another's account to an unknown one", alice, `{"fromAccount": 2, "toAccount": 9, "amount": 10}`, http.StatusForbidden, CodePermissionDenied},
+		{"unknown destination", alice, `{"fromAccount": 1, "toAccount": 9, "amount": 10}`, http.StatusNotFound, CodeAccountNotFound},
+		{"self transfer", alice, `{"fromAccount": 1, "toNumber": 1001, "amount": 10}`, http.StatusBadRequest, CodeSelfTransfer},
+		{"self transfer beyond the balance", alice, `{"fromAccount": 1, "toAccount": 1, "amount": 1000}`, http.StatusBadRequest, CodeSelfTransfer},
+		{"beyond the balance", alice, `{"fromAccount": 1, "toAccount": 2, "amount": 1000}`, http.StatusUnprocessableEntity, CodeInsufficientFunds},
+		{"over the maximum", alice, `{"fromAccount": 1, "toAccount": 2, "amount": 30}`, http.StatusBadRequest, CodeAmountTooLarge},
+		{"valid", alice, `{"fromAccount": 1, "toAccount": 2, "amount": 10}`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/transfer", strings.NewReader(tt.body))
+			if tt.caller != nil {
+				token, err := createJWT(tt.caller, "session", time.Minute)
+				assert.Nil(t, err)
+				req.Header.Set("x-jwt-token", token)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+
+			var apiErr ApiError
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&apiErr))
+			assert.Equal(t, tt.code, apiErr.Code)
+		})
+	}
+}
+
+func TestHandlePreviewTransfer(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice := &Account{ID: 1, Number: 1001, OwnerID: 1, Balance: 5000, Verified: true}
+	bob := &Account{ID: 2, Number: 1002, OwnerID: 2, Balance: 5000, Verified: true}
+	// The storage can't make transfers, so a preview making one would panic.
+	server := newTestServer(t, newFakeStorage(alice, bob))
+	server.fees = NewFeeCalculator(&Config{TransferFeeFlat: 25})
+	server.maxTransferAmount = 4000
+	token, err := createJWT(alice, "session", time.Minute)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{"would succeed", `{"fromAccount": 1, "toAccount": 2, "amount": 10}`, http.StatusOK,
+			`{"amount": 10.00, "fee": 0.25, "total": 10.25, "netAmount": 10.00, "wouldSucceed": true}`},
+		{"fee beyond the balance", `{"fromAccount": 1, "toAccount": 2, "amount": 50}`, http.StatusOK,
+			`{"amount": 50.00, "fee": 0.25, "total": 50.25, "netAmount": 50.00, "wouldSucceed": false, "error": "insufficient funds", "code": "insufficient_funds"}`},
+		{"unknown destination", `{"fromAccount": 1, "toAccount": 9, "amount": 10}`, http.StatusOK, ""},
+		{"invalid body", `{"fromAccount": 1, "toAccount": 2, "amount": 0}`, http.StatusBadRequest, ""},
+		{"another's account", `{"fromAccount": 2, "toAccount": 1, "amount": 10}`, http.StatusForbidden, ""},
+		{"external", `{"fromAccount": 1, "amount": 10, "external": {"iban": "DE89370400440532013000"}}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/transfer/preview", strings.NewReader(tt.body))
+			req.Header.Set("x-jwt-token", token)
+			rec := httptest.NewRecorder()
+			makeHTTPHandlerFunc(server.handlePreviewTransfer)(rec, req)
+			assert.Equal(t, tt.status, rec.Code, rec.Body.String())
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, rec.Body.String())
+			}
+		})
+	}
+	assert.Equal(t, Money(5000), alice.Balance, "nothing was transferred")
+}
+
+func TestHandleAccountTransfer(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice := &Account{ID: 1, Number: 1001, OwnerID: 1, Balance: 5000, Verified: true}
+	bob := &Account{ID: 2, Number: 1002, OwnerID: 2, Balance: 5000, Verified: true}
+	server := newTestServer(t, &fakeTransferStorage{newFakeStorage(alice, bob)})
+	handler := withJWTAuth(makeHTTPHandlerFunc(server.handleAccountTransfer), server.storage)
+	token, err := createJWT(alice, "session", time.Minute)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name  string
+		id    string
+		body  string
+		check func(t *testing.T, rec *httptest.ResponseRecorder)
+	}{
+		{"from the own account", "1", `{"toAccount": 2, "amount": 10}`, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			var result TransferResult
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&result))
+			assert.Equal(t, 1, result.FromAccount)
+			assert.Equal(t, 2, result.ToAccount)
+		}},
+		{"from another's account", "2", `{"toAccount": 1, "amount": 10}`, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			assert.Contains(t, rec.Body.String(), "permission denied")
+		}},
+		{"with a source in the body", "1", `{"fromAccount": 2, "toAccount": 1, "amount": 10}`, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Contains(t, rec.Body.String(), CodeInvalidRequest)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/account/"+tt.id+"/transfer", strings.NewReader(tt.body))
+			req = mux.SetURLVars(req, map[string]string{"id": tt.id})
+			req.Header.Set("x-jwt-token", token)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			tt.check(t, rec)
+		})
+	}
+}
+
+type fakeGetTransferStorage struct {
+	*fakeStorage
+	transfers map[int]*Transfer
+}
+
+func (s *fakeGetTransferStorage) GetTransfer(id int) (*Transfer, error) {
+	t, ok := s.transfers[id]
+	if !ok {
+		return nil, fmt.Errorf("%w with id: '%d'", ErrTransferNotFound, id)
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func TestHandleGetTransfer(t *testing.T) {
+	t.Setenv("JWT_SECRETS", "secret")
+	alice := &Account{ID: 1, Number: 1001, OwnerID: 1}
+	bob := &Account{ID: 2, Number: 1002, OwnerID: 2}
+	carol := &Account{ID: 3, Number: 1003, OwnerID: 3}
+	storage := &fakeGetTransferStorage{newFakeStorage(alice, bob, carol), map[int]*Transfer{
+		7: {ID: 7, FromAccount: 1, ToAccount: 2, Amount: 10, Status: TransferStatusFailed, FailureReason: ErrInsufficientFunds.Error()},
+	}}
+	server := newTestServer(t, storage)
+	handler := withTokenAuth(makeHTTPHandlerFunc(server.handleGetTransfer))
+
+	tests := []struct {
+		name   string
+		caller *Account
+		id     string
+		admin  bool
+		status int
+	}{
+		{"sender", alice, "7", false, http.StatusOK},
+		{"recipient", bob, "7", false, http.StatusOK},
+		{"stranger", carol, "7", false, http.StatusNotFound},
+		{"admin", carol, "7", true, http.StatusOK},
+		{"unknown", alice, "8", false, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.admins = map[int64]bool{carol.Number: tt.admin}
+			token, err := createJWT(tt.caller, "session", time.Minute)
+			assert.Nil(t, err)
+			req := httptest.NewRequest(http.MethodGet, "/transfer/"+tt.id, nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tt.id})
+			req.Header.Set("x-jwt-token", token)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+			if tt.status != http.StatusOK {
+				return
+			}
+			var transfer Transfer
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&transfer))
+			assert.Equal(t, TransferStatusFailed, transfer.Status)
+			assert.Equal(t, ErrInsufficientFunds.Error(), transfer.FailureReason)
+		})
+	}
+}
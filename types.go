@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"math/rand"
+	"strings"
 	"time"
+	"unicode"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -23,41 +27,638 @@ type CreateAccountResponse struct {
 	Token     string `json:"token"`
 }
 
+type BalanceResponse struct {
+	AccountID int       `json:"accountId"`
+	Balance   Money     `json:"balance"`
+	Currency  string    `json:"currency"`
+	AsOf      time.Time `json:"asOf"`
+	// Display is the balance converted to the ?display= currency.
+	Display *DisplayBalance `json:"display,omitempty"`
+}
+
+type DisplayBalance struct {
+	Currency string      `json:"currency"`
+	Amount   json.Number `json:"amount"`
+	Rate     float64     `json:"rate"`
+	RateAt   time.Time   `json:"rateAt"`
+}
+
+type BalancesRequest struct {
+	IDs []int `json:"ids"`
+}
+
+// BalancesResponse maps account ids to their balance. Ids without an
+// account are left out.
+type BalancesResponse struct {
+	Balances map[int]Money `json:"balances"`
+}
+
+// ScheduleTransferRequest asks for a transfer to be made at ExecuteAt.
+type ScheduleTransferRequest struct {
+	TransferRequest
+	ExecuteAt time.Time `json:"executeAt"`
+}
+
+const (
+	ScheduledTransferPending   = "pending"
+	ScheduledTransferDone      = "done"
+	ScheduledTransferFailed    = "failed"
+	ScheduledTransferCancelled = "cancelled"
+)
+
+// ScheduledTransfer is a transfer waiting to be made by the scheduler, or
+// the record of what became of it.
+type ScheduledTransfer struct {
+	ID            int       `json:"id"`
+	FromAccount   int       `json:"fromAccount"`
+	ToAccount     int       `json:"toAccount"`
+	Amount        Money     `json:"amount"`
+	Fee           Money     `json:"fee"`
+	Description   string    `json:"description,omitempty"`
+	Category      string    `json:"category,omitempty"`
+	ExecuteAt     time.Time `json:"executeAt"`
+	Status        string    `json:"status"`
+	FailureReason string    `json:"failureReason,omitempty"`
+	TransferID    *int      `json:"transferId,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	// ScheduledBy is the id of the account whose holder scheduled the
+	// transfer.
+	ScheduledBy int `json:"-"`
+}
+
+// ScheduledTransferCheck decides, when a scheduled transfer is due, whether
+// it may still be made. It returns why not, or an error when it can't tell
+// right now, leaving the transfer pending.
+type ScheduledTransferCheck func(*ScheduledTransfer) (reason string, err error)
+
+// Session is a login: every JWT handed out belongs to one, and revoking the
+// session invalidates the token before it expires.
+type Session struct {
+	ID         string     `json:"id"`
+	AccountID  int        `json:"accountId"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt time.Time  `json:"lastUsedAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	UserAgent  string     `json:"userAgent,omitempty"`
+	ClientIP   string     `json:"clientIp,omitempty"`
+}
+
+// IdempotencyRecord remembers which account a create-account request with a
+// given Idempotency-Key produced. AccountID is 0 while the request is still
+// being processed.
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	AccountID   int
+	CreatedAt   time.Time
+}
+
 type CreateAccountRequest struct {
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
-	Password  string `json:"password"`
+	FirstName string            `json:"firstName"`
+	LastName  string            `json:"lastName"`
+	Password  string            `json:"password"`
+	Email     string            `json:"email"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// UpdateAccountRequest only changes the fields that are present.
+type UpdateAccountRequest struct {
+	FirstName *string           `json:"firstName,omitempty"`
+	LastName  *string           `json:"lastName,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	// Nickname is cleared by an empty one.
+	Nickname *string `json:"nickname,omitempty"`
+}
+
+// AccountFilter narrows down the accounts returned by GetAllAccounts. Zero
+// values don't filter.
+type AccountFilter struct {
+	MetadataKey   string
+	MetadataValue string
+	// Name matches the first name, the last name or both separated by a
+	// space, ignoring case.
+	Name string
+	// MinBalance, when set, leaves out accounts with a lower balance.
+	MinBalance *Money
+	// CreatedFrom and CreatedTo, when set, bound the creation time, both
+	// included.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+
+	// Limit, when set, pages through the accounts by creation time,
+	// skipping Offset of them or starting after the After cursor.
+	Limit  int
+	Offset int
+	After  *AccountCursor
+}
+
+// AccountCursor is the position of an account in a listing paged by
+// creation time; the id breaks ties.
+type AccountCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+// AccountPage is a page of the account listing. NextCursor is empty on the
+// last page.
+type AccountPage struct {
+	// Accounts are *Account or, with their number masked, *MaskedAccount.
+	Accounts   []any  `json:"accounts"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// TransferFilter narrows down the transfers returned by GetTransfers. Zero
+// values don't filter.
+type TransferFilter struct {
+	// Direction is DirectionIn or DirectionOut, relative to the account.
+	Direction string
+	// From and To bound the creation time, To being exclusive.
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Offset int
+}
+
+type TransferHistoryResponse struct {
+	Transfers []*Transfer `json:"transfers"`
+	Limit     int         `json:"limit"`
+	Offset    int         `json:"offset"`
 }
 
+type SetMaxAccountsRequest struct {
+	// MaxAccounts resets the owner to the configured default when nil.
+	MaxAccounts *int `json:"maxAccounts"`
+}
+
+// AddOwnerRequest names an account of the person to add as a co-owner.
+type AddOwnerRequest struct {
+	Number int64 `json:"number"`
+}
+
+type AccountOwnersResponse struct {
+	AccountID int   `json:"accountId"`
+	Owners    []int `json:"owners"`
+}
+
+type SetMinBalanceRequest struct {
+	MinBalance Money `json:"minBalance"`
+}
+
+// TransferRequest identifies each side of the transfer either by account
+// number, which is what users know each other by, or by internal id.
 type TransferRequest struct {
-	ToAccount int64 `json:"toAccount"`
-	Amount    int   `json:"amount"`
+	FromAccount int64  `json:"fromAccount,omitempty"`
+	ToAccount   int64  `json:"toAccount,omitempty"`
+	FromNumber  int64  `json:"fromNumber,omitempty"`
+	ToNumber    int64  `json:"toNumber,omitempty"`
+	Amount      Money  `json:"amount"`
+	Description string `json:"description,omitempty"`
+	// Category is one of the configured spending categories, for budgeting.
+	Category string `json:"category,omitempty"`
+	// External, instead of toAccount or toNumber, sends the money to an
+	// account at another bank.
+	External *ExternalDestination `json:"external,omitempty"`
+}
+
+// ExternalDestination is an account at another bank, given either by IBAN
+// or by US routing and account number.
+type ExternalDestination struct {
+	IBAN          string `json:"iban,omitempty"`
+	RoutingNumber string `json:"routingNumber,omitempty"`
+	AccountNumber string `json:"accountNumber,omitempty"`
+}
+
+// ExternalTransfer is money leaving the bank. The source is debited when it
+// is created, as TransferStatusExternalPending, and the settlement process
+// takes it from there.
+type ExternalTransfer struct {
+	ID          int                 `json:"id"`
+	FromAccount int                 `json:"fromAccount"`
+	Destination ExternalDestination `json:"destination"`
+	Amount      Money               `json:"amount"`
+	Fee         Money               `json:"fee"`
+	Description string              `json:"description,omitempty"`
+	Status      string              `json:"status"`
+	CreatedAt   time.Time           `json:"createdAt"`
+	FromBalance Money               `json:"fromBalance"`
+}
+
+type Transfer struct {
+	ID          int       `json:"id"`
+	FromAccount int       `json:"fromAccount"`
+	ToAccount   int       `json:"toAccount"`
+	Amount      Money     `json:"amount"`
+	Fee         Money     `json:"fee"`
+	Description string    `json:"description,omitempty"`
+	Category    string    `json:"category,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Status is TransferStatusCompleted, or TransferStatusFailed for a
+	// transfer that didn't go through, for FailureReason.
+	Status        string `json:"status"`
+	FailureReason string `json:"failureReason,omitempty"`
+
+	// FromBalance and ToBalance are the balances the transfer left the
+	// accounts with.
+	FromBalance Money `json:"-"`
+	ToBalance   Money `json:"-"`
+
+	fromOwner, toOwner int
+}
+
+const (
+	TransferStatusCompleted = "completed"
+	TransferStatusFailed    = "failed"
+	// TransferStatusExternalPending is an external transfer waiting to be
+	// settled with the other bank.
+	TransferStatusExternalPending = "external_pending"
+)
+
+// TransferResult is what clients get back for a transfer they made.
+type TransferResult struct {
+	TransferID  int       `json:"transferId"`
+	Status      string    `json:"status"`
+	FromAccount int       `json:"fromAccount"`
+	ToAccount   int       `json:"toAccount"`
+	Amount      Money     `json:"amount"`
+	Fee         Money     `json:"fee"`
+	Description string    `json:"description,omitempty"`
+	Category    string    `json:"category,omitempty"`
+	FromBalance Money     `json:"fromBalance"`
+	ToBalance   *Money    `json:"toBalance,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// NewTransferResult describes a completed transfer. The destination balance
+// is only disclosed when both accounts have the same owner: the sender has
+// no business knowing how much money somebody else holds.
+func NewTransferResult(t *Transfer) *TransferResult {
+	res := &TransferResult{
+		TransferID:  t.ID,
+		Status:      t.Status,
+		FromAccount: t.FromAccount,
+		ToAccount:   t.ToAccount,
+		Amount:      t.Amount,
+		Fee:         t.Fee,
+		Description: t.Description,
+		Category:    t.Category,
+		FromBalance: t.FromBalance,
+		Timestamp:   t.CreatedAt,
+	}
+	if t.fromOwner == t.toOwner {
+		toBalance := t.ToBalance
+		res.ToBalance = &toBalance
+	}
+	return res
+}
+
+type LedgerEntry struct {
+	ID          int       `json:"id"`
+	AccountID   int       `json:"accountId"`
+	TransferID  int       `json:"transferId"`
+	Amount      Money     `json:"amount"`
+	Kind        string    `json:"kind"`
+	Description string    `json:"description,omitempty"`
+	Category    string    `json:"category,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// ExternalTransferID links the entries of a transfer to another bank
+	// to its external_transfer row.
+	ExternalTransferID int `json:"externalTransferId,omitempty"`
+}
+
+// BalanceDiscrepancy is an account whose stored balance doesn't match the
+// sum of its ledger entries. Difference is Balance minus LedgerBalance.
+type BalanceDiscrepancy struct {
+	AccountID     int   `json:"accountId"`
+	Number        int64 `json:"number"`
+	Balance       Money `json:"balance"`
+	LedgerBalance Money `json:"ledgerBalance"`
+	Difference    Money `json:"difference"`
+}
+
+type ReconcileResponse struct {
+	Discrepancies []*BalanceDiscrepancy `json:"discrepancies"`
+	CheckedAt     time.Time             `json:"checkedAt"`
+}
+
+// Event records a change to an account or a transfer, in the order the
+// changes were committed.
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	AccountID int             `json:"accountId"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
 }
 
+// AuditActionAccountCreated is the audit action of every account creation,
+// by signing up, by an owner opening another account or by an import.
+const AuditActionAccountCreated = "account.created"
+
+// AuditEntry records who did something to an account, for compliance. It is
+// kept when the account is deleted.
+type AuditEntry struct {
+	ID        int64  `json:"id"`
+	AccountID int    `json:"accountId"`
+	Action    string `json:"action"`
+	SourceIP  string `json:"sourceIp"`
+	UserAgent string `json:"userAgent"`
+	// AdminNumber is the account number of the admin who did it, if one
+	// did.
+	AdminNumber *int64    `json:"adminNumber,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type AuditFilter struct {
+	// AccountID, when set, restricts the log to one account.
+	AccountID int
+	Limit     int
+}
+
+// OutboxMessage is a webhook message waiting to be delivered. It is posted
+// as is; receivers should deduplicate by ID since a message may arrive
+// more than once.
+type OutboxMessage struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Attempts  int             `json:"-"`
+}
+
+const (
+	EventAccountCreated  = "account.created"
+	EventAccountUpdated  = "account.updated"
+	EventAccountDeleted  = "account.deleted"
+	EventTransferCreated = "transfer.created"
+	// EventAccountNumberChanged carries a NumberChange.
+	EventAccountNumberChanged = "account.number_changed"
+	// EventExternalTransferCreated carries an ExternalTransfer.
+	EventExternalTransferCreated = "external_transfer.created"
+)
+
+type ChangeNumberRequest struct {
+	Number int64 `json:"number"`
+}
+
+// NumberChange records that an account was reissued a new number. The old
+// one stays reserved for the account, so that statements carrying it can
+// still be resolved.
+type NumberChange struct {
+	AccountID int       `json:"accountId"`
+	OldNumber int64     `json:"oldNumber"`
+	NewNumber int64     `json:"newNumber"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// NumberLookup is the account an account number belongs or belonged to.
+type NumberLookup struct {
+	Account *Account `json:"account"`
+	// Former is set when the number was replaced by Account.Number.
+	Former bool `json:"former"`
+}
+
+// CategorySpending is what an account spent on one category.
+type CategorySpending struct {
+	Category  string `json:"category"`
+	Amount    Money  `json:"amount"`
+	Transfers int    `json:"transfers"`
+}
+
+type SpendingResponse struct {
+	Categories []*CategorySpending `json:"categories"`
+	Total      Money               `json:"total"`
+}
+
+// LedgerEntry kinds recorded for every balance movement.
+const (
+	LedgerTransferOut = "transfer_out"
+	LedgerTransferIn  = "transfer_in"
+	LedgerFee         = "fee"
+	// LedgerExternalOut books money sent to another bank.
+	LedgerExternalOut = "external_out"
+	// LedgerOpeningBalance books the money an account was created with.
+	LedgerOpeningBalance = "opening_balance"
+)
+
+// Account balances may not drop below MinBalance; a negative MinBalance is
+// the overdraft the account is allowed. Accounts belong to the owner whose
+// id is OwnerID, the id of the account they signed up with. MaxAccounts
+// overrides the configured cap on how many accounts that owner may hold.
+// Account is also what the API returns for an account. Like every other
+// type on the wire its JSON fields are camelCase; optional fields (metadata,
+// maxAccounts) are left out when unset, while fields whose zero value
+// means something, such as a balance or minBalance of 0, are always present.
 type Account struct {
-	ID                int       `json:"id"`
-	FirstName         string    `json:"firstName"`
-	LastName          string    `json:"lastName"`
-	EncryptedPassword string    `json:"-"`
-	Number            int64     `json:"number"`
-	Balance           int64     `json:"balance"`
-	CreatedAt         time.Time `json:"createdAt"`
+	ID        int    `json:"id"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	// Nickname is the owner's own label for the account, such as "Rent",
+	// as opposed to the legal name.
+	Nickname          string            `json:"nickname,omitempty"`
+	EncryptedPassword string            `json:"-"`
+	Number            int64             `json:"number"`
+	Balance           Money             `json:"balance"`
+	MinBalance        Money             `json:"minBalance"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	// Email is only shown to the account holder, by GET /account/me, and
+	// to admins.
+	Email       string    `json:"-"`
+	Verified    bool      `json:"verified"`
+	OwnerID     int       `json:"ownerId"`
+	MaxAccounts *int      `json:"maxAccounts,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Version goes up with every UpdateAccount; it is sent as the ETag.
+	Version int `json:"version"`
+
+	// LastLoginAt is only shown to the account holder, by GET /account/me.
+	LastLoginAt *time.Time `json:"-"`
+	// LockedUntil is set once too many logins in a row failed; logging in
+	// is refused until then.
+	LockedUntil *time.Time `json:"-"`
+
+	// audit, when set, is recorded along with the account when it is
+	// created.
+	audit *AuditEntry
+}
+
+// Locked reports whether logins to the account are refused at now.
+func (a *Account) Locked(now time.Time) bool {
+	return a.LockedUntil != nil && now.Before(*a.LockedUntil)
+}
+
+// MeResponse is the caller's own account, with what only they get to see.
+type MeResponse struct {
+	*Account
+	Email       string     `json:"email,omitempty"`
+	LastLoginAt *time.Time `json:"lastLoginAt,omitempty"`
+}
+
+// AdminAccount is an account as admins see it, email included.
+type AdminAccount struct {
+	*Account
+	Email string `json:"email,omitempty"`
+}
+
+// MaskedAccount is an account with all but the last digits of its number
+// hidden, which is how GET /account/{id} shows it by default.
+type MaskedAccount struct {
+	*Account
+	Number string `json:"number"`
+}
+
+func NewMaskedAccount(account *Account) *MaskedAccount {
+	return &MaskedAccount{Account: account, Number: maskNumber(account.Number)}
 }
 
 func NewAccount(firstName, lastName, password string) (*Account, error) {
-	pwd, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	pwd, err := hashPassword(password)
 	if err != nil {
 		return nil, err
 	}
 	return &Account{
 		FirstName:         firstName,
 		LastName:          lastName,
-		EncryptedPassword: string(pwd),
+		EncryptedPassword: pwd,
 		Number:            int64(rand.Intn(1000000)),
 		CreatedAt:         time.Now().UTC(),
 	}, nil
 }
 
+// Stats are bank-wide aggregates. The transfer figures cover the transfers
+// created since Since.
+type Stats struct {
+	AccountCount   int64     `json:"accountCount"`
+	TotalBalance   Money     `json:"totalBalance"`
+	Since          time.Time `json:"since"`
+	TransferCount  int64     `json:"transferCount"`
+	TransferVolume Money     `json:"transferVolume"`
+	FeesCollected  Money     `json:"feesCollected"`
+	GeneratedAt    time.Time `json:"generatedAt"`
+	// Idempotency is counted by this instance since it started.
+	Idempotency *IdempotencyStats `json:"idempotency,omitempty"`
+}
+
+type IdempotencyStats struct {
+	Reserved  int64 `json:"reserved"`
+	Replays   int64 `json:"replays"`
+	Conflicts int64 `json:"conflicts"`
+}
+
+// AccountOption sets up an account built by NewAccountWithOptions.
+type AccountOption func(*Account) error
+
+// WithBalance opens the account with the given balance.
+func WithBalance(balance Money) AccountOption {
+	return func(a *Account) error {
+		a.Balance = balance
+		return nil
+	}
+}
+
+// WithNumber gives the account a number of the caller's choosing instead of
+// a random one.
+func WithNumber(number int64) AccountOption {
+	return func(a *Account) error {
+		if number <= 0 {
+			return fmt.Errorf("invalid account number: '%d'", number)
+		}
+		a.Number = number
+		return nil
+	}
+}
+
+// WithCurrency states the currency the account's amounts are given in. All
+// accounts are held in the configured currency, so any other is rejected
+// rather than having its amounts silently misread.
+func WithCurrency(code string) AccountOption {
+	return func(a *Account) error {
+		if _, err := currencyExponent(code); err != nil {
+			return err
+		}
+		if code != moneyCurrency {
+			return fmt.Errorf("unsupported currency: '%s', accounts are held in %s", code, moneyCurrency)
+		}
+		return nil
+	}
+}
+
+// NewAccountWithOptions is NewAccount with the options applied in order.
+func NewAccountWithOptions(firstName, lastName, password string, opts ...AccountOption) (*Account, error) {
+	account, err := NewAccount(firstName, lastName, password)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		if err := opt(account); err != nil {
+			return nil, err
+		}
+	}
+	return account, nil
+}
+
+// maxDescriptionLength is the number of characters kept of a transfer
+// description, matching the width of the description columns.
+const maxDescriptionLength = 140
+
+// sanitizeDescription collapses whitespace, drops control characters and
+// truncates the description to maxDescriptionLength characters.
+func sanitizeDescription(desc string) string {
+	desc = strings.Join(strings.FieldsFunc(desc, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+
+	if runes := []rune(desc); len(runes) > maxDescriptionLength {
+		desc = strings.TrimSpace(string(runes[:maxDescriptionLength]))
+	}
+	return desc
+}
+
+// maxMetadataSize bounds the size of an account's metadata once encoded.
+const maxMetadataSize = 4096
+
+func validateMetadata(metadata map[string]string) error {
+	for key := range metadata {
+		if key == "" {
+			return fmt.Errorf("metadata keys must not be empty")
+		}
+	}
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxMetadataSize {
+		return fmt.Errorf("metadata must not exceed %d bytes", maxMetadataSize)
+	}
+	return nil
+}
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores everything past 72 bytes.
+	maxPasswordLength = 72
+)
+
+func validatePassword(pwd string) error {
+	if len(pwd) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+	if len(pwd) > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes long", maxPasswordLength)
+	}
+	return nil
+}
+
+func hashPassword(pwd string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+	return string(b), err
+}
+
 func (a *Account) ValidatePassword(pwd string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(a.EncryptedPassword), []byte(pwd)) == nil
 }
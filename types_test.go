@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,3 +15,55 @@ func TestNewAccount(t *testing.T) {
 
 	fmt.Printf("%+v\n", acc)
 }
+
+func TestNewAccountWithOptions(t *testing.T) {
+	acc, err := NewAccountWithOptions("a", "b", "testPass", WithBalance(1250), WithNumber(4242), WithCurrency("USD"))
+	assert.Nil(t, err)
+	assert.Equal(t, Money(1250), acc.Balance)
+	assert.Equal(t, int64(4242), acc.Number)
+	assert.True(t, acc.ValidatePassword("testPass"))
+
+	_, err = NewAccountWithOptions("a", "b", "testPass", WithNumber(0))
+	assert.NotNil(t, err)
+	_, err = NewAccountWithOptions("a", "b", "testPass", WithCurrency("EUR"))
+	assert.NotNil(t, err, "amounts are held in USD")
+	_, err = NewAccountWithOptions("a", "b", "testPass", WithCurrency("usd"))
+	assert.NotNil(t, err)
+}
+
+func TestSanitizeDescription(t *testing.T) {
+	assert.Equal(t, "rent for june", sanitizeDescription("  rent\tfor \n june\x07 "))
+	assert.Equal(t, maxDescriptionLength, len([]rune(sanitizeDescription(strings.Repeat("é", 500)))))
+}
+
+func TestTransferResultJSON(t *testing.T) {
+	transfer := &Transfer{ID: 7, FromAccount: 1, ToAccount: 2, Amount: 100, Fee: 1, FromBalance: 399, ToBalance: 600, fromOwner: 1, toOwner: 2}
+
+	b, err := json.Marshal(NewTransferResult(transfer))
+	assert.Nil(t, err)
+
+	var fields map[string]any
+	assert.Nil(t, json.Unmarshal(b, &fields))
+	for _, name := range []string{"transferId", "status", "fromAccount", "toAccount", "amount", "fee", "fromBalance", "timestamp"} {
+		assert.Contains(t, fields, name)
+	}
+	assert.NotContains(t, fields, "toBalance", "another owner's balance must not be disclosed")
+
+	transfer.toOwner = transfer.fromOwner
+	assert.Equal(t, Money(600), *NewTransferResult(transfer).ToBalance)
+}
+
+func TestAccountJSON(t *testing.T) {
+	b, err := json.Marshal(&Account{ID: 1, FirstName: "a", LastName: "b", EncryptedPassword: "secret", Number: 1001, Email: "a@example.com"})
+	assert.Nil(t, err)
+
+	var fields map[string]any
+	assert.Nil(t, json.Unmarshal(b, &fields))
+	// These names are part of the API; renaming any of them breaks clients.
+	for _, name := range []string{"id", "firstName", "lastName", "number", "balance", "minBalance", "verified", "ownerId", "createdAt"} {
+		assert.Contains(t, fields, name)
+	}
+	for _, name := range []string{"metadata", "email", "maxAccounts", "encryptedPassword", "EncryptedPassword"} {
+		assert.NotContains(t, fields, name)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxAccountID is the largest account id that fits the integer columns
+// holding them. Numbers are bigint, so any positive number fits.
+const maxAccountID = math.MaxInt32
+
+// maxNameLength matches the width of the first_name and last_name columns.
+const maxNameLength = 50
+
+// maxNicknameLength matches the width of the nickname column, which counts
+// characters rather than bytes.
+const maxNicknameLength = 30
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError reports every field of a request body that failed to
+// validate.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = fmt.Sprintf("%s: %s", f.Field, f.Message)
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+// fieldErrors collects the violations found by a Validate method.
+type fieldErrors []FieldError
+
+func (fe *fieldErrors) add(field, format string, args ...any) {
+	*fe = append(*fe, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (fe *fieldErrors) addErr(field string, err error) {
+	if err != nil {
+		fe.add(field, "%s", err)
+	}
+}
+
+// err returns a *ValidationError holding the violations, or nil if there
+// were none.
+func (fe fieldErrors) err() error {
+	if len(fe) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: fe}
+}
+
+func validateName(errs *fieldErrors, field, name string) {
+	switch {
+	case strings.TrimSpace(name) == "":
+		errs.add(field, "must not be empty")
+	case len(name) > maxNameLength:
+		errs.add(field, "must be at most %d characters long", maxNameLength)
+	}
+}
+
+func (r *CreateAccountRequest) Validate() error {
+	var errs fieldErrors
+	validateName(&errs, "firstName", r.FirstName)
+	validateName(&errs, "lastName", r.LastName)
+	errs.addErr("password", validatePassword(r.Password))
+	if _, err := mail.ParseAddress(r.Email); err != nil {
+		errs.add("email", "invalid email address: '%s'", r.Email)
+	}
+	errs.addErr("metadata", validateMetadata(r.Metadata))
+	return errs.err()
+}
+
+func (r *UpdateAccountRequest) Validate() error {
+	var errs fieldErrors
+	if r.FirstName != nil {
+		validateName(&errs, "firstName", *r.FirstName)
+	}
+	if r.LastName != nil {
+		validateName(&errs, "lastName", *r.LastName)
+	}
+	errs.addErr("metadata", validateMetadata(r.Metadata))
+	if r.Nickname != nil && utf8.RuneCountInString(*r.Nickname) > maxNicknameLength {
+		errs.add("nickname", "must be at most %d characters long", maxNicknameLength)
+	}
+	return errs.err()
+}
+
+func (r *TransferRequest) Validate() error {
+	var errs fieldErrors
+	if r.Amount <= 0 {
+		errs.add("amount", "transfer amount must be positive")
+	}
+	validateAccountRef(&errs, "fromAccount", "fromNumber", r.FromAccount, r.FromNumber)
+	switch {
+	case r.External == nil:
+		validateAccountRef(&errs, "toAccount", "toNumber", r.ToAccount, r.ToNumber)
+	case r.ToAccount != 0 || r.ToNumber != 0:
+		errs.add("external", "specify either toAccount, toNumber or external, not more")
+	default:
+		r.External.validate(&errs)
+	}
+	return errs.err()
+}
+
+// validateAccountRef checks that an account is given either by id or by
+// number, and that it is in range.
+func validateAccountRef(errs *fieldErrors, idField, numberField string, id, number int64) {
+	switch {
+	case id != 0 && number != 0:
+		errs.add(idField, "specify either %s or %s, not both", idField, numberField)
+	case id == 0 && number == 0:
+		errs.add(idField, "%s or %s is required", idField, numberField)
+	case id < 0:
+		errs.add(idField, "must be positive")
+	case number < 0:
+		errs.add(numberField, "must be positive")
+	case id > maxAccountID:
+		errs.add(idField, "must be at most %d", maxAccountID)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func invalidFields(err error) []string {
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		return nil
+	}
+	fields := make([]string, len(verr.Fields))
+	for i, f := range verr.Fields {
+		fields[i] = f.Field
+	}
+	return fields
+}
+
+func TestCreateAccountRequestValidate(t *testing.T) {
+	valid := CreateAccountRequest{FirstName: "a", LastName: "b", Password: "password", Email: "a@example.com"}
+	assert.Nil(t, valid.Validate())
+
+	req := CreateAccountRequest{FirstName: " ", Password: "short", Email: "nope", Metadata: map[string]string{"": "x"}}
+	assert.Equal(t, []string{"firstName", "lastName", "password", "email", "metadata"}, invalidFields(req.Validate()),
+		"every violation is reported at once")
+}
+
+func TestUpdateAccountRequestValidate(t *testing.T) {
+	nickname := strings.Repeat("é", maxNicknameLength)
+	req := UpdateAccountRequest{Nickname: &nickname}
+	assert.Nil(t, req.Validate(), "the length is counted in characters")
+
+	nickname += "x"
+	assert.Equal(t, []string{"nickname"}, invalidFields(req.Validate()))
+}
+
+func TestTransferRequestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		req    TransferRequest
+		fields []string
+	}{
+		{TransferRequest{FromAccount: 1, ToNumber: 1002, Amount: 10}, nil},
+		{TransferRequest{Amount: 0}, []string{"amount", "fromAccount", "toAccount"}},
+		{TransferRequest{FromAccount: 1, FromNumber: 1001, ToAccount: -2, Amount: 10}, []string{"fromAccount", "toAccount"}},
+		{TransferRequest{FromAccount: maxAccountID + 1, ToNumber: 1 << 40, Amount: 10}, []string{"fromAccount"}},
+		{TransferRequest{FromAccount: 1, ToNumber: 1 << 40, Amount: 10}, nil},
+	} {
+		assert.Equal(t, tc.fields, invalidFields(tc.req.Validate()), "%+v", tc.req)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const verificationTokenTTL = 24 * time.Hour
+
+// generateToken returns a random token to hand out and the hash it should be
+// stored as, so that a leaked table doesn't leak usable tokens.
+func generateToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendVerification emails the account holder the link that verifies their
+// account. Failing to send doesn't undo the signup: the error is only logged.
+func (s *APIServer) sendVerification(account *Account) {
+	token, hash, err := generateToken()
+	if err != nil {
+		log.Printf("error generating verification token for account %s: %v", maskNumber(int64(account.ID)), err)
+		return
+	}
+	if err := s.storage.CreateVerificationToken(account.ID, hash, time.Now().UTC().Add(verificationTokenTTL)); err != nil {
+		log.Printf("error storing verification token for account %s: %v", maskNumber(int64(account.ID)), err)
+		return
+	}
+
+	body := fmt.Sprintf("Welcome to gobank! Confirm your email address by visiting %s/verify?token=%s", s.publicURL, token)
+	if err := s.notifier.Send(account.Email, "Verify your gobank account", body); err != nil {
+		log.Printf("error sending verification email for account %s: %v", maskNumber(int64(account.ID)), err)
+	}
+}
+
+func (s *APIServer) handleVerify(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("method not allowed, %s", r.Method)
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return fmt.Errorf("missing token")
+	}
+
+	id, err := s.storage.VerifyAccount(hashToken(token))
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]int{"account verified successfully with id": id})
+}
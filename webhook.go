@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	outboxPollInterval = 5 * time.Second
+	outboxBatchSize    = 50
+	// outboxLease is how long a claimed message is left alone before it
+	// counts as abandoned; it must outlast a delivery attempt.
+	outboxLease = time.Minute
+	// outboxMaxAttempts is how many deliveries are tried before a message
+	// is given up on, waiting outboxRetryBase doubled after each failure.
+	outboxMaxAttempts = 10
+	outboxRetryBase   = 10 * time.Second
+	outboxRetryMax    = time.Hour
+
+	webhookTimeout = 10 * time.Second
+)
+
+// WebhookSender posts outbox messages to the configured URL.
+type WebhookSender struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+// Send delivers a message, succeeding only on a 2xx response. The body is
+// signed with HMAC-SHA256 in X-Gobank-Signature when a secret is set.
+func (ws *WebhookSender) Send(ctx context.Context, m *OutboxMessage) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gobank-Event", m.Type)
+	req.Header.Set("X-Gobank-Delivery", fmt.Sprint(m.ID))
+	if ws.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(ws.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Gobank-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := ws.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// runOutboxDispatcher delivers the queued webhook messages until ctx is
+// done.
+func (s *APIServer) runOutboxDispatcher(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.dispatchOutbox(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchOutbox delivers every message that is due, in batches.
+func (s *APIServer) dispatchOutbox(ctx context.Context) {
+	for ctx.Err() == nil {
+		now := time.Now().UTC()
+		messages, err := s.storage.ClaimOutboxMessages(now, now.Add(outboxLease), outboxBatchSize)
+		if err != nil {
+			log.Printf("error claiming outbox messages: %v", err)
+			return
+		}
+		if len(messages) == 0 {
+			return
+		}
+
+		for _, m := range messages {
+			sendCtx, cancel := context.WithTimeout(ctx, webhookTimeout)
+			err := s.webhooks.Send(sendCtx, m)
+			cancel()
+			if err == nil {
+				err = s.storage.MarkOutboxMessageSent(m.ID, time.Now().UTC())
+			} else {
+				err = s.storage.MarkOutboxMessageFailed(m.ID, nextOutboxAttempt(m.Attempts, time.Now().UTC()), err.Error())
+			}
+			if err != nil {
+				log.Printf("error updating outbox message %d: %v", m.ID, err)
+			}
+		}
+	}
+}
+
+// nextOutboxAttempt returns when to retry a message that failed its
+// attempts-th delivery, or nil once it ran out of attempts.
+func nextOutboxAttempt(attempts int, now time.Time) *time.Time {
+	if attempts >= outboxMaxAttempts {
+		return nil
+	}
+	delay := outboxRetryBase << (attempts - 1)
+	if delay > outboxRetryMax || delay <= 0 {
+		delay = outboxRetryMax
+	}
+	next := now.Add(delay)
+	return &next
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeOutboxStorage struct {
+	*fakeStorage
+	pending []*OutboxMessage
+	sent    []int64
+	failed  map[int64]*time.Time
+}
+
+func (s *fakeOutboxStorage) ClaimOutboxMessages(now, leaseUntil time.Time, limit int) ([]*OutboxMessage, error) {
+	claimed := s.pending
+	s.pending = nil
+	for _, m := range claimed {
+		m.Attempts++
+	}
+	return claimed, nil
+}
+
+func (s *fakeOutboxStorage) MarkOutboxMessageSent(id int64, at time.Time) error {
+	s.sent = append(s.sent, id)
+	return nil
+}
+
+func (s *fakeOutboxStorage) MarkOutboxMessageFailed(id int64, nextAttempt *time.Time, reason string) error {
+	s.failed[id] = nextAttempt
+	return nil
+}
+
+func TestDispatchOutbox(t *testing.T) {
+	var bodies [][]byte
+	var signatures []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		signatures = append(signatures, r.Header.Get("X-Gobank-Signature"))
+		if r.Header.Get("X-Gobank-Delivery") == "2" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer hook.Close()
+
+	store := &fakeOutboxStorage{
+		fakeStorage: newFakeStorage(),
+		pending: []*OutboxMessage{
+			{ID: 1, Type: EventTransferCreated, Payload: json.RawMessage(`{"amount":10}`)},
+			{ID: 2, Type: EventTransferCreated, Payload: json.RawMessage(`{"amount":20}`)},
+		},
+		failed: make(map[int64]*time.Time),
+	}
+	server := newTestServer(t, store)
+	server.webhooks = &WebhookSender{URL: hook.URL, Secret: "secret", Client: hook.Client()}
+
+	server.dispatchOutbox(context.Background())
+
+	assert.Equal(t, []int64{1}, store.sent)
+	if assert.Contains(t, store.failed, int64(2)) {
+		assert.NotNil(t, store.failed[2])
+	}
+	if assert.Len(t, bodies, 2) {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(bodies[0])
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signatures[0])
+
+		var got OutboxMessage
+		assert.NoError(t, json.Unmarshal(bodies[0], &got))
+		assert.Equal(t, int64(1), got.ID)
+		assert.JSONEq(t, `{"amount":10}`, string(got.Payload))
+	}
+}
+
+func TestNextOutboxAttempt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{9, 2560 * time.Second},
+	}
+	for _, tt := range tests {
+		next := nextOutboxAttempt(tt.attempts, now)
+		if assert.NotNil(t, next, "attempts %d", tt.attempts) {
+			assert.Equal(t, tt.want, next.Sub(now), "attempts %d", tt.attempts)
+		}
+	}
+
+	assert.Nil(t, nextOutboxAttempt(outboxMaxAttempts, now))
+}